@@ -28,6 +28,11 @@ const (
 	MISSING_RESULT                 = 5
 	INTERNAL_ERROR                 = 6
 	PROTOCOL_ERROR                 = 7
+	// The server is too busy to handle the call. Not part of the Apache
+	// Thrift set of exception types, so 8 to 10 are left unused.
+	OVERLOADED = 11
+	// The caller is not allowed to make the call.
+	PERMISSION_DENIED = 12
 )
 
 // Application level Thrift exception
@@ -140,3 +145,18 @@ func (p *tApplicationException) Write(oprot TProtocol) (err error) {
 	err = oprot.WriteStructEnd()
 	return
 }
+
+// Replies to the call name/seqId, whose arguments have already been read,
+// with exc.
+func writeApplicationException(out TProtocol, name string, seqId int32, exc TApplicationException) error {
+	if err := out.WriteMessageBegin(name, EXCEPTION, seqId); err != nil {
+		return err
+	}
+	if err := exc.Write(out); err != nil {
+		return err
+	}
+	if err := out.WriteMessageEnd(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
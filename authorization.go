@@ -0,0 +1,92 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Decides whether the caller with identity, nil if it presented no
+// verified client certificate, may call method. A non-nil error denies
+// the call and is sent to the caller.
+type TAuthorizer func(ctx context.Context, identity *TPeerIdentity, method string) error
+
+// NewTAuthorizationMiddleware returns a middleware answering the calls
+// authorize denies with a PERMISSION_DENIED TApplicationException.
+func NewTAuthorizationMiddleware(authorize TAuthorizer) TMiddleware {
+	return func(next TCallHandler) TCallHandler {
+		return func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+			identity, _ := PeerIdentityFromContext(ctx)
+			if err := authorize(ctx, identity, call.Name); err != nil {
+				return RejectCall(call, in, out, NewTApplicationException(PERMISSION_DENIED, err.Error()))
+			}
+			return next(ctx, call, in, out)
+		}
+	}
+}
+
+// Matches any identity or method in a TMethodPolicy.
+const POLICY_ANY = "*"
+
+var errPermissionDenied = errors.New("Permission denied")
+
+// TMethodPolicy allows calls by identity name, as returned by
+// TPeerIdentity.Name, and method, denying all others. Callers without a
+// verified identity are always denied.
+type TMethodPolicy struct {
+	mu    sync.RWMutex
+	rules map[string]map[string]bool
+}
+
+func NewTMethodPolicy() *TMethodPolicy {
+	return &TMethodPolicy{rules: make(map[string]map[string]bool)}
+}
+
+// Allows the identity name, or any identity if POLICY_ANY, to call the
+// given methods, or any method if one of them is POLICY_ANY.
+func (p *TMethodPolicy) Allow(name string, methods ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	allowed, ok := p.rules[name]
+	if !ok {
+		allowed = make(map[string]bool)
+		p.rules[name] = allowed
+	}
+	for _, method := range methods {
+		allowed[method] = true
+	}
+}
+
+// Authorize is a TAuthorizer applying the policy.
+func (p *TMethodPolicy) Authorize(ctx context.Context, identity *TPeerIdentity, method string) error {
+	if identity == nil {
+		return errPermissionDenied
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, name := range []string{identity.Name(), POLICY_ANY} {
+		if allowed := p.rules[name]; allowed[method] || allowed[POLICY_ANY] {
+			return nil
+		}
+	}
+	return errPermissionDenied
+}
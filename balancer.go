@@ -0,0 +1,423 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ways of picking the endpoint a TBalancer lends a transport to.
+type TBalancingStrategy int
+
+const (
+	// Each endpoint in turn.
+	BALANCE_ROUND_ROBIN TBalancingStrategy = iota
+	// The endpoint with the fewest transports lent out.
+	BALANCE_LEAST_OUTSTANDING
+	// The one with fewer transports lent out of two endpoints picked at
+	// random, which avoids herding onto a single endpoint.
+	BALANCE_POWER_OF_TWO
+)
+
+// Defaults of a TBalancer.
+const (
+	DEFAULT_EJECT_FAILURES   = 5
+	DEFAULT_EJECT_DURATION   = 10 * time.Second
+	DEFAULT_RESOLVE_INTERVAL = 30 * time.Second
+)
+
+// An endpoint stays ejected for at most this many times the ejection
+// duration after failing repeated probes.
+const maxEjectBackoff = 8
+
+// Provides the addresses, as host:port, of the endpoints of a service.
+type TResolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+type tStaticResolver []string
+
+func (p tStaticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return append([]string(nil), p...), nil
+}
+
+// Returns a resolver of a fixed list of addresses.
+func NewTStaticResolver(addrs ...string) TResolver {
+	return tStaticResolver(addrs)
+}
+
+type tDNSResolver struct {
+	host string
+	port string
+}
+
+func (p *tDNSResolver) Resolve(ctx context.Context) ([]string, error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, p.host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, p.port)
+	}
+	return addrs, nil
+}
+
+// Returns a resolver of the A and AAAA records of host, with the given
+// port.
+func NewTDNSResolver(host string, port int) TResolver {
+	return &tDNSResolver{host: host, port: strconv.Itoa(port)}
+}
+
+type tSRVResolver struct {
+	service string
+	proto   string
+	name    string
+}
+
+func (p *tSRVResolver) Resolve(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, p.service, p.proto, p.name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(records))
+	for i, record := range records {
+		addrs[i] = net.JoinHostPort(record.Target, strconv.Itoa(int(record.Port)))
+	}
+	return addrs, nil
+}
+
+// Returns a resolver of the SRV records of _service._proto.name, as
+// net.LookupSRV looks them up.
+func NewTSRVResolver(service, proto, name string) TResolver {
+	return &tSRVResolver{service: service, proto: proto, name: name}
+}
+
+// The state of an endpoint of a TBalancer.
+type TEndpointStats struct {
+	Addr string
+	// The transports lent out.
+	Outstanding int
+	// The failures since the last success.
+	Failures int
+	Ejected  bool
+	Pool     TTransportPoolStats
+}
+
+type tEndpoint struct {
+	addr        string
+	pool        *TTransportPool
+	outstanding int
+	failures    int
+	// The number of times the endpoint was ejected in a row, and until
+	// when. Once that time has passed, a single probe is let through.
+	ejections    int
+	ejectedUntil time.Time
+	probing      bool
+	// Counts the ejections, so that calls started before the latest one
+	// can be told apart.
+	generation int
+}
+
+// A TTransportSource spreading calls over the endpoints of a service, each
+// with a pool of transports. Endpoints failing repeatedly are ejected for a
+// while, after which a single call probes whether they recovered. The
+// endpoints are looked up with a TResolver, again at regular intervals if
+// WatchResolver is called.
+//
+// A transport counts as failed if it failed a read, write or flush, or was
+// discarded, as clients do after such errors.
+type TBalancer struct {
+	resolver TResolver
+	dial     func(addr string) TTransportDialer
+
+	mu            sync.Mutex
+	endpoints     []*tEndpoint
+	resolved      bool
+	next          int
+	strategy      TBalancingStrategy
+	ejectFailures int
+	ejectDuration time.Duration
+	configurePool func(*TTransportPool)
+	stopWatching  chan struct{}
+	closed        bool
+	now           func() time.Time
+	// Returns a random number in [0, n).
+	random func(n int) int
+}
+
+// Creates a balancer over the endpoints resolver provides, opening
+// transports to each with the dialer dial returns for its address.
+func NewTBalancer(resolver TResolver, dial func(addr string) TTransportDialer) *TBalancer {
+	return &TBalancer{
+		resolver:      resolver,
+		dial:          dial,
+		ejectFailures: DEFAULT_EJECT_FAILURES,
+		ejectDuration: DEFAULT_EJECT_DURATION,
+		now:           time.Now,
+		random:        rand.Intn,
+	}
+}
+
+func (p *TBalancer) SetStrategy(strategy TBalancingStrategy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.strategy = strategy
+}
+
+// Sets after how many failures in a row an endpoint is ejected, and for how
+// long at first. The duration doubles each time a probe fails.
+func (p *TBalancer) SetEjection(failures int, duration time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ejectFailures = failures
+	p.ejectDuration = duration
+}
+
+// Sets a function configuring the pool of each new endpoint, such as its
+// limits.
+func (p *TBalancer) SetPoolConfigurator(configure func(*TTransportPool)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configurePool = configure
+}
+
+// Looks up the endpoints, adding new ones and closing the pools of those
+// that went away. On error, the endpoints are left as they are.
+func (p *TBalancer) Refresh(ctx context.Context) error {
+	addrs, err := p.resolver.Resolve(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil || p.closed {
+		return err
+	}
+	sort.Strings(addrs)
+	current := make(map[string]*tEndpoint, len(p.endpoints))
+	for _, e := range p.endpoints {
+		current[e.addr] = e
+	}
+	endpoints := make([]*tEndpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		if e, ok := current[addr]; ok {
+			endpoints = append(endpoints, e)
+			delete(current, addr)
+			continue
+		}
+		if len(endpoints) > 0 && endpoints[len(endpoints)-1].addr == addr {
+			continue
+		}
+		pool := NewTTransportPool(p.dial(addr))
+		if p.configurePool != nil {
+			p.configurePool(pool)
+		}
+		endpoints = append(endpoints, &tEndpoint{addr: addr, pool: pool})
+	}
+	for _, e := range current {
+		e.pool.Close()
+	}
+	p.endpoints = endpoints
+	p.resolved = true
+	return nil
+}
+
+// Refreshes the endpoints every interval until the balancer is closed.
+func (p *TBalancer) WatchResolver(interval time.Duration) {
+	p.mu.Lock()
+	if p.stopWatching != nil || p.closed {
+		p.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	p.stopWatching = stop
+	p.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				p.Refresh(ctx)
+				cancel()
+			}
+		}
+	}()
+}
+
+func (p *TBalancer) Endpoints() []TEndpointStats {
+	p.mu.Lock()
+	endpoints := append([]*tEndpoint(nil), p.endpoints...)
+	stats := make([]TEndpointStats, len(endpoints))
+	now := p.now()
+	for i, e := range endpoints {
+		stats[i] = TEndpointStats{Addr: e.addr, Outstanding: e.outstanding, Failures: e.failures, Ejected: now.Before(e.ejectedUntil)}
+	}
+	p.mu.Unlock()
+	for i, e := range endpoints {
+		stats[i].Pool = e.pool.Stats()
+	}
+	return stats
+}
+
+// Lends out a transport to the endpoint picked by the strategy, looking up
+// the endpoints first if that has not happened yet.
+func (p *TBalancer) Get(ctx context.Context) (*TPooledTransport, error) {
+	p.mu.Lock()
+	resolved := p.resolved
+	p.mu.Unlock()
+	if !resolved {
+		if err := p.Refresh(ctx); err != nil {
+			return nil, NewTTransportException(NOT_OPEN, "Unable to resolve endpoints: "+err.Error())
+		}
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	e := p.pickLocked()
+	if e == nil {
+		p.mu.Unlock()
+		return nil, NewTTransportException(NOT_OPEN, "No available endpoints")
+	}
+	e.outstanding++
+	// Calls to an endpoint whose ejection is over probe whether it
+	// recovered.
+	probe := !e.ejectedUntil.IsZero()
+	if probe {
+		e.probing = true
+	}
+	generation := e.generation
+	p.mu.Unlock()
+	trans, err := e.pool.Get(ctx)
+	if err != nil {
+		// Only failing to connect counts against the endpoint, and not
+		// waiting for one of its busy transports.
+		p.done(e, probe, generation, err != errPoolClosed && err != errPoolWaitTimeout && ctx.Err() == nil)
+		return nil, err
+	}
+	trans.onClose = func(failed bool) { p.done(e, probe, generation, failed) }
+	return trans, nil
+}
+
+// done records the outcome of a call to e, which probed e if probe is set
+// and started in the given ejection generation. The outcomes of calls
+// started before the latest ejection are ignored, so that only a probe
+// ends it.
+func (p *TBalancer) done(e *tEndpoint, probe bool, generation int, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.outstanding--
+	if probe {
+		e.probing = false
+	}
+	if generation != e.generation {
+		return
+	}
+	if !failed {
+		e.failures = 0
+		e.ejections = 0
+		e.ejectedUntil = time.Time{}
+		return
+	}
+	e.failures++
+	if probe || e.ejectedUntil.IsZero() && e.failures >= p.ejectFailures {
+		if e.ejections < maxEjectBackoff {
+			e.ejections++
+		}
+		backoff := 1
+		for i := 1; i < e.ejections && backoff < maxEjectBackoff; i++ {
+			backoff *= 2
+		}
+		e.ejectedUntil = p.now().Add(time.Duration(backoff) * p.ejectDuration)
+		e.generation++
+	}
+}
+
+// available reports whether e may be picked: it is not ejected, or its
+// ejection is over and no probe is in flight.
+func (p *TBalancer) available(e *tEndpoint, now time.Time) bool {
+	return e.ejectedUntil.IsZero() || !now.Before(e.ejectedUntil) && !e.probing
+}
+
+func (p *TBalancer) pickLocked() *tEndpoint {
+	now := p.now()
+	available := make([]*tEndpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if p.available(e, now) {
+			available = append(available, e)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	switch p.strategy {
+	case BALANCE_LEAST_OUTSTANDING:
+		// Start at a rotating index, so that ties are spread.
+		p.next++
+		var best *tEndpoint
+		for i := range available {
+			e := available[(p.next+i)%len(available)]
+			if best == nil || e.outstanding < best.outstanding {
+				best = e
+			}
+		}
+		return best
+	case BALANCE_POWER_OF_TWO:
+		if len(available) == 1 {
+			return available[0]
+		}
+		i, j := p.random(len(available)), p.random(len(available)-1)
+		if j >= i {
+			j++
+		}
+		if available[j].outstanding < available[i].outstanding {
+			return available[j]
+		}
+		return available[i]
+	default:
+		p.next++
+		return available[p.next%len(available)]
+	}
+}
+
+// Stops watching the resolver and closes the pools of all endpoints.
+func (p *TBalancer) Close() error {
+	p.mu.Lock()
+	endpoints := p.endpoints
+	p.endpoints = nil
+	p.closed = true
+	if p.stopWatching != nil {
+		close(p.stopWatching)
+	}
+	p.mu.Unlock()
+	for _, e := range endpoints {
+		e.pool.Close()
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testEndpointTransport struct {
+	*TMemoryBuffer
+	addr string
+}
+
+// Dials memory buffers tagged with their address, failing for the
+// addresses marked down.
+type testEndpointDialer struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (p *testEndpointDialer) setDown(addr string, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[addr] = down
+}
+
+func (p *testEndpointDialer) dialer(addr string) TTransportDialer {
+	return func(ctx context.Context) (TTransport, error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.down[addr] {
+			return nil, NewTTransportException(NOT_OPEN, "connection refused")
+		}
+		return &testEndpointTransport{TMemoryBuffer: NewTMemoryBuffer(), addr: addr}, nil
+	}
+}
+
+// A resolver whose addresses can be changed.
+type testResolver struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (p *testResolver) set(addrs ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addrs = addrs
+}
+
+func (p *testResolver) Resolve(ctx context.Context) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.addrs...), nil
+}
+
+func newTestBalancer(addrs ...string) (*TBalancer, *testEndpointDialer) {
+	dialer := &testEndpointDialer{down: make(map[string]bool)}
+	return NewTBalancer(NewTStaticResolver(addrs...), dialer.dialer), dialer
+}
+
+// getFrom borrows a transport from balancer, returning it along with the
+// address of its endpoint, or "" if borrowing failed.
+func getFrom(t *testing.T, balancer *TBalancer) (*TPooledTransport, string) {
+	trans, err := balancer.Get(context.Background())
+	if err != nil {
+		return nil, ""
+	}
+	return trans, trans.TTransport.(*testEndpointTransport).addr
+}
+
+func TestBalancerStrategies(t *testing.T) {
+	balancer, _ := newTestBalancer("c:1", "a:1", "b:1")
+	defer balancer.Close()
+	var picked []string
+	for i := 0; i < 6; i++ {
+		trans, addr := getFrom(t, balancer)
+		picked = append(picked, addr)
+		trans.Close()
+	}
+	if got := strings.Join(picked, " "); got != "b:1 c:1 a:1 b:1 c:1 a:1" {
+		t.Errorf("Unexpected round robin order: %s", got)
+	}
+
+	balancer.SetStrategy(BALANCE_LEAST_OUTSTANDING)
+	held := make(map[string]*TPooledTransport)
+	for i := 0; i < 3; i++ {
+		trans, addr := getFrom(t, balancer)
+		if held[addr] != nil {
+			t.Errorf("Expected %s not to be picked again while others have fewer transports out", addr)
+		}
+		held[addr] = trans
+	}
+	held["b:1"].Close()
+	trans, addr := getFrom(t, balancer)
+	if addr != "b:1" {
+		t.Errorf("Expected the endpoint with fewest transports out to be picked, got %s", addr)
+	}
+	held["b:1"] = trans
+	for _, e := range balancer.Endpoints() {
+		if e.Outstanding != 1 || e.Pool.InUse != 1 {
+			t.Errorf("Unexpected endpoint stats: %+v", e)
+		}
+	}
+
+	balancer.SetStrategy(BALANCE_POWER_OF_TWO)
+	held["a:1"].Close()
+	picks := [][2]int{{1, 0}, {1, 1}, {2, 0}}
+	balancer.random = func(n int) int {
+		pick := picks[0][0]
+		if n == 2 {
+			pick = picks[0][1]
+			picks = picks[1:]
+		}
+		return pick
+	}
+	// Choices b and a, then b and c, then c and a: the one with fewer
+	// transports out wins, the first if tied.
+	for _, expected := range []string{"a:1", "b:1", "a:1"} {
+		trans, addr := getFrom(t, balancer)
+		if addr != expected {
+			t.Errorf("Expected %s to be picked, got %s", expected, addr)
+		}
+		trans.Close()
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	balancer, dialer := newTestBalancer("a:1", "b:1")
+	defer balancer.Close()
+	now := time.Now()
+	balancer.now = func() time.Time { return now }
+	balancer.SetEjection(2, time.Second)
+	dialer.setDown("a:1", true)
+
+	var picked []string
+	for i := 0; i < 6; i++ {
+		trans, addr := getFrom(t, balancer)
+		picked = append(picked, addr)
+		if trans != nil {
+			trans.Close()
+		}
+	}
+	if got := strings.Join(picked, ","); got != "b:1,,b:1,,b:1,b:1" {
+		t.Errorf("Expected a:1 to be ejected after failing twice: %s", got)
+	}
+	if stats := balancer.Endpoints(); !stats[0].Ejected || stats[0].Failures != 2 || stats[1].Ejected {
+		t.Errorf("Unexpected endpoint stats: %+v", stats)
+	}
+
+	// Once the ejection is over, a single probe is let through, and its
+	// failure ejects the endpoint for twice as long.
+	now = now.Add(time.Second)
+	trans, _ := getFrom(t, balancer)
+	if _, addr := getFrom(t, balancer); addr != "" {
+		t.Errorf("Expected the probe to fail, got %s", addr)
+	}
+	trans.Close()
+	now = now.Add(time.Second)
+	if _, addr := getFrom(t, balancer); addr != "b:1" {
+		t.Errorf("Expected a:1 to be ejected again, got %s", addr)
+	}
+	now = now.Add(time.Second)
+	dialer.setDown("a:1", false)
+	probed := false
+	for i := 0; i < 2; i++ {
+		trans, addr := getFrom(t, balancer)
+		probed = probed || addr == "a:1"
+		trans.Close()
+	}
+	if !probed {
+		t.Fatal("Expected a:1 to be probed")
+	}
+	if stats := balancer.Endpoints(); stats[0].Ejected || stats[0].Failures != 0 {
+		t.Errorf("Expected a:1 to be restored after a successful probe: %+v", stats)
+	}
+
+	// A transport that failed counts as a failure of its endpoint.
+	for i := 0; i < 4; i++ {
+		trans, _ := balancer.Get(context.Background())
+		trans.Discard()
+	}
+	if stats := balancer.Endpoints(); !stats[0].Ejected || !stats[1].Ejected {
+		t.Errorf("Expected endpoints with failed transports to be ejected: %+v", stats)
+	}
+	if _, err := balancer.Get(context.Background()); err == nil {
+		t.Error("Expected Get to fail with all endpoints ejected")
+	}
+}
+
+func TestBalancerIgnoresPoolWaits(t *testing.T) {
+	balancer, _ := newTestBalancer("a:1")
+	defer balancer.Close()
+	balancer.SetEjection(1, time.Second)
+	balancer.SetPoolConfigurator(func(pool *TTransportPool) {
+		pool.SetMaxOpen(1)
+		pool.SetWaitTimeout(time.Millisecond)
+	})
+	busy, _ := getFrom(t, balancer)
+	for i := 0; i < 3; i++ {
+		if _, err := balancer.Get(context.Background()); err != errPoolWaitTimeout {
+			t.Fatalf("Expected waiting for a transport to time out, got %v", err)
+		}
+	}
+	busy.Close()
+	if stats := balancer.Endpoints(); stats[0].Ejected || stats[0].Failures != 0 {
+		t.Errorf("Expected a busy endpoint not to count as failing: %+v", stats)
+	}
+}
+
+func TestBalancerProbeOutlivesEarlierCalls(t *testing.T) {
+	balancer, _ := newTestBalancer("a:1")
+	defer balancer.Close()
+	now := time.Now()
+	balancer.now = func() time.Time { return now }
+	balancer.SetEjection(1, time.Second)
+
+	earlier, _ := getFrom(t, balancer)
+	failing, _ := getFrom(t, balancer)
+	failing.Discard()
+	now = now.Add(time.Second)
+	probe, addr := getFrom(t, balancer)
+	if addr != "a:1" {
+		t.Fatal("Expected a:1 to be probed")
+	}
+	// A call made before the ejection ending does not end the probe.
+	earlier.Discard()
+	if stats := balancer.Endpoints(); stats[0].Ejected {
+		t.Errorf("Expected an earlier call not to eject a:1 again: %+v", stats)
+	}
+	if _, addr := getFrom(t, balancer); addr != "" {
+		t.Errorf("Expected no call to a:1 while the probe is in flight, got %s", addr)
+	}
+	probe.Close()
+	if _, addr := getFrom(t, balancer); addr != "a:1" {
+		t.Errorf("Expected a:1 restored after the probe succeeded, got %q", addr)
+	}
+}
+
+func TestBalancerSlowCallDoesNotEndEjection(t *testing.T) {
+	balancer, _ := newTestBalancer("a:1")
+	defer balancer.Close()
+	now := time.Now()
+	balancer.now = func() time.Time { return now }
+	balancer.SetEjection(1, time.Second)
+
+	slow, _ := getFrom(t, balancer)
+	failing, _ := getFrom(t, balancer)
+	failing.Discard()
+	// A call started before the ejection succeeding is no probe.
+	slow.Close()
+	if stats := balancer.Endpoints(); !stats[0].Ejected || stats[0].Failures != 1 {
+		t.Errorf("Expected a:1 to stay ejected: %+v", stats)
+	}
+	if _, addr := getFrom(t, balancer); addr != "" {
+		t.Errorf("Expected no call to a:1 while it is ejected, got %s", addr)
+	}
+	now = now.Add(time.Second)
+	probe, addr := getFrom(t, balancer)
+	if addr != "a:1" {
+		t.Fatal("Expected a:1 to be probed")
+	}
+	probe.Close()
+	if stats := balancer.Endpoints(); stats[0].Ejected || stats[0].Failures != 0 {
+		t.Errorf("Expected a:1 restored after the probe succeeded: %+v", stats)
+	}
+}
+
+func TestBalancerResolver(t *testing.T) {
+	resolver := &testResolver{}
+	resolver.set("a:1", "b:1")
+	dialer := &testEndpointDialer{down: make(map[string]bool)}
+	balancer := NewTBalancer(resolver, dialer.dialer)
+	defer balancer.Close()
+	held, _ := getFrom(t, balancer)
+
+	resolver.set("b:1", "c:1", "c:1")
+	balancer.WatchResolver(10 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats := balancer.Endpoints()
+		if len(stats) == 2 && stats[0].Addr == "b:1" && stats[1].Addr == "c:1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the endpoints to be refreshed: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	held.Close()
+	for i := 0; i < 4; i++ {
+		trans, addr := getFrom(t, balancer)
+		if addr == "a:1" {
+			t.Error("Expected a removed endpoint not to be picked")
+		}
+		trans.Close()
+	}
+
+	addrs, err := NewTDNSResolver("localhost", 9090).Resolve(context.Background())
+	if err != nil {
+		t.Skipf("Unable to resolve localhost: %v", err)
+	}
+	for _, addr := range addrs {
+		if !strings.HasSuffix(addr, ":9090") {
+			t.Errorf("Unexpected address %s", addr)
+		}
+	}
+}
+
+func TestBalancerRetries(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		server, addr, done := startTestServer(t, &sleepProcessor{})
+		defer func() {
+			server.Stop()
+			waitServe(t, done)
+		}()
+		addrs = append(addrs, addr)
+	}
+	// An endpoint nothing listens on.
+	addrs = append(addrs, "127.0.0.1:1")
+	balancer := NewTBalancer(NewTStaticResolver(addrs...), func(addr string) TTransportDialer {
+		return NewTSocketDialer(addr, time.Second, nil)
+	})
+	defer balancer.Close()
+	client := NewTRetryingClient(balancer, NewTBinaryProtocolFactoryDefault())
+	client.SetBackoff(time.Millisecond, time.Millisecond)
+	for i := 0; i < 6; i++ {
+		if err := client.Call(context.Background(), "test", &testSleepArgs{}, &testEmptyResult{}); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+	}
+	for _, e := range balancer.Endpoints() {
+		if e.Addr == "127.0.0.1:1" && e.Failures == 0 {
+			t.Errorf("Expected the unreachable endpoint to fail: %+v", e)
+		} else if e.Addr != "127.0.0.1:1" && e.Pool.Dialed != 1 {
+			t.Errorf("Expected one connection to %s to be reused: %+v", e.Addr, e)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// A TProcessor dispatching each call to the TProcessorFunction registered
+// for its method, for use by generated and hand-written services alike.
+//
+// Calls to unknown methods have their arguments skipped and are answered
+// with an UNKNOWN_METHOD TApplicationException, or not at all if they are
+// oneway. Messages that are neither CALL nor ONEWAY are answered with an
+// INVALID_MESSAGE_TYPE_EXCEPTION. Registered functions receive the server's
+// context if they were adapted with NewTProcessorFunctionFromContext.
+type TBaseProcessor struct {
+	mu           sync.RWMutex
+	processorMap map[string]TProcessorFunction
+}
+
+func NewTBaseProcessor() *TBaseProcessor {
+	return &TBaseProcessor{processorMap: make(map[string]TProcessorFunction)}
+}
+
+// Registers function as the handler of calls to the method name.
+func (p *TBaseProcessor) AddToProcessorMap(name string, function TProcessorFunction) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processorMap[name] = function
+}
+
+func (p *TBaseProcessor) GetProcessorFunction(name string) (TProcessorFunction, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	function, ok := p.processorMap[name]
+	return function, ok
+}
+
+// Returns a copy of the registered functions by method name.
+func (p *TBaseProcessor) ProcessorMap() map[string]TProcessorFunction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m := make(map[string]TProcessorFunction, len(p.processorMap))
+	for name, function := range p.processorMap {
+		m[name] = function
+	}
+	return m
+}
+
+func (p *TBaseProcessor) Process(in, out TProtocol) (bool, TException) {
+	return p.ProcessContext(context.Background(), in, out)
+}
+
+// Processes a call like Process, passing ctx on to the registered function.
+func (p *TBaseProcessor) ProcessContext(ctx context.Context, in, out TProtocol) (bool, TException) {
+	name, typeId, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	if typeId != CALL && typeId != ONEWAY {
+		exc := NewTApplicationException(INVALID_MESSAGE_TYPE_EXCEPTION, fmt.Sprintf("Invalid message type %d for %s", typeId, name))
+		return false, p.reject(name, typeId, seqId, in, out, exc)
+	}
+	if function, ok := p.GetProcessorFunction(name); ok {
+		// Tell wrapped functions the message type; the header is not replayed.
+		in = &tMessageHeaderProtocol{TProtocol: in, name: name, typeId: typeId, seqId: seqId, replayed: true}
+		return NewTContextProcessorFunction(function).Process(ctx, seqId, in, out)
+	}
+	exc := NewTApplicationException(UNKNOWN_METHOD, "Unknown function "+name)
+	return false, p.reject(name, typeId, seqId, in, out, exc)
+}
+
+// reject skips the arguments of a call that cannot be processed and, unless
+// it is oneway, replies with exc. It returns exc, or the error that
+// prevented the reply.
+func (p *TBaseProcessor) reject(name string, typeId TMessageType, seqId int32, in, out TProtocol, exc TApplicationException) TException {
+	if err := in.Skip(STRUCT); err != nil {
+		return err
+	}
+	if err := in.ReadMessageEnd(); err != nil {
+		return err
+	}
+	if typeId == ONEWAY {
+		return exc
+	}
+	if err := writeApplicationException(out, name, seqId, exc); err != nil {
+		return err
+	}
+	return exc
+}
+
+func (p *TBaseProcessor) contextProcessor() TContextProcessor {
+	return &tBaseContextProcessor{p}
+}
+
+type tBaseContextProcessor struct {
+	processor *TBaseProcessor
+}
+
+func (p *tBaseContextProcessor) Process(ctx context.Context, in, out TProtocol) (bool, TException) {
+	return p.processor.ProcessContext(ctx, in, out)
+}
@@ -0,0 +1,105 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"testing"
+)
+
+func newTestBaseProcessor() *TBaseProcessor {
+	processor := NewTBaseProcessor()
+	processor.AddToProcessorMap("echo", &emptyReplyFunction{})
+	return processor
+}
+
+func TestBaseProcessorDispatch(t *testing.T) {
+	processor := newTestBaseProcessor()
+	if _, ok := processor.GetProcessorFunction("echo"); !ok {
+		t.Fatal("Registered function not found")
+	}
+	if m := processor.ProcessorMap(); len(m) != 1 {
+		t.Fatalf("Unexpected processor map: %v", m)
+	}
+	in := NewTMemoryBuffer()
+	out := NewTMemoryBuffer()
+	pf := NewTBinaryProtocolFactoryDefault()
+	sendTestCall(pf.GetProtocol(in), "echo", 3, 0)
+	if ok, err := processor.Process(pf.GetProtocol(in), pf.GetProtocol(out)); !ok || err != nil {
+		t.Fatalf("Process failed: %v %v", ok, err)
+	}
+	if name, typeId, seqId, err := readTestReply(pf.GetProtocol(out)); name != "echo" || typeId != REPLY || seqId != 3 || err != nil {
+		t.Errorf("Unexpected reply: %s %d %d %v", name, typeId, seqId, err)
+	}
+}
+
+func TestBaseProcessorUnknownMethod(t *testing.T) {
+	server, addr, done := startTestServer(t, newTestBaseProcessor())
+	prot := openTestClient(t, addr)
+	sendTestCall(prot, "missing", 1, 0)
+	_, typeId, seqId, err := readTestReply(prot)
+	if e, ok := err.(TApplicationException); !ok || e.TypeId() != UNKNOWN_METHOD || typeId != EXCEPTION || seqId != 1 {
+		t.Fatalf("Expected UNKNOWN_METHOD, got %d %d %v", typeId, seqId, err)
+	}
+	// The connection stays usable.
+	if err := callTestServer(prot, "echo", 2, 0); err != nil {
+		t.Fatalf("Call after unknown method failed: %v", err)
+	}
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestBaseProcessorUnknownOneway(t *testing.T) {
+	in := NewTMemoryBuffer()
+	out := NewTMemoryBuffer()
+	pf := NewTBinaryProtocolFactoryDefault()
+	prot := pf.GetProtocol(in)
+	prot.WriteMessageBegin("missing", ONEWAY, 1)
+	prot.WriteStructBegin("args")
+	prot.WriteFieldStop()
+	prot.WriteStructEnd()
+	prot.WriteMessageEnd()
+	_, err := newTestBaseProcessor().Process(pf.GetProtocol(in), pf.GetProtocol(out))
+	if e, ok := err.(TApplicationException); !ok || e.TypeId() != UNKNOWN_METHOD {
+		t.Errorf("Expected UNKNOWN_METHOD, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Unexpected reply of %d bytes to a oneway call", out.Len())
+	}
+}
+
+func TestBaseProcessorInvalidMessageType(t *testing.T) {
+	in := NewTMemoryBuffer()
+	out := NewTMemoryBuffer()
+	pf := NewTBinaryProtocolFactoryDefault()
+	prot := pf.GetProtocol(in)
+	prot.WriteMessageBegin("echo", REPLY, 4)
+	prot.WriteStructBegin("result")
+	prot.WriteFieldStop()
+	prot.WriteStructEnd()
+	prot.WriteMessageEnd()
+	if ok, _ := newTestBaseProcessor().Process(pf.GetProtocol(in), pf.GetProtocol(out)); ok {
+		t.Error("Expected Process to stop on an invalid message type")
+	}
+	_, typeId, seqId, err := readTestReply(pf.GetProtocol(out))
+	if e, ok := err.(TApplicationException); !ok || e.TypeId() != INVALID_MESSAGE_TYPE_EXCEPTION || typeId != EXCEPTION || seqId != 4 {
+		t.Errorf("Expected INVALID_MESSAGE_TYPE_EXCEPTION, got %d %d %v", typeId, seqId, err)
+	}
+}
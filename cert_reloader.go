@@ -0,0 +1,263 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TCertReloader serves a TLS certificate and, optionally, a bundle of CAs
+// trusted to sign client certificates, loaded from files that may be
+// replaced while the server runs. Reloading happens on Reload, on SIGHUP
+// after WatchSignal and on changes to the files after Poll. Handshakes
+// after a reload use the new files; connections already established are
+// not affected. A failed reload keeps the previous files in use and is
+// reported to the logger and the error handler.
+type TCertReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	logger   TLogger
+
+	mu           sync.RWMutex
+	cert         *tls.Certificate
+	clientCAs    *x509.CertPool
+	lastErr      error
+	errorHandler func(error)
+	stamps       map[string]fileStamp
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// What Poll compares to tell whether a file has changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Loads the certificate and key from certFile and keyFile, and the CA
+// bundle from caFile unless it is empty.
+func NewTCertReloader(certFile, keyFile, caFile string) (*TCertReloader, error) {
+	p := &TCertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		stop:     make(chan struct{}),
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Sets the logger reload failures are reported to, DefaultLogger() if nil.
+func (p *TCertReloader) SetLogger(logger TLogger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logger = logger
+}
+
+// Sets a function to be told of each failed reload.
+func (p *TCertReloader) SetErrorHandler(handler func(error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.errorHandler = handler
+}
+
+// Returns the error of the last reload, or nil if it succeeded.
+func (p *TCertReloader) LastError() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastErr
+}
+
+// Reloads the files now. On failure the previous files stay in use.
+func (p *TCertReloader) Reload() error {
+	err := p.load()
+	if err != nil {
+		p.mu.RLock()
+		logger, handler := p.logger, p.errorHandler
+		p.mu.RUnlock()
+		if logger == nil {
+			logger = DefaultLogger()
+		}
+		logger.Error("thrift: reloading TLS certificates failed", logAttrs(nil, "", err)...)
+		if handler != nil {
+			handler(err)
+		}
+	}
+	return err
+}
+
+func (p *TCertReloader) load() error {
+	stamps := make(map[string]fileStamp)
+	for _, name := range []string{p.certFile, p.keyFile, p.caFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			stamps[name] = fileStamp{info.ModTime(), info.Size()}
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	var clientCAs *x509.CertPool
+	if err == nil && p.caFile != "" {
+		clientCAs, err = loadCertPool(p.caFile)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Remember the files even if they are broken, so that Poll waits for
+	// them to change again.
+	p.stamps = stamps
+	p.lastErr = err
+	if err != nil {
+		return err
+	}
+	p.cert = &cert
+	p.clientCAs = clientCAs
+	return nil
+}
+
+func loadCertPool(name string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + name)
+	}
+	return pool, nil
+}
+
+// Reloads the files whenever one of sigs is received, or SIGHUP if none
+// are given, until Stop.
+func (p *TCertReloader) WatchSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ch:
+				p.Reload()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Checks the files every interval and reloads them when one has changed,
+// until Stop.
+func (p *TCertReloader) Poll(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if p.changed() {
+					p.Reload()
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// changed reports whether a file differs from when it was last loaded.
+func (p *TCertReloader) changed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, name := range []string{p.certFile, p.keyFile, p.caFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			// Likely being replaced; look again next time.
+			continue
+		}
+		if p.stamps[name] != (fileStamp{info.ModTime(), info.Size()}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops watching for signals and polling.
+func (p *TCertReloader) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// Returns the current certificate, for tls.Config.GetCertificate.
+func (p *TCertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cert, nil
+}
+
+// Returns the current CA bundle, or nil if none was given.
+func (p *TCertReloader) ClientCAs() *x509.CertPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.clientCAs
+}
+
+// Returns a copy of base, which may be nil, serving the current
+// certificate and trusting the current CA bundle for client certificates
+// in each handshake. The certificates and GetConfigForClient of base are
+// replaced.
+func (p *TCertReloader) Config(base *tls.Config) *tls.Config {
+	if base == nil {
+		base = &tls.Config{}
+	}
+	cfg := base.Clone()
+	cfg.Certificates = nil
+	cfg.GetCertificate = p.GetCertificate
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		c := cfg.Clone()
+		c.Certificates = []tls.Certificate{*p.cert}
+		c.GetCertificate = nil
+		c.GetConfigForClient = nil
+		if p.clientCAs != nil {
+			c.ClientCAs = p.clientCAs
+		}
+		return c, nil
+	}
+	return cfg
+}
@@ -0,0 +1,276 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A certificate authority issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for 127.0.0.1 usable by clients and servers,
+// with the given common name and URI SANs, and its key, in PEM.
+func (ca *testCA) issue(t *testing.T, name string, uris ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatalf("Invalid URI %q: %v", uri, err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// keyPair returns a certificate issued by ca for use in a tls.Config.
+func (ca *testCA) keyPair(t *testing.T, name string, uris ...string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, name, uris...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Unable to load key pair: %v", err)
+	}
+	return cert
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) {
+	// Replace the file atomically, as certificate management tools do.
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		t.Fatalf("Unable to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatalf("Unable to rename %s: %v", tmp, err)
+	}
+}
+
+// servedCommonName connects to addr and returns the common name of the
+// certificate the server presents.
+func discardLogger() TLogger {
+	return slog.New(slog.DiscardHandler)
+}
+
+func servedCommonName(t *testing.T, addr string, ca *testCA) string {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Unable to connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestSSLServerSocketCertReload(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	issue := func(name string) {
+		certPEM, keyPEM := ca.issue(t, name)
+		writeTestFile(t, certFile, certPEM)
+		writeTestFile(t, keyFile, keyPEM)
+	}
+	issue("one")
+	reloader, err := NewTCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Unable to load certificates: %v", err)
+	}
+	defer reloader.Stop()
+	reloader.SetLogger(discardLogger())
+	failures := make(chan error, 10)
+	reloader.SetErrorHandler(func(err error) { failures <- err })
+
+	addr, err := FindAvailableTCPServerPort(40000)
+	if err != nil {
+		t.Fatalf("Unable to find available tcp port addr: %s", err)
+	}
+	serverSocket, err := NewTSSLServerSocket(addr.String(), &tls.Config{})
+	if err != nil {
+		t.Fatalf("Unable to create server socket: %s", err)
+	}
+	serverSocket.SetCertReloader(reloader)
+	server := NewTSimpleServer2(&sleepProcessor{}, serverSocket)
+	done := startServing(t, server, serverSocket)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	old, err := NewTSSLSocketTimeout(addr.String(), &tls.Config{RootCAs: pool}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create client socket: %s", err)
+	}
+	if err := old.Open(); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer old.Close()
+	oldProt := NewTBinaryProtocolTransport(old)
+	if err := callTestServer(oldProt, "call", 1, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if name := servedCommonName(t, addr.String(), ca); name != "one" {
+		t.Fatalf("Served certificate %q, want one", name)
+	}
+
+	// Explicit reload.
+	issue("two")
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if name := servedCommonName(t, addr.String(), ca); name != "two" {
+		t.Errorf("Served certificate %q after reload, want two", name)
+	}
+	// Existing connections carry on.
+	if err := callTestServer(oldProt, "call", 2, 0); err != nil {
+		t.Errorf("Call on existing connection failed: %v", err)
+	}
+
+	// A broken file is reported and the previous certificate kept.
+	writeTestFile(t, certFile, []byte("garbage"))
+	if err := reloader.Reload(); err == nil {
+		t.Error("Expected reloading a broken certificate to fail")
+	}
+	if err := <-failures; err == nil || reloader.LastError() == nil {
+		t.Error("Reload failure not reported")
+	}
+	if name := servedCommonName(t, addr.String(), ca); name != "two" {
+		t.Errorf("Served certificate %q after failed reload, want two", name)
+	}
+
+	// Reload on SIGHUP.
+	reloader.WatchSignal()
+	issue("three")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitCommonName(t, addr.String(), ca, "three")
+
+	// Reload on change.
+	reloader.Poll(10 * time.Millisecond)
+	issue("four")
+	waitCommonName(t, addr.String(), ca, "four")
+}
+
+func waitCommonName(t *testing.T, addr string, ca *testCA, expected string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		name := servedCommonName(t, addr, ca)
+		if name == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Served certificate %q, want %s", name, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertReloaderClientCAs(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	certPEM, keyPEM := ca.issue(t, "server")
+	writeTestFile(t, certFile, certPEM)
+	writeTestFile(t, keyFile, keyPEM)
+	writeTestFile(t, caFile, ca.pem)
+	reloader, err := NewTCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("Unable to load certificates: %v", err)
+	}
+	cfg := reloader.Config(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert})
+	first, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || first.ClientAuth != tls.RequireAndVerifyClientCert || len(first.Certificates) != 1 {
+		t.Fatalf("Unexpected config %+v: %v", first, err)
+	}
+	writeTestFile(t, caFile, other.pem)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	second, _ := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if first.ClientCAs.Equal(second.ClientCAs) {
+		t.Error("CA bundle not reloaded")
+	}
+	if !second.ClientCAs.Equal(reloader.ClientCAs()) {
+		t.Error("Config does not use the reloaded CA bundle")
+	}
+}
@@ -0,0 +1,474 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The states of a TCircuitBreaker.
+type TCircuitState int
+
+const (
+	// Calls go through.
+	CIRCUIT_CLOSED TCircuitState = iota
+	// Calls fail fast with a TCircuitOpenError.
+	CIRCUIT_OPEN
+	// A few trial calls go through, deciding whether to close again.
+	CIRCUIT_HALF_OPEN
+)
+
+func (p TCircuitState) String() string {
+	switch p {
+	case CIRCUIT_CLOSED:
+		return "closed"
+	case CIRCUIT_OPEN:
+		return "open"
+	case CIRCUIT_HALF_OPEN:
+		return "half-open"
+	}
+	return fmt.Sprintf("TCircuitState(%d)", int(p))
+}
+
+// Defaults of TCircuitBreakerSettings.
+const (
+	DEFAULT_CIRCUIT_CONSECUTIVE_FAILURES = 5
+	DEFAULT_CIRCUIT_FAILURE_RATE         = 0.5
+	DEFAULT_CIRCUIT_MIN_REQUESTS         = 20
+	DEFAULT_CIRCUIT_WINDOW               = 10 * time.Second
+	DEFAULT_CIRCUIT_OPEN_DURATION        = 5 * time.Second
+	DEFAULT_CIRCUIT_HALF_OPEN_CALLS      = 1
+)
+
+// The number of buckets the window of a TCircuitBreaker is counted in.
+const circuitBuckets = 10
+
+// When a TCircuitBreaker opens and closes. Zero values stand for the
+// defaults.
+type TCircuitBreakerSettings struct {
+	// Open after this many failures in a row, or never if negative.
+	ConsecutiveFailures int
+	// Open once this fraction of the calls in the window failed, provided
+	// there were at least MinRequests, or never if negative.
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+	// How long to stay open before letting trial calls through.
+	OpenDuration time.Duration
+	// How many trial calls to let through at once when half-open, all of
+	// which must succeed to close.
+	HalfOpenCalls int
+}
+
+func (p TCircuitBreakerSettings) withDefaults() TCircuitBreakerSettings {
+	if p.ConsecutiveFailures == 0 {
+		p.ConsecutiveFailures = DEFAULT_CIRCUIT_CONSECUTIVE_FAILURES
+	}
+	if p.FailureRate == 0 {
+		p.FailureRate = DEFAULT_CIRCUIT_FAILURE_RATE
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = DEFAULT_CIRCUIT_MIN_REQUESTS
+	}
+	if p.Window <= 0 {
+		p.Window = DEFAULT_CIRCUIT_WINDOW
+	} else if p.Window < circuitBuckets {
+		// Each bucket must span at least a nanosecond.
+		p.Window = circuitBuckets
+	}
+	if p.OpenDuration <= 0 {
+		p.OpenDuration = DEFAULT_CIRCUIT_OPEN_DURATION
+	}
+	if p.HalfOpenCalls <= 0 {
+		p.HalfOpenCalls = DEFAULT_CIRCUIT_HALF_OPEN_CALLS
+	}
+	return p
+}
+
+// Returned instead of making a call while a circuit is open.
+type TCircuitOpenError struct {
+	Name string
+	// How long until trial calls are let through.
+	RetryAfter time.Duration
+}
+
+func (p *TCircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit %s open, retry after %v", p.Name, p.RetryAfter)
+}
+
+// A change of state of a circuit.
+type TCircuitEvent struct {
+	Name string
+	From TCircuitState
+	To   TCircuitState
+	Time time.Time
+	// The failure that opened the circuit, and its kind: "transport",
+	// "protocol" or "application" for Thrift exceptions. Unset for other
+	// changes.
+	Err       error
+	ErrorType string
+}
+
+// Reports whether err counts as a failure of the called service.
+type TFailureClassifier func(err error) bool
+
+// DefaultFailureClassifier counts transport and protocol exceptions, and
+// errors of other types, as failures. Application exceptions only count if
+// they are INTERNAL_ERROR or OVERLOADED, as others, such as UNKNOWN_METHOD,
+// come from a working server.
+func DefaultFailureClassifier(err error) bool {
+	switch errorType(err) {
+	case "transport", "protocol":
+		return true
+	case "application":
+		switch err.(TApplicationException).TypeId() {
+		case INTERNAL_ERROR, OVERLOADED:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+type tCircuitBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// A circuit breaker, failing calls fast while the calls through it keep
+// failing. It opens when too many calls in a row or too large a fraction
+// of recent calls fail. Once it has been open for a while it turns
+// half-open, letting a few trial calls through: it closes if they succeed
+// and opens again otherwise.
+type TCircuitBreaker struct {
+	name     string
+	settings TCircuitBreakerSettings
+
+	mu          sync.Mutex
+	state       TCircuitState
+	openedAt    time.Time
+	consecutive int
+	buckets     [circuitBuckets]tCircuitBucket
+	trials      int
+	successes   int
+	listener    func(TCircuitEvent)
+	classify    TFailureClassifier
+	now         func() time.Time
+}
+
+func NewTCircuitBreaker(name string, settings TCircuitBreakerSettings) *TCircuitBreaker {
+	return &TCircuitBreaker{
+		name:     name,
+		settings: settings.withDefaults(),
+		classify: DefaultFailureClassifier,
+		now:      time.Now,
+	}
+}
+
+func (p *TCircuitBreaker) Name() string {
+	return p.name
+}
+
+// Sets the function called after each change of state.
+func (p *TCircuitBreaker) SetStateListener(listener func(TCircuitEvent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listener = listener
+}
+
+func (p *TCircuitBreaker) SetFailureClassifier(classify TFailureClassifier) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.classify = classify
+}
+
+func (p *TCircuitBreaker) State() TCircuitState {
+	p.mu.Lock()
+	event := p.expireLocked()
+	state := p.state
+	p.mu.Unlock()
+	p.emit(event)
+	return state
+}
+
+// Calls fn if the circuit lets it through, recording its outcome, and
+// otherwise returns a TCircuitOpenError. Calls failing with a
+// TCircuitOpenError themselves, as from a nested breaker, are not counted.
+func (p *TCircuitBreaker) Execute(fn func() error) error {
+	return p.ExecuteContext(context.Background(), fn)
+}
+
+// Calls fn like Execute, except that a failure once ctx is done is not
+// counted: the caller giving up says nothing about the backend.
+func (p *TCircuitBreaker) ExecuteContext(ctx context.Context, fn func() error) error {
+	trial, err := p.allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil && ctx.Err() != nil {
+		p.forget(trial)
+		return err
+	}
+	p.record(trial, err)
+	return err
+}
+
+// expireLocked turns an open circuit half-open once its time is up.
+func (p *TCircuitBreaker) expireLocked() *TCircuitEvent {
+	if p.state == CIRCUIT_OPEN && !p.now().Before(p.openedAt.Add(p.settings.OpenDuration)) {
+		return p.setStateLocked(CIRCUIT_HALF_OPEN, nil)
+	}
+	return nil
+}
+
+func (p *TCircuitBreaker) allow() (bool, error) {
+	p.mu.Lock()
+	event := p.expireLocked()
+	var trial bool
+	var err error
+	switch p.state {
+	case CIRCUIT_OPEN:
+		err = &TCircuitOpenError{Name: p.name, RetryAfter: p.openedAt.Add(p.settings.OpenDuration).Sub(p.now())}
+	case CIRCUIT_HALF_OPEN:
+		if p.trials < p.settings.HalfOpenCalls {
+			p.trials++
+			trial = true
+		} else {
+			err = &TCircuitOpenError{Name: p.name}
+		}
+	}
+	p.mu.Unlock()
+	p.emit(event)
+	return trial, err
+}
+
+// forget releases the slot of a call that is not counted.
+func (p *TCircuitBreaker) forget(trial bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if trial {
+		p.trials--
+	}
+}
+
+func (p *TCircuitBreaker) record(trial bool, err error) {
+	if _, ok := err.(*TCircuitOpenError); ok {
+		p.forget(trial)
+		return
+	}
+	p.mu.Lock()
+	event := p.recordLocked(trial, err != nil && p.classify(err), err)
+	p.mu.Unlock()
+	p.emit(event)
+}
+
+func (p *TCircuitBreaker) recordLocked(trial, failed bool, err error) *TCircuitEvent {
+	if trial {
+		if p.state != CIRCUIT_HALF_OPEN {
+			return nil
+		}
+		if failed {
+			return p.setStateLocked(CIRCUIT_OPEN, err)
+		}
+		p.successes++
+		if p.successes >= p.settings.HalfOpenCalls {
+			return p.setStateLocked(CIRCUIT_CLOSED, nil)
+		}
+		return nil
+	}
+	// Calls let through before the circuit opened no longer matter.
+	if p.state != CIRCUIT_CLOSED {
+		return nil
+	}
+	bucket := p.bucketLocked()
+	bucket.requests++
+	if !failed {
+		p.consecutive = 0
+		return nil
+	}
+	bucket.failures++
+	p.consecutive++
+	if p.settings.ConsecutiveFailures > 0 && p.consecutive >= p.settings.ConsecutiveFailures {
+		return p.setStateLocked(CIRCUIT_OPEN, err)
+	}
+	if p.settings.FailureRate > 0 {
+		requests, failures := p.countsLocked()
+		if requests >= p.settings.MinRequests && float64(failures) >= p.settings.FailureRate*float64(requests) {
+			return p.setStateLocked(CIRCUIT_OPEN, err)
+		}
+	}
+	return nil
+}
+
+// bucketLocked returns the bucket counting calls made now, emptying it if
+// it last counted calls a window ago.
+func (p *TCircuitBreaker) bucketLocked() *tCircuitBucket {
+	width := p.settings.Window / circuitBuckets
+	start := p.now().Truncate(width)
+	bucket := &p.buckets[(start.UnixNano()/int64(width))%circuitBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = tCircuitBucket{start: start}
+	}
+	return bucket
+}
+
+// countsLocked returns the calls and failures in the window.
+func (p *TCircuitBreaker) countsLocked() (int, int) {
+	since := p.now().Add(-p.settings.Window)
+	requests, failures := 0, 0
+	for _, bucket := range p.buckets {
+		if bucket.start.After(since) {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+func (p *TCircuitBreaker) setStateLocked(state TCircuitState, err error) *TCircuitEvent {
+	event := &TCircuitEvent{Name: p.name, From: p.state, To: state, Time: p.now()}
+	if err != nil {
+		event.Err = err
+		event.ErrorType = errorType(err)
+	}
+	p.state = state
+	p.trials = 0
+	p.successes = 0
+	switch state {
+	case CIRCUIT_OPEN:
+		p.openedAt = event.Time
+	case CIRCUIT_CLOSED:
+		p.consecutive = 0
+		p.buckets = [circuitBuckets]tCircuitBucket{}
+	}
+	return event
+}
+
+func (p *TCircuitBreaker) emit(event *TCircuitEvent) {
+	if event == nil {
+		return
+	}
+	p.mu.Lock()
+	listener := p.listener
+	p.mu.Unlock()
+	if listener != nil {
+		listener(*event)
+	}
+}
+
+// A TClient passing calls to another through circuit breakers for the
+// endpoint the client calls and for each method, so that a failing
+// endpoint, or a failing method of an otherwise working one, fails fast.
+// Calls failing after their context is done are not counted.
+type TCircuitBreakerClient struct {
+	client   TClient
+	endpoint *TCircuitBreaker
+	settings TCircuitBreakerSettings
+
+	mu       sync.Mutex
+	methods  map[string]*TCircuitBreaker
+	listener func(TCircuitEvent)
+	classify TFailureClassifier
+}
+
+// Wraps client, which calls the endpoint named endpoint, such as its
+// address. The breakers of methods are named endpoint/method.
+func NewTCircuitBreakerClient(client TClient, endpoint string, settings TCircuitBreakerSettings) *TCircuitBreakerClient {
+	return &TCircuitBreakerClient{
+		client:   client,
+		endpoint: NewTCircuitBreaker(endpoint, settings),
+		settings: settings,
+		methods:  make(map[string]*TCircuitBreaker),
+		classify: DefaultFailureClassifier,
+	}
+}
+
+// Sets the function called after each change of state of any of the
+// client's breakers.
+func (p *TCircuitBreakerClient) SetStateListener(listener func(TCircuitEvent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listener = listener
+	p.endpoint.SetStateListener(listener)
+	for _, breaker := range p.methods {
+		breaker.SetStateListener(listener)
+	}
+}
+
+func (p *TCircuitBreakerClient) SetFailureClassifier(classify TFailureClassifier) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.classify = classify
+	p.endpoint.SetFailureClassifier(classify)
+	for _, breaker := range p.methods {
+		breaker.SetFailureClassifier(classify)
+	}
+}
+
+// Returns the breaker of the endpoint, which counts calls to all methods.
+func (p *TCircuitBreakerClient) EndpointBreaker() *TCircuitBreaker {
+	return p.endpoint
+}
+
+// Returns the breaker of method, creating it if needed.
+func (p *TCircuitBreakerClient) MethodBreaker(method string) *TCircuitBreaker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	breaker, ok := p.methods[method]
+	if !ok {
+		breaker = NewTCircuitBreaker(p.endpoint.Name()+"/"+method, p.settings)
+		breaker.SetStateListener(p.listener)
+		breaker.SetFailureClassifier(p.classify)
+		p.methods[method] = breaker
+	}
+	return breaker
+}
+
+func (p *TCircuitBreakerClient) Call(ctx context.Context, method string, args, result TStruct) error {
+	return p.execute(ctx, method, func() error {
+		return p.client.Call(ctx, method, args, result)
+	})
+}
+
+// Sends a oneway call to method with args, if the wrapped client supports
+// that as TStandardClient does.
+func (p *TCircuitBreakerClient) Oneway(ctx context.Context, method string, args TStruct) error {
+	client, ok := p.client.(interface {
+		Oneway(ctx context.Context, method string, args TStruct) error
+	})
+	if !ok {
+		return NewTApplicationException(UNKNOWN_APPLICATION_EXCEPTION, "Oneway calls not supported by the wrapped client")
+	}
+	return p.execute(ctx, method, func() error {
+		return client.Oneway(ctx, method, args)
+	})
+}
+
+func (p *TCircuitBreakerClient) execute(ctx context.Context, method string, fn func() error) error {
+	breaker := p.MethodBreaker(method)
+	return p.endpoint.ExecuteContext(ctx, func() error {
+		return breaker.ExecuteContext(ctx, fn)
+	})
+}
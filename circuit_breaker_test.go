@@ -0,0 +1,338 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Unix(1000, 0)}
+}
+
+func (p *testClock) Now() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.now
+}
+
+func (p *testClock) Advance(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.now = p.now.Add(d)
+}
+
+func newTestBreaker(settings TCircuitBreakerSettings) (*TCircuitBreaker, *testClock, *[]TCircuitEvent) {
+	clock := newTestClock()
+	breaker := NewTCircuitBreaker("test", settings)
+	breaker.now = clock.Now
+	events := &[]TCircuitEvent{}
+	breaker.SetStateListener(func(event TCircuitEvent) {
+		*events = append(*events, event)
+	})
+	return breaker, clock, events
+}
+
+var errTestTransport = NewTTransportException(NOT_OPEN, "refused")
+
+func failWith(err error) func() error {
+	return func() error { return err }
+}
+
+func succeed() error {
+	return nil
+}
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	breaker, _, events := newTestBreaker(TCircuitBreakerSettings{ConsecutiveFailures: 3, FailureRate: -1})
+	for i := 0; i < 2; i++ {
+		breaker.Execute(failWith(errTestTransport))
+	}
+	breaker.Execute(succeed)
+	for i := 0; i < 2; i++ {
+		breaker.Execute(failWith(errTestTransport))
+	}
+	if state := breaker.State(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected closed after a success reset the count, got %v", state)
+	}
+	breaker.Execute(failWith(errTestTransport))
+	if state := breaker.State(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected open, got %v", state)
+	}
+	if len(*events) != 1 {
+		t.Fatalf("Expected 1 event, got %v", *events)
+	}
+	event := (*events)[0]
+	if event.From != CIRCUIT_CLOSED || event.To != CIRCUIT_OPEN || event.Err != errTestTransport || event.ErrorType != "transport" || event.Name != "test" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+}
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	breaker, clock, _ := newTestBreaker(TCircuitBreakerSettings{ConsecutiveFailures: -1, FailureRate: 0.5, MinRequests: 10, Window: 10 * time.Second})
+	for i := 0; i < 4; i++ {
+		breaker.Execute(succeed)
+		breaker.Execute(failWith(errTestTransport))
+	}
+	if state := breaker.State(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected closed below the minimum requests, got %v", state)
+	}
+	// Calls older than the window no longer count.
+	clock.Advance(11 * time.Second)
+	for i := 0; i < 5; i++ {
+		breaker.Execute(succeed)
+	}
+	for i := 0; i < 4; i++ {
+		breaker.Execute(failWith(errTestTransport))
+	}
+	if state := breaker.State(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected closed at 4 of 9 failing, got %v", state)
+	}
+	breaker.Execute(failWith(errTestTransport))
+	if state := breaker.State(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected open at 5 of 10 failing, got %v", state)
+	}
+}
+
+func TestCircuitBreakerFailsFastWhileOpen(t *testing.T) {
+	breaker, clock, _ := newTestBreaker(TCircuitBreakerSettings{ConsecutiveFailures: 1, OpenDuration: 5 * time.Second})
+	breaker.Execute(failWith(errTestTransport))
+	clock.Advance(2 * time.Second)
+	called := false
+	err := breaker.Execute(func() error {
+		called = true
+		return nil
+	})
+	if called {
+		t.Fatal("Expected no call while open")
+	}
+	openErr, ok := err.(*TCircuitOpenError)
+	if !ok {
+		t.Fatalf("Expected a TCircuitOpenError, got %T %v", err, err)
+	}
+	if openErr.Name != "test" || openErr.RetryAfter != 3*time.Second {
+		t.Fatalf("Unexpected error %+v", openErr)
+	}
+	if errorType(err) == "transport" {
+		t.Fatal("Expected the open error not to be a transport exception")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	breaker, clock, events := newTestBreaker(TCircuitBreakerSettings{ConsecutiveFailures: 1, OpenDuration: time.Second, HalfOpenCalls: 2})
+	breaker.Execute(failWith(errTestTransport))
+	clock.Advance(time.Second)
+	if state := breaker.State(); state != CIRCUIT_HALF_OPEN {
+		t.Fatalf("Expected half-open, got %v", state)
+	}
+
+	// A failing trial call opens the circuit again.
+	breaker.Execute(failWith(errTestTransport))
+	if state := breaker.State(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected open after a failed trial, got %v", state)
+	}
+	clock.Advance(time.Second)
+
+	// No more trial calls than allowed go through at once.
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			breaker.Execute(func() error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+	<-started
+	<-started
+	if _, ok := breaker.Execute(succeed).(*TCircuitOpenError); !ok {
+		t.Fatal("Expected a third trial call to fail fast")
+	}
+	close(release)
+	wg.Wait()
+	if state := breaker.State(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected closed after successful trials, got %v", state)
+	}
+
+	expected := []TCircuitState{CIRCUIT_OPEN, CIRCUIT_HALF_OPEN, CIRCUIT_OPEN, CIRCUIT_HALF_OPEN, CIRCUIT_CLOSED}
+	if len(*events) != len(expected) {
+		t.Fatalf("Expected %d events, got %v", len(expected), *events)
+	}
+	for i, event := range *events {
+		if event.To != expected[i] {
+			t.Fatalf("Expected event %d to %v, got %v", i, expected[i], event.To)
+		}
+	}
+}
+
+func TestCircuitBreakerClassification(t *testing.T) {
+	breaker, _, _ := newTestBreaker(TCircuitBreakerSettings{ConsecutiveFailures: 1})
+	breaker.Execute(failWith(NewTApplicationException(UNKNOWN_METHOD, "unknown")))
+	breaker.Execute(failWith(NewTApplicationException(INVALID_MESSAGE_TYPE_EXCEPTION, "invalid")))
+	breaker.Execute(failWith(&TCircuitOpenError{Name: "nested"}))
+	if state := breaker.State(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected closed, got %v", state)
+	}
+
+	for _, err := range []error{
+		NewTTransportException(TIMED_OUT, "timeout"),
+		NewTProtocolException(errors.New("bad")),
+		NewTApplicationException(INTERNAL_ERROR, "internal"),
+		NewTApplicationException(OVERLOADED, "overloaded"),
+		errors.New("other"),
+	} {
+		if !DefaultFailureClassifier(err) {
+			t.Errorf("Expected %T %v to count as a failure", err, err)
+		}
+	}
+
+	breaker.SetFailureClassifier(func(err error) bool { return false })
+	breaker.Execute(failWith(errTestTransport))
+	if state := breaker.State(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected closed with a custom classifier, got %v", state)
+	}
+}
+
+type testBreakerClient struct {
+	mu    sync.Mutex
+	fail  map[string]error
+	calls []string
+}
+
+func (p *testBreakerClient) Call(ctx context.Context, method string, args, result TStruct) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, method)
+	return p.fail[method]
+}
+
+func TestCircuitBreakerClientPerMethod(t *testing.T) {
+	inner := &testBreakerClient{fail: map[string]error{
+		"broken": NewTApplicationException(INTERNAL_ERROR, "broken"),
+	}}
+	client := NewTCircuitBreakerClient(inner, "localhost:9090", TCircuitBreakerSettings{ConsecutiveFailures: 2, FailureRate: -1})
+	var events []TCircuitEvent
+	client.SetStateListener(func(event TCircuitEvent) {
+		events = append(events, event)
+	})
+	ctx := context.Background()
+
+	// Failures of one method interleaved with successes of another open
+	// only the failing method's circuit.
+	for i := 0; i < 2; i++ {
+		client.Call(ctx, "broken", nil, nil)
+		client.Call(ctx, "working", nil, nil)
+	}
+	err := client.Call(ctx, "broken", nil, nil)
+	if openErr, ok := err.(*TCircuitOpenError); !ok || openErr.Name != "localhost:9090/broken" {
+		t.Fatalf("Expected the method circuit open, got %T %v", err, err)
+	}
+	if err := client.Call(ctx, "working", nil, nil); err != nil {
+		t.Fatalf("Expected working calls to go through, got %v", err)
+	}
+	if state := client.EndpointBreaker().State(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected the endpoint circuit closed, got %v", state)
+	}
+	if len(inner.calls) != 5 {
+		t.Fatalf("Expected 5 calls through, got %v", inner.calls)
+	}
+	if len(events) != 1 || events[0].Name != "localhost:9090/broken" || events[0].ErrorType != "application" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+}
+
+func TestCircuitBreakerClientPerEndpoint(t *testing.T) {
+	inner := &testBreakerClient{fail: map[string]error{
+		"a": errTestTransport,
+		"b": errTestTransport,
+	}}
+	client := NewTCircuitBreakerClient(inner, "localhost:9090", TCircuitBreakerSettings{ConsecutiveFailures: 2, FailureRate: -1})
+	ctx := context.Background()
+	client.Call(ctx, "a", nil, nil)
+	client.Call(ctx, "b", nil, nil)
+	if state := client.EndpointBreaker().State(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected the endpoint circuit open, got %v", state)
+	}
+	err := client.Call(ctx, "c", nil, nil)
+	if openErr, ok := err.(*TCircuitOpenError); !ok || openErr.Name != "localhost:9090" {
+		t.Fatalf("Expected the endpoint circuit open, got %T %v", err, err)
+	}
+	if len(inner.calls) != 2 {
+		t.Fatalf("Expected 2 calls through, got %v", inner.calls)
+	}
+}
+
+func TestCircuitBreakerTinyWindow(t *testing.T) {
+	breaker, _, _ := newTestBreaker(TCircuitBreakerSettings{ConsecutiveFailures: -1, MinRequests: 1, Window: time.Nanosecond})
+	breaker.Execute(failWith(errTestTransport))
+	if state := breaker.State(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected open, got %v", state)
+	}
+}
+
+func TestCircuitBreakerIgnoresCallerCancellation(t *testing.T) {
+	inner := &testBreakerClient{fail: map[string]error{
+		"cancelled": contextTransportException(context.Canceled),
+		"expired":   contextTransportException(context.DeadlineExceeded),
+	}}
+	client := NewTCircuitBreakerClient(inner, "localhost:9090", TCircuitBreakerSettings{ConsecutiveFailures: 2, FailureRate: -1})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	for i := 0; i < 3; i++ {
+		client.Call(cancelled, "cancelled", nil, nil)
+		client.Call(expired, "expired", nil, nil)
+	}
+	if state := client.EndpointBreaker().State(); state != CIRCUIT_CLOSED {
+		t.Errorf("Expected the endpoint circuit closed, got %v", state)
+	}
+	for _, method := range []string{"cancelled", "expired"} {
+		if state := client.MethodBreaker(method).State(); state != CIRCUIT_CLOSED {
+			t.Errorf("Expected the circuit of %s closed, got %v", method, state)
+		}
+	}
+
+	// A cancelled trial call leaves its place to another.
+	breaker, clock, _ := newTestBreaker(TCircuitBreakerSettings{ConsecutiveFailures: 1, OpenDuration: time.Second, HalfOpenCalls: 1})
+	breaker.Execute(failWith(errTestTransport))
+	clock.Advance(time.Second)
+	breaker.ExecuteContext(cancelled, failWith(errTestTransport))
+	if err := breaker.Execute(succeed); err != nil {
+		t.Fatalf("Expected a trial call after a cancelled one, got %v", err)
+	}
+	if state := breaker.State(); state != CIRCUIT_CLOSED {
+		t.Errorf("Expected closed after the trial succeeded, got %v", state)
+	}
+}
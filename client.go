@@ -0,0 +1,191 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Makes calls to a service, as generated clients do.
+type TClient interface {
+	// Calls method with args, reading the reply into result. Exceptions
+	// the server replies with are returned as TApplicationException.
+	Call(ctx context.Context, method string, args, result TStruct) error
+}
+
+// A TClient sending calls through a pair of protocols, one at a time. Each
+// call gets the next sequence id, and replies are checked to be for the
+// method and sequence id of the call, failing with a WRONG_METHOD_NAME or
+// BAD_SEQUENCE_ID TApplicationException otherwise.
+//
+// Calls run in a client span started with the default tracer. When ctx is
+// done during a call, the transport is interrupted if it supports that,
+// as TSocket does, leaving it closed.
+type TStandardClient struct {
+	iprot TProtocol
+	oprot TProtocol
+	seqId int32
+	// Serializes calls, as protocols are not safe for concurrent use.
+	mu sync.Mutex
+}
+
+func NewTStandardClient(inputProtocol, outputProtocol TProtocol) *TStandardClient {
+	return &TStandardClient{iprot: inputProtocol, oprot: outputProtocol}
+}
+
+func NewTStandardClientFactory2(trans TTransport, protocolFactory TProtocolFactory) *TStandardClient {
+	return NewTStandardClientFactory3(trans, protocolFactory, protocolFactory)
+}
+
+func NewTStandardClientFactory3(trans TTransport, inputProtocolFactory, outputProtocolFactory TProtocolFactory) *TStandardClient {
+	return NewTStandardClient(inputProtocolFactory.GetProtocol(trans), outputProtocolFactory.GetProtocol(trans))
+}
+
+func (p *TStandardClient) InputProtocol() TProtocol {
+	return p.iprot
+}
+
+func (p *TStandardClient) OutputProtocol() TProtocol {
+	return p.oprot
+}
+
+func (p *TStandardClient) Call(ctx context.Context, method string, args, result TStruct) error {
+	_, err := p.call(ctx, method, CALL, args, result)
+	return err
+}
+
+// Sends a oneway call to method with args. It returns once the call is
+// flushed, as no reply follows.
+func (p *TStandardClient) Oneway(ctx context.Context, method string, args TStruct) error {
+	_, err := p.call(ctx, method, ONEWAY, args, nil)
+	return err
+}
+
+// call makes a call or oneway call, also reporting whether the failure, if
+// any, happened once writing the message had begun, so that the server may
+// have received it.
+func (p *TStandardClient) call(ctx context.Context, method string, typeId TMessageType, args, result TStruct) (sent bool, err error) {
+	// The span's context is injected into the transport's headers, which
+	// are shared by the calls on it.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ctx, span := StartClientSpan(ctx, method, p.oprot.Transport())
+	defer func() {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}()
+	stop, err := p.watch(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer stop(&err)
+	seqId := atomic.AddInt32(&p.seqId, 1)
+	if err := p.send(method, typeId, seqId, args); err != nil || typeId == ONEWAY {
+		return true, err
+	}
+	return true, p.recv(method, seqId, result)
+}
+
+// watch interrupts the transport once ctx is done, unless the returned
+// function is called first. If ctx was done, that function replaces *err
+// with the reason.
+func (p *TStandardClient) watch(ctx context.Context) (func(*error), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextTransportException(err)
+	}
+	trans, ok := p.oprot.Transport().(interface {
+		Interrupt() error
+	})
+	if !ok || ctx.Done() == nil {
+		return func(*error) {}, nil
+	}
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		trans.Interrupt()
+		close(interrupted)
+	})
+	return func(err *error) {
+		if !stop() {
+			<-interrupted
+			*err = contextTransportException(ctx.Err())
+		}
+	}, nil
+}
+
+func contextTransportException(err error) TTransportException {
+	if err == context.DeadlineExceeded {
+		return NewTTransportException(TIMED_OUT, err.Error())
+	}
+	return NewTTransportExceptionFromError(err)
+}
+
+func (p *TStandardClient) send(method string, typeId TMessageType, seqId int32, args TStruct) error {
+	if err := p.oprot.WriteMessageBegin(method, typeId, seqId); err != nil {
+		return err
+	}
+	if err := args.Write(p.oprot); err != nil {
+		return err
+	}
+	if err := p.oprot.WriteMessageEnd(); err != nil {
+		return err
+	}
+	return p.oprot.Flush()
+}
+
+func (p *TStandardClient) recv(method string, seqId int32, result TStruct) error {
+	name, typeId, replySeqId, err := p.iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	var exc TApplicationException
+	switch {
+	case name != method:
+		exc = NewTApplicationException(WRONG_METHOD_NAME, method+" failed: wrong method name")
+	case replySeqId != seqId:
+		exc = NewTApplicationException(BAD_SEQUENCE_ID, method+" failed: out of sequence response")
+	case typeId == EXCEPTION:
+		if exc, err = NewTApplicationException(UNKNOWN_APPLICATION_EXCEPTION, "").Read(p.iprot); err != nil {
+			return err
+		}
+		if err := p.iprot.ReadMessageEnd(); err != nil {
+			return err
+		}
+		return exc
+	case typeId != REPLY:
+		exc = NewTApplicationException(INVALID_MESSAGE_TYPE_EXCEPTION, method+" failed: invalid message type")
+	default:
+		if err := result.Read(p.iprot); err != nil {
+			return err
+		}
+		return p.iprot.ReadMessageEnd()
+	}
+	// Skip the unexpected reply, so that the next one can be read.
+	if err := p.iprot.Skip(STRUCT); err != nil {
+		return err
+	}
+	if err := p.iprot.ReadMessageEnd(); err != nil {
+		return err
+	}
+	return exc
+}
@@ -0,0 +1,247 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The arguments sleepProcessor reads.
+type testSleepArgs struct {
+	sleep int32
+}
+
+func (p *testSleepArgs) Write(out TProtocol) error {
+	out.WriteStructBegin("args")
+	out.WriteFieldBegin("sleep", I32, 1)
+	out.WriteI32(p.sleep)
+	out.WriteFieldEnd()
+	out.WriteFieldStop()
+	return out.WriteStructEnd()
+}
+
+func (p *testSleepArgs) Read(in TProtocol) error {
+	return in.Skip(STRUCT)
+}
+
+// A result with no fields, recording whether it was read.
+type testEmptyResult struct {
+	read bool
+}
+
+func (p *testEmptyResult) Write(out TProtocol) error {
+	out.WriteStructBegin("result")
+	out.WriteFieldStop()
+	return out.WriteStructEnd()
+}
+
+func (p *testEmptyResult) Read(in TProtocol) error {
+	p.read = true
+	return in.Skip(STRUCT)
+}
+
+func openTestStandardClient(t *testing.T, addr string) (*TStandardClient, *TSocket) {
+	socket, err := NewTSocketTimeout(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create client socket: %s", err)
+	}
+	if err := socket.Open(); err != nil {
+		t.Fatalf("Unable to connect to %s: %s", addr, err)
+	}
+	return NewTStandardClientFactory2(socket, NewTBinaryProtocolFactoryDefault()), socket
+}
+
+func TestStandardClientCall(t *testing.T) {
+	processor := NewTBaseProcessor()
+	processor.AddToProcessorMap("echo", &emptyReplyFunction{})
+	server, addr, done := startTestServer(t, processor)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+	client, socket := openTestStandardClient(t, addr)
+	defer socket.Close()
+
+	for i := 0; i < 3; i++ {
+		result := &testEmptyResult{}
+		if err := client.Call(context.Background(), "echo", &testSleepArgs{}, result); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		if !result.read {
+			t.Error("Expected the result to be read")
+		}
+	}
+	err := client.Call(context.Background(), "missing", &testSleepArgs{}, &testEmptyResult{})
+	if exc, ok := err.(TApplicationException); !ok || exc.TypeId() != UNKNOWN_METHOD {
+		t.Errorf("Expected an UNKNOWN_METHOD exception, got %v", err)
+	}
+	if err := client.Call(context.Background(), "echo", &testSleepArgs{}, &testEmptyResult{}); err != nil {
+		t.Errorf("Call after an exception failed: %v", err)
+	}
+}
+
+func TestStandardClientValidatesReplies(t *testing.T) {
+	replies := NewTMemoryBuffer()
+	reply := NewTBinaryProtocolTransport(replies)
+	for _, r := range []struct {
+		name   string
+		typeId TMessageType
+		seqId  int32
+	}{
+		{"echo", REPLY, 7},
+		{"other", REPLY, 2},
+		{"echo", CALL, 3},
+		{"echo", REPLY, 4},
+	} {
+		reply.WriteMessageBegin(r.name, r.typeId, r.seqId)
+		(&testEmptyResult{}).Write(reply)
+		reply.WriteMessageEnd()
+	}
+	requests := NewTMemoryBuffer()
+	client := NewTStandardClient(reply, NewTBinaryProtocolTransport(requests))
+
+	for _, expected := range []int32{BAD_SEQUENCE_ID, WRONG_METHOD_NAME, INVALID_MESSAGE_TYPE_EXCEPTION} {
+		result := &testEmptyResult{}
+		err := client.Call(context.Background(), "echo", &testSleepArgs{}, result)
+		if exc, ok := err.(TApplicationException); !ok || exc.TypeId() != expected {
+			t.Errorf("Expected an exception of type %d, got %v", expected, err)
+		}
+		if result.read {
+			t.Error("Expected the result of an invalid reply not to be read")
+		}
+	}
+	if err := client.Call(context.Background(), "echo", &testSleepArgs{}, &testEmptyResult{}); err != nil {
+		t.Errorf("Expected the reply following invalid ones to be read: %v", err)
+	}
+
+	if err := client.Oneway(context.Background(), "notify", &testSleepArgs{}); err != nil {
+		t.Fatalf("Oneway call failed: %v", err)
+	}
+	request := NewTBinaryProtocolTransport(requests)
+	for i := int32(1); i <= 5; i++ {
+		name, typeId, seqId, err := request.ReadMessageBegin()
+		if err != nil {
+			t.Fatalf("Unable to read request: %v", err)
+		}
+		if seqId != i || (i < 5) != (typeId == CALL && name == "echo") || (i == 5) != (typeId == ONEWAY && name == "notify") {
+			t.Errorf("Unexpected request %d: %s %d %d", i, name, typeId, seqId)
+		}
+		request.Skip(STRUCT)
+		request.ReadMessageEnd()
+	}
+}
+
+func TestStandardClientContext(t *testing.T) {
+	server, addr, done := startTestServer(t, &sleepProcessor{})
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+	client, socket := openTestStandardClient(t, addr)
+	defer socket.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.Call(ctx, "slow", &testSleepArgs{sleep: 500}, &testEmptyResult{})
+	if exc, ok := err.(TTransportException); !ok || exc.TypeId() != TIMED_OUT {
+		t.Errorf("Expected a TIMED_OUT exception, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Call returned after %v", elapsed)
+	}
+	if err := client.Call(ctx, "late", &testSleepArgs{}, &testEmptyResult{}); err == nil {
+		t.Error("Expected a call with a done context to fail")
+	}
+}
+
+func TestStandardClientTracing(t *testing.T) {
+	tracer := NewTRecordingTracer()
+	SetDefaultTracer(tracer)
+	defer SetDefaultTracer(nil)
+	replies := NewTMemoryBuffer()
+	reply := NewTBinaryProtocolTransport(replies)
+	writeApplicationException(reply, "echo", 1, NewTApplicationException(INTERNAL_ERROR, "boom"))
+	client := NewTStandardClient(reply, NewTBinaryProtocolTransport(NewTMemoryBuffer()))
+	if err := client.Call(context.Background(), "echo", &testSleepArgs{}, &testEmptyResult{}); err == nil {
+		t.Fatal("Expected the exception to be returned")
+	}
+	spans := tracer.Spans()
+	if len(spans) != 1 || spans[0].Name != "echo" || spans[0].Err() == nil || !spans[0].Ended() {
+		t.Errorf("Unexpected spans: %#v", spans)
+	}
+}
+
+func TestStandardClientConcurrentTracedCalls(t *testing.T) {
+	tracer := NewTRecordingTracer()
+	SetDefaultTracer(tracer)
+	defer SetDefaultTracer(nil)
+	pf := NewTBinaryProtocolFactoryDefault()
+	handler := NewThriftHandlerFunc(&sleepProcessor{}, pf, pf)
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header.Get(TRACEPARENT_HEADER))
+		mu.Unlock()
+		handler(w, r)
+	}))
+	defer server.Close()
+	trans, err := NewTHttpPostClient(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	client := NewTStandardClientFactory2(trans, pf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Call(context.Background(), "echo", &testSleepArgs{}, &testEmptyResult{}); err != nil {
+				t.Errorf("Call failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each request carries the context of its own span.
+	var sent []string
+	for _, span := range tracer.Spans() {
+		sent = append(sent, FormatTraceparent(span.Context()))
+	}
+	sort.Strings(sent)
+	sort.Strings(received)
+	if len(sent) != 8 || len(received) != 8 {
+		t.Fatalf("Expected 8 spans and requests, got %d and %d", len(sent), len(received))
+	}
+	for i := range sent {
+		if sent[i] != received[i] {
+			t.Errorf("Requests carried %v, want %v", received, sent)
+			break
+		}
+	}
+}
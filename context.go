@@ -0,0 +1,108 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Details of the connection a call arrived on, available to context-aware
+// processors through ConnectionInfoFromContext.
+type TConnectionInfo struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// The state of the TLS connection after the handshake, or nil if the
+	// connection does not use TLS.
+	TLS *tls.ConnectionState
+	// The request headers, for transports that carry them such as HTTP.
+	Headers http.Header
+	// The PROXY protocol header the connection began with, if the server
+	// socket reads them. LocalAddr and RemoteAddr are taken from it.
+	Proxy *TProxyHeader
+}
+
+type tContextKey int
+
+const (
+	connectionInfoKey tContextKey = iota
+	spanKey
+	remoteSpanContextKey
+	peerIdentityKey
+	serverContextKey
+)
+
+// Returns a copy of ctx carrying info.
+func NewContextWithConnectionInfo(ctx context.Context, info *TConnectionInfo) context.Context {
+	return context.WithValue(ctx, connectionInfoKey, info)
+}
+
+// Returns the details of the connection the call being processed arrived
+// on, if the server provided them.
+func ConnectionInfoFromContext(ctx context.Context) (*TConnectionInfo, bool) {
+	info, ok := ctx.Value(connectionInfoKey).(*TConnectionInfo)
+	return info, ok
+}
+
+// netConnOf returns the network connection underlying an accepted
+// transport, if it exposes one.
+func netConnOf(trans TTransport) net.Conn {
+	if c, ok := trans.(interface {
+		Conn() net.Conn
+	}); ok {
+		return c.Conn()
+	}
+	return nil
+}
+
+// How long a client may take to complete the TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// newServerConnectionInfo describes the connection of an accepted
+// transport, completing the TLS handshake first if it has not happened yet.
+func newServerConnectionInfo(ctx context.Context, trans TTransport) (*TConnectionInfo, error) {
+	info := &TConnectionInfo{}
+	conn := netConnOf(trans)
+	if conn == nil {
+		return info, nil
+	}
+	if proxyConn := proxyConnOf(conn); proxyConn != nil {
+		proxyConn.init()
+		if proxyConn.err != nil {
+			return nil, NewTTransportExceptionFromError(proxyConn.err)
+		}
+		info.Proxy = proxyConn.header
+	}
+	info.LocalAddr = conn.LocalAddr()
+	info.RemoteAddr = conn.RemoteAddr()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, NewTTransportExceptionFromError(err)
+		}
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+	}
+	return info, nil
+}
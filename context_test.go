@@ -0,0 +1,123 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A context-aware processor reporting the context of each call on calls,
+// then waiting for it to be cancelled if the call is named "wait".
+type contextProcessor struct {
+	calls     chan context.Context
+	cancelled chan bool
+}
+
+func newContextProcessor() *contextProcessor {
+	return &contextProcessor{calls: make(chan context.Context, 10), cancelled: make(chan bool, 10)}
+}
+
+func (p *contextProcessor) Process(ctx context.Context, in, out TProtocol) (bool, TException) {
+	name, _, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	in.Skip(STRUCT)
+	in.ReadMessageEnd()
+	p.calls <- ctx
+	if name == "wait" {
+		select {
+		case <-ctx.Done():
+			p.cancelled <- true
+		case <-time.After(2 * time.Second):
+			p.cancelled <- false
+		}
+	}
+	out.WriteMessageBegin(name, REPLY, seqId)
+	out.WriteStructBegin("result")
+	out.WriteFieldStop()
+	out.WriteStructEnd()
+	out.WriteMessageEnd()
+	return true, out.Flush()
+}
+
+func TestContextProcessorAdapters(t *testing.T) {
+	cp := newContextProcessor()
+	p := NewTProcessorFromContext(cp)
+	if NewTContextProcessor(p) != cp {
+		t.Errorf("Expected adapting back to return the original context processor")
+	}
+	sp := &sleepProcessor{}
+	if NewTProcessorFromContext(NewTContextProcessor(sp)) != sp {
+		t.Errorf("Expected adapting back to return the original processor")
+	}
+}
+
+func TestServerConnectionContext(t *testing.T) {
+	processor := newContextProcessor()
+	server, addr, done := startTestServer(t, NewTProcessorFromContext(processor))
+	client := openTestClient(t, addr)
+	if err := callTestServer(client, "test", 1, 0); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	ctx := <-processor.calls
+	info, ok := ConnectionInfoFromContext(ctx)
+	if !ok || info.RemoteAddr == nil || info.LocalAddr == nil || info.TLS != nil {
+		t.Errorf("Unexpected connection info: %#v", info)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Context cancelled while the connection is open")
+	}
+
+	if err := sendTestCall(client, "wait", 2, 0); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	<-processor.calls
+	client.Transport().Close()
+	if !<-processor.cancelled {
+		t.Errorf("Expected context to be cancelled when the client disconnected")
+	}
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestHttpHandlerConnectionContext(t *testing.T) {
+	processor := newContextProcessor()
+	pf := NewTBinaryProtocolFactoryDefault()
+	server := httptest.NewServer(http.HandlerFunc(NewThriftHandlerFunc(NewTProcessorFromContext(processor), pf, pf)))
+	defer server.Close()
+	trans, err := NewTHttpPostClient(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to create http client: %s", err)
+	}
+	client := pf.GetProtocol(trans)
+	if err := callTestServer(client, "test", 1, 0); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	ctx := <-processor.calls
+	info, ok := ConnectionInfoFromContext(ctx)
+	if !ok || info.RemoteAddr == nil || info.Headers.Get("Content-Type") != "application/x-thrift" {
+		t.Errorf("Unexpected connection info: %#v", info)
+	}
+}
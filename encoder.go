@@ -0,0 +1,277 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Marks the start of every record written by an Encoder in framed mode.
+	STREAM_FRAME_MAGIC = 0x54465231 // "TFR1"
+	// Size of the magic, length and checksum that precede each framed record.
+	STREAM_FRAME_HEADER_SIZE = 12
+	// Largest framed record a Decoder accepts unless told otherwise.
+	DEFAULT_MAX_STREAM_FRAME_SIZE = 16 * 1024 * 1024
+)
+
+// Encoder writes a sequence of TStruct values to an io.Writer, in the same
+// way encoding/json.Encoder does for JSON values.
+//
+// By default records are written back to back using the configured protocol.
+// In framed mode every record is preceded by a magic number, its length and a
+// CRC32 of its payload, which lets a Decoder skip records that are corrupt
+// and resynchronise on the next one.
+type Encoder struct {
+	trans  *StreamTransport
+	proto  TProtocol
+	framed bool
+
+	frameBuffer   *TMemoryBuffer
+	frameProtocol TProtocol
+	protoFactory  TProtocolFactory
+}
+
+// NewEncoder returns an Encoder writing to w using protocols created by
+// protoFactory.
+func NewEncoder(w io.Writer, protoFactory TProtocolFactory) *Encoder {
+	trans := NewStreamTransportW(w)
+	return &Encoder{
+		trans:        trans,
+		proto:        protoFactory.GetProtocol(trans),
+		protoFactory: protoFactory,
+	}
+}
+
+// Enables or disables length-delimited framing of records.
+func (p *Encoder) SetFramed(framed bool) {
+	p.framed = framed
+}
+
+// Encode writes v to the stream and flushes it.
+func (p *Encoder) Encode(v TStruct) error {
+	if !p.framed {
+		if err := v.Write(p.proto); err != nil {
+			return err
+		}
+		if err := p.proto.Flush(); err != nil {
+			return err
+		}
+		return p.trans.Flush()
+	}
+	if p.frameBuffer == nil {
+		p.frameBuffer = NewTMemoryBufferLen(1024)
+		p.frameProtocol = p.protoFactory.GetProtocol(p.frameBuffer)
+	}
+	p.frameBuffer.Reset()
+	if err := v.Write(p.frameProtocol); err != nil {
+		return err
+	}
+	if err := p.frameProtocol.Flush(); err != nil {
+		return err
+	}
+	payload := p.frameBuffer.Bytes()
+	var header [STREAM_FRAME_HEADER_SIZE]byte
+	binary.BigEndian.PutUint32(header[0:4], STREAM_FRAME_MAGIC)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[8:12], crc32.ChecksumIEEE(payload))
+	if _, err := p.trans.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := p.trans.Write(payload); err != nil {
+		return err
+	}
+	return p.trans.Flush()
+}
+
+// Decoder reads a sequence of TStruct values written by an Encoder from an
+// io.Reader.
+//
+// Decode returns io.EOF once the stream ends cleanly between two records. In
+// framed mode a corrupt record is reported as a TProtocolException of type
+// INVALID_DATA and skipped, so decoding may simply continue with the next
+// call to Decode.
+type Decoder struct {
+	source io.Reader
+	reader *bufio.Reader
+	count  *countingReader
+	trans  *StreamTransport
+	proto  TProtocol
+	framed bool
+
+	maxFrameSize int
+	protoFactory TProtocolFactory
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (p *countingReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.n += int64(n)
+	return n, err
+}
+
+// NewDecoder returns a Decoder reading from r using protocols created by
+// protoFactory.
+func NewDecoder(r io.Reader, protoFactory TProtocolFactory) *Decoder {
+	reader := bufio.NewReader(r)
+	count := &countingReader{r: reader}
+	trans := &StreamTransport{Reader: count}
+	return &Decoder{
+		source:       r,
+		reader:       reader,
+		count:        count,
+		trans:        trans,
+		proto:        protoFactory.GetProtocol(trans),
+		maxFrameSize: DEFAULT_MAX_STREAM_FRAME_SIZE,
+		protoFactory: protoFactory,
+	}
+}
+
+// Enables or disables length-delimited framing of records. This must match
+// the setting of the Encoder that produced the stream.
+func (p *Decoder) SetFramed(framed bool) {
+	p.framed = framed
+}
+
+// Sets the largest framed record that will be accepted. Larger frames are
+// treated as corrupt.
+func (p *Decoder) SetMaxFrameSize(size int) {
+	p.maxFrameSize = size
+}
+
+// Decode reads the next record from the stream into v.
+func (p *Decoder) Decode(v TStruct) error {
+	if p.framed {
+		return p.decodeFrame(v)
+	}
+	start := p.count.n
+	if err := v.Read(p.proto); err != nil {
+		// Nothing at all was consumed and the stream is exhausted: this
+		// is the end of the stream rather than a truncated record.
+		if p.count.n == start {
+			if _, perr := p.reader.Peek(1); perr == io.EOF {
+				return io.EOF
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *Decoder) decodeFrame(v TStruct) error {
+	skipped, err := p.syncFrame()
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		return NewTProtocolExceptionWithType(INVALID_DATA, fmt.Errorf("skipped %d bytes of corrupt data before frame", skipped))
+	}
+	header, err := p.peekFrame(STREAM_FRAME_HEADER_SIZE)
+	if err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(header[4:8]))
+	checksum := binary.BigEndian.Uint32(header[8:12])
+	if size > p.maxFrameSize {
+		// Only the header is consumed; the next call resynchronises on
+		// whatever frame follows.
+		p.reader.Discard(STREAM_FRAME_HEADER_SIZE)
+		return NewTProtocolExceptionWithType(INVALID_DATA, fmt.Errorf("frame size %d exceeds limit of %d", size, p.maxFrameSize))
+	}
+	// The frame is only consumed once its checksum matches, so that a
+	// corrupt size does not swallow the frames that follow.
+	frame, err := p.peekFrame(STREAM_FRAME_HEADER_SIZE + size)
+	if err != nil {
+		return err
+	}
+	payload := frame[STREAM_FRAME_HEADER_SIZE:]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		p.resync()
+		return NewTProtocolExceptionWithType(INVALID_DATA, fmt.Errorf("checksum mismatch in frame of size %d", size))
+	}
+	buf := NewTMemoryBuffer()
+	buf.Write(payload)
+	p.reader.Discard(len(frame))
+	if err := v.Read(p.protoFactory.GetProtocol(buf)); err != nil {
+		return NewTProtocolExceptionWithType(INVALID_DATA, err)
+	}
+	return nil
+}
+
+// peekFrame returns the next n bytes without consuming them, growing the
+// read buffer if it is too small. If the stream ends first it resyncs on
+// the next frame, as the size may be corrupt rather than the frame
+// truncated.
+func (p *Decoder) peekFrame(n int) ([]byte, error) {
+	if n > p.reader.Size() {
+		buffered, _ := p.reader.Peek(p.reader.Buffered())
+		rest := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), p.source)
+		p.reader = bufio.NewReaderSize(rest, n)
+		p.count.r = p.reader
+	}
+	b, err := p.reader.Peek(n)
+	if err != nil {
+		if err == io.EOF {
+			p.resync()
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, NewTTransportExceptionFromError(err)
+	}
+	return b, nil
+}
+
+// resync skips the magic of the current frame and any input up to the next.
+func (p *Decoder) resync() {
+	p.reader.Discard(4)
+	p.syncFrame()
+}
+
+// syncFrame discards input until the stream is positioned on a frame magic
+// and returns the number of bytes discarded on the way.
+func (p *Decoder) syncFrame() (int, error) {
+	skipped := 0
+	for {
+		b, err := p.reader.Peek(4)
+		if len(b) == 4 && binary.BigEndian.Uint32(b) == STREAM_FRAME_MAGIC {
+			return skipped, nil
+		}
+		if err != nil {
+			if err != io.EOF {
+				return skipped, NewTTransportExceptionFromError(err)
+			}
+			if skipped == 0 && len(b) == 0 {
+				return 0, io.EOF
+			}
+			p.reader.Discard(len(b))
+			return skipped + len(b), nil
+		}
+		p.reader.Discard(1)
+		skipped++
+	}
+}
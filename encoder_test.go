@@ -0,0 +1,147 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func encoderTestStructs() []*TestStruct {
+	structs := make([]*TestStruct, 5)
+	for i := range structs {
+		m := NewTestStruct()
+		m.Int32 = int32(i)
+		m.St = "record"
+		m.E = TestEnum_SECOND
+		structs[i] = m
+	}
+	return structs
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	protocols := []TProtocolFactory{
+		NewTBinaryProtocolFactoryDefault(),
+		// Compact omitted, see THRIFT-2158
+		NewTJSONProtocolFactory(),
+	}
+	for _, framed := range []bool{false, true} {
+		for _, pf := range protocols {
+			buf := &bytes.Buffer{}
+			enc := NewEncoder(buf, pf)
+			enc.SetFramed(framed)
+			for _, m := range encoderTestStructs() {
+				if err := enc.Encode(m); err != nil {
+					t.Fatalf("%T framed=%v: unable to encode: %s", pf, framed, err)
+				}
+			}
+			dec := NewDecoder(buf, pf)
+			dec.SetFramed(framed)
+			for i := 0; i < 5; i++ {
+				m := NewTestStruct()
+				if err := dec.Decode(m); err != nil {
+					t.Fatalf("%T framed=%v: unable to decode record %d: %s", pf, framed, i, err)
+				}
+				if m.Int32 != int32(i) || m.St != "record" {
+					t.Fatalf("%T framed=%v: record %d decoded as %#v", pf, framed, i, m)
+				}
+			}
+			if err := dec.Decode(NewTestStruct()); err != io.EOF {
+				t.Fatalf("%T framed=%v: expected io.EOF at end of stream, got %v", pf, framed, err)
+			}
+		}
+	}
+}
+
+func TestDecoderSkipsCorruptFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf, NewTBinaryProtocolFactoryDefault())
+	enc.SetFramed(true)
+	for _, m := range encoderTestStructs() {
+		if err := enc.Encode(m); err != nil {
+			t.Fatalf("Unable to encode: %s", err)
+		}
+	}
+	data := buf.Bytes()
+	frameSize := len(data) / 5
+	// Corrupt the payload of the second record and the magic of the fourth.
+	data[frameSize+STREAM_FRAME_HEADER_SIZE+2] ^= 0xff
+	data[3*frameSize] ^= 0xff
+
+	dec := NewDecoder(bytes.NewReader(data), NewTBinaryProtocolFactoryDefault())
+	dec.SetFramed(true)
+	var got []int32
+	corrupt := 0
+	for {
+		m := NewTestStruct()
+		err := dec.Decode(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if e, ok := err.(TProtocolException); !ok || e.TypeId() != INVALID_DATA {
+				t.Fatalf("Expected INVALID_DATA protocol exception, got %T: %s", err, err)
+			}
+			corrupt++
+			continue
+		}
+		got = append(got, m.Int32)
+	}
+	if corrupt != 2 {
+		t.Errorf("Expected 2 corrupt records, got %d", corrupt)
+	}
+	if len(got) != 3 || got[0] != 0 || got[1] != 2 || got[2] != 4 {
+		t.Errorf("Expected records [0 2 4], got %v", got)
+	}
+}
+
+func TestDecoderResyncsAfterCorruptFrameSize(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf, NewTBinaryProtocolFactoryDefault())
+	enc.SetFramed(true)
+	for _, m := range encoderTestStructs() {
+		if err := enc.Encode(m); err != nil {
+			t.Fatalf("Unable to encode: %s", err)
+		}
+	}
+	data := buf.Bytes()
+	// Claim a size within the limit but past the following frames, and one
+	// past the end of the stream.
+	data[6] ^= 0x01
+	data[5] ^= 0x01
+
+	dec := NewDecoder(bytes.NewReader(data), NewTBinaryProtocolFactoryDefault())
+	dec.SetFramed(true)
+	var got []int32
+	for i := 0; i < 20; i++ {
+		m := NewTestStruct()
+		err := dec.Decode(m)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			got = append(got, m.Int32)
+		}
+	}
+	if len(got) != 4 || got[0] != 1 || got[3] != 4 {
+		t.Errorf("Expected records [1 2 3 4], got %v", got)
+	}
+}
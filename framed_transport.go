@@ -23,24 +23,34 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"net"
 )
 
 type TFramedTransport struct {
 	transport   TTransport
 	writeBuffer *bytes.Buffer
 	readBuffer  *bytes.Buffer
+	logger      TLogger
 }
 
 type tFramedTransportFactory struct {
 	factory TTransportFactory
+	logger  TLogger
 }
 
 func NewTFramedTransportFactory(factory TTransportFactory) TTransportFactory {
 	return &tFramedTransportFactory{factory: factory}
 }
 
+// Returns a factory whose transports report problems to logger.
+func NewTFramedTransportFactory2(factory TTransportFactory, logger TLogger) TTransportFactory {
+	return &tFramedTransportFactory{factory: factory, logger: logger}
+}
+
 func (p *tFramedTransportFactory) GetTransport(base TTransport) TTransport {
-	return NewTFramedTransport(p.factory.GetTransport(base))
+	trans := NewTFramedTransport(p.factory.GetTransport(base))
+	trans.SetLogger(p.logger)
+	return trans
 }
 
 func NewTFramedTransport(transport TTransport) *TFramedTransport {
@@ -49,6 +59,19 @@ func NewTFramedTransport(transport TTransport) *TFramedTransport {
 	return &TFramedTransport{transport: transport, writeBuffer: bytes.NewBuffer(writeBuf), readBuffer: bytes.NewBuffer(readBuf)}
 }
 
+// Sets the logger the transport reports problems to, DefaultLogger() if
+// nil.
+func (p *TFramedTransport) SetLogger(logger TLogger) {
+	p.logger = logger
+}
+
+func (p *TFramedTransport) Logger() TLogger {
+	if p.logger == nil {
+		return DefaultLogger()
+	}
+	return p.logger
+}
+
 func (p *TFramedTransport) Open() error {
 	return p.transport.Open()
 }
@@ -95,8 +118,13 @@ func (p *TFramedTransport) Flush() error {
 	}
 	if size > 0 {
 		if n, err := p.writeBuffer.WriteTo(p.transport); err != nil {
-			print("Error while flushing write buffer of size ", size, " to transport, only wrote ", n, " bytes: ", err, "\n")
-			return NewTTransportExceptionFromError(err)
+			err = NewTTransportExceptionFromError(err)
+			var remote net.Addr
+			if conn := netConnOf(p.transport); conn != nil {
+				remote = conn.RemoteAddr()
+			}
+			p.Logger().Error("thrift: short write flushing frame", append(logAttrs(remote, "", err), "size", size, "written", n)...)
+			return err
 		}
 	}
 	err = p.transport.Flush()
@@ -0,0 +1,62 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// Environment variable naming the file descriptor a process started by
+// StartHandoffChild writes to once it serves.
+const HANDOFF_READY_FD_ENV = "THRIFT_HANDOFF_READY_FD"
+
+// The program StartHandoffChild starts; replaced in tests.
+var handoffCommand = func() (string, []string, error) {
+	name, err := os.Executable()
+	return name, os.Args[1:], err
+}
+
+// handoffEnviron returns the environment of this process without the
+// variables describing inherited sockets.
+func handoffEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case LISTEN_FDS_ENV, LISTEN_PID_ENV, LISTEN_FDNAMES_ENV, LISTEN_PPID_ENV, HANDOFF_READY_FD_ENV:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// Handoff hands the server's listening socket to a new instance of the
+// running program started with StartHandoffChild, then shuts the server
+// down as Shutdown does, letting its connections finish. Once Serve has
+// returned the process can exit, leaving the new one to serve.
+func (p *TSimpleServer) Handoff(ctx context.Context) (*os.Process, error) {
+	child, err := StartHandoffChild(ctx, p.serverTransport)
+	if err != nil {
+		return nil, err
+	}
+	return child, p.Shutdown(ctx)
+}
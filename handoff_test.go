@@ -0,0 +1,152 @@
+//go:build unix
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Set in the environment of the child process started by TestHandoff.
+const handoffTestAddrEnv = "THRIFT_TEST_HANDOFF_ADDR"
+
+// Replies to every call as method "child".
+type handoffChildProcessor struct{}
+
+func (p *handoffChildProcessor) Process(in, out TProtocol) (bool, TException) {
+	_, _, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	in.Skip(STRUCT)
+	in.ReadMessageEnd()
+	out.WriteMessageBegin("child", REPLY, seqId)
+	out.WriteStructBegin("result")
+	out.WriteFieldStop()
+	out.WriteStructEnd()
+	out.WriteMessageEnd()
+	return true, out.Flush()
+}
+
+// Runs as the child of TestHandoff, serving on the inherited socket.
+func TestHandoffChild(t *testing.T) {
+	addr := os.Getenv(handoffTestAddrEnv)
+	if addr == "" {
+		t.Skip("Only run by TestHandoff")
+	}
+	listeners, err := ListenersFromEnv()
+	if err != nil || len(listeners) != 1 || listeners[0].Name != handoffListenerName(listeners[0].Addr()) {
+		t.Fatalf("Unexpected inherited listeners %v: %v", listeners, err)
+	}
+	serverSocket, err := NewTServerSocketFromEnv(addr, 0)
+	if err != nil || !serverSocket.IsListening() {
+		t.Fatalf("Socket for %s not inherited: %v", addr, err)
+	}
+	server := NewTSimpleServer2(&handoffChildProcessor{}, serverSocket)
+	go func() {
+		time.Sleep(5 * time.Second)
+		server.Stop()
+	}()
+	server.Serve()
+}
+
+func TestHandoff(t *testing.T) {
+	server, addr, done := startTestServer(t, &sleepProcessor{})
+	defer server.Stop()
+	saved := handoffCommand
+	defer func() { handoffCommand = saved }()
+	handoffCommand = func() (string, []string, error) {
+		return os.Args[0], []string{"-test.run=^TestHandoffChild$"}, nil
+	}
+	os.Setenv(handoffTestAddrEnv, addr)
+	defer os.Unsetenv(handoffTestAddrEnv)
+
+	before := openTestClient(t, addr)
+	defer before.Transport().Close()
+	if err := callTestServer(before, "call", 1, 0); err != nil {
+		t.Fatalf("Call before handoff failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	child, err := server.Handoff(ctx)
+	if err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	defer func() {
+		child.Kill()
+		child.Wait()
+	}()
+	waitServe(t, done)
+
+	after := openTestClient(t, addr)
+	defer after.Transport().Close()
+	sendTestCall(after, "call", 2, 0)
+	if name, _, _, err := readTestReply(after); err != nil || name != "child" {
+		t.Errorf("Expected the child to answer, got %q: %v", name, err)
+	}
+}
+
+func TestHandoffFailsWhenChildExits(t *testing.T) {
+	serverSocket, _ := newTestServerSocket(t)
+	if err := serverSocket.Listen(); err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer serverSocket.Close()
+	saved := handoffCommand
+	defer func() { handoffCommand = saved }()
+	handoffCommand = func() (string, []string, error) {
+		return os.Args[0], []string{"-test.list=^$"}, nil
+	}
+	if _, err := StartHandoffChild(context.Background(), serverSocket); err == nil {
+		t.Error("Expected handoff to a child that does not serve to fail")
+	}
+	// The socket still accepts.
+	conn, err := net.Dial("tcp", serverSocket.Addr().String())
+	if err != nil {
+		t.Fatalf("Socket closed by failed handoff: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSameListenAddr(t *testing.T) {
+	resolve := func(s string) *net.TCPAddr {
+		addr, _ := net.ResolveTCPAddr("tcp", s)
+		return addr
+	}
+	for _, tc := range []struct {
+		inherited, requested string
+		expected             bool
+	}{
+		{"127.0.0.1:9090", "127.0.0.1:9090", true},
+		{"127.0.0.1:9090", "127.0.0.1:9091", false},
+		{"[::]:9090", ":9090", true},
+		{"[::]:9090", "0.0.0.0:9090", true},
+		{"127.0.0.1:9090", ":9090", false},
+	} {
+		if got := sameListenAddr(resolve(tc.inherited), resolve(tc.requested)); got != tc.expected {
+			t.Errorf("sameListenAddr(%s, %s) = %v", tc.inherited, tc.requested, got)
+		}
+	}
+}
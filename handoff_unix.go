@@ -0,0 +1,136 @@
+//go:build unix
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// StartHandoffChild starts a new instance of the running program, with the
+// same arguments and environment, passing it the listening sockets of
+// transports as it would be by systemd socket activation, named after their
+// addresses by handoffListenerName. It returns once a server in the new process has
+// started listening, as servers adopting the sockets with
+// NewTServerSocketFromEnv do, or fails if the process exits first or ctx
+// ends, in which case the process is killed.
+func StartHandoffChild(ctx context.Context, transports ...TServerTransport) (*os.Process, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var names []string
+	for _, t := range transports {
+		s, ok := t.(interface {
+			File() (*os.File, error)
+			Addr() net.Addr
+		})
+		if !ok {
+			return nil, errors.New("Server transport cannot be handed off")
+		}
+		f, err := s.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, handoffListenerName(s.Addr()))
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	name, args, err := handoffCommand()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(handoffEnviron(),
+		LISTEN_FDS_ENV+"="+strconv.Itoa(len(names)),
+		LISTEN_FDNAMES_ENV+"="+strings.Join(names, ":"),
+		LISTEN_PPID_ENV+"="+strconv.Itoa(os.Getpid()),
+		HANDOFF_READY_FD_ENV+"="+strconv.Itoa(LISTEN_FDS_START+len(names)),
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Only the child holds the write end now, so reading it ends when the
+	// child signals or exits.
+	readyW.Close()
+	files = files[:len(files)-1]
+	signalled := make(chan bool, 1)
+	go func() {
+		var b [1]byte
+		n, _ := ready.Read(b[:])
+		signalled <- n > 0
+	}()
+	select {
+	case ok := <-signalled:
+		if ok {
+			return cmd.Process, nil
+		}
+		cmd.Wait()
+		return nil, errors.New("Handoff child exited before serving")
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, ctx.Err()
+	}
+}
+
+// handoffListenerName names the socket listening on addr for the child,
+// replacing the colons LISTEN_FDNAMES separates names with.
+func handoffListenerName(addr net.Addr) string {
+	return strings.ReplaceAll(addr.String(), ":", "_")
+}
+
+var handoffReadyOnce sync.Once
+
+// notifyHandoffReady tells the process that started this one with
+// StartHandoffChild, if any, that this one serves.
+func notifyHandoffReady() {
+	handoffReadyOnce.Do(func() {
+		v := os.Getenv(HANDOFF_READY_FD_ENV)
+		os.Unsetenv(HANDOFF_READY_FD_ENV)
+		fd, err := strconv.Atoi(v)
+		if err != nil || fd < LISTEN_FDS_START {
+			return
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "handoff")
+		f.Write([]byte{1})
+		f.Close()
+	})
+}
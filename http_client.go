@@ -32,6 +32,8 @@ type THttpClient struct {
 	requestBuffer      *bytes.Buffer
 	nsecConnectTimeout int64
 	nsecReadTimeout    int64
+	// Headers sent with each request.
+	header http.Header
 }
 
 type THttpClientTransportFactory struct {
@@ -88,6 +90,22 @@ func NewTHttpPostClient(urlstr string) (TTransport, error) {
 	return &THttpClient{url: parsedURL, requestBuffer: bytes.NewBuffer(buf)}, nil
 }
 
+// Sets a header to be sent with each subsequent request.
+func (p *THttpClient) SetHeader(key, value string) {
+	if p.header == nil {
+		p.header = http.Header{}
+	}
+	p.header.Set(key, value)
+}
+
+func (p *THttpClient) GetHeader(key string) string {
+	return p.header.Get(key)
+}
+
+func (p *THttpClient) DelHeader(key string) {
+	p.header.Del(key)
+}
+
 func (p *THttpClient) Open() error {
 	// do nothing
 	return nil
@@ -128,7 +146,15 @@ func (p *THttpClient) Write(buf []byte) (int, error) {
 }
 
 func (p *THttpClient) Flush() error {
-	response, err := http.Post(p.url.String(), "application/x-thrift", p.requestBuffer)
+	request, err := http.NewRequest("POST", p.url.String(), p.requestBuffer)
+	if err != nil {
+		return NewTTransportExceptionFromError(err)
+	}
+	for key, values := range p.header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", "application/x-thrift")
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return NewTTransportExceptionFromError(err)
 	}
@@ -0,0 +1,65 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"net"
+	"net/http"
+)
+
+// NewThriftHandlerFunc returns an http.HandlerFunc serving Thrift calls
+// POSTed to it, as sent by THttpClient. Processors adapted with
+// NewTProcessorFromContext receive the request's context, which is
+// cancelled when the client goes away and carries the remote address, TLS
+// state and headers of the request, along with the caller's verified TLS
+// identity and the span context it propagated, if any.
+func NewThriftHandlerFunc(processor TProcessor, inPfactory, outPfactory TProtocolFactory) func(w http.ResponseWriter, r *http.Request) {
+	contextProcessor := NewTContextProcessor(processor)
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := &TConnectionInfo{
+			RemoteAddr: httpAddr(r.RemoteAddr),
+			TLS:        r.TLS,
+			Headers:    r.Header,
+		}
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			info.LocalAddr = addr
+		}
+		ctx := NewContextWithConnectionInfo(r.Context(), info)
+		if identity := newPeerIdentity(r.TLS); identity != nil {
+			ctx = NewContextWithPeerIdentity(ctx, identity)
+		}
+		ctx = DefaultPropagator().Extract(ctx, r.Header)
+		w.Header().Add("Content-Type", "application/x-thrift")
+		transport := NewStreamTransport(r.Body, w)
+		contextProcessor.Process(ctx, inPfactory.GetProtocol(transport), outPfactory.GetProtocol(transport))
+		transport.Flush()
+	}
+}
+
+// The address of an HTTP client, as reported by net/http.
+type httpAddr string
+
+func (p httpAddr) Network() string {
+	return "tcp"
+}
+
+func (p httpAddr) String() string {
+	return string(p)
+}
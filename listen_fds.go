@@ -0,0 +1,144 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Environment variables describing inherited listeners, as set by systemd
+// socket activation and by Handoff.
+const (
+	LISTEN_FDS_ENV     = "LISTEN_FDS"
+	LISTEN_PID_ENV     = "LISTEN_PID"
+	LISTEN_FDNAMES_ENV = "LISTEN_FDNAMES"
+	// Set by Handoff in place of LISTEN_PID, which the parent cannot know
+	// before starting the child: the pid of the parent.
+	LISTEN_PPID_ENV = "THRIFT_LISTEN_PPID"
+)
+
+// The first inherited file descriptor.
+const LISTEN_FDS_START = 3
+
+// A listener inherited from the process that started this one.
+type TInheritedListener struct {
+	net.Listener
+	// The name systemd was configured to give the socket, or for Handoff
+	// the address it listens on with colons replaced by underscores.
+	Name string
+}
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inherited   []TInheritedListener
+	inheritErr  error
+)
+
+// Returns the listeners passed to this process through LISTEN_FDS, by
+// systemd socket activation or Handoff. The environment variables are
+// cleared so that processes started later don't inherit them, and every
+// call returns the same listeners, less those adopted by
+// NewTServerSocketFromEnv.
+func ListenersFromEnv() ([]TInheritedListener, error) {
+	inheritOnce.Do(func() {
+		inherited, inheritErr = listenersFromEnv()
+	})
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	return append([]TInheritedListener(nil), inherited...), inheritErr
+}
+
+// adoptListener removes the inherited listener for addr from those
+// returned by ListenersFromEnv and returns it, or nil if there is none.
+func adoptListener(addr *net.TCPAddr) (net.Listener, error) {
+	if _, err := ListenersFromEnv(); err != nil {
+		return nil, err
+	}
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	for i, l := range inherited {
+		if a, ok := l.Addr().(*net.TCPAddr); ok && sameListenAddr(a, addr) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return l.Listener, nil
+		}
+	}
+	return nil, nil
+}
+
+func sameListenAddr(a, b *net.TCPAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+	return a.IP.Equal(b.IP) || (len(b.IP) == 0 || b.IP.IsUnspecified()) && a.IP.IsUnspecified()
+}
+
+// Creates a server socket for listenAddr that adopts the matching listener
+// passed by systemd or Handoff, if there is one, and otherwise listens
+// itself.
+func NewTServerSocketFromEnv(listenAddr string, clientTimeout time.Duration) (*TServerSocket, error) {
+	addr, err := net.ResolveTCPAddr("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := adoptListener(addr)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		return NewTServerSocketFromListener(l, clientTimeout), nil
+	}
+	return &TServerSocket{addr: addr, clientTimeout: clientTimeout}, nil
+}
+
+// Creates a TLS server socket like NewTServerSocketFromEnv.
+func NewTSSLServerSocketFromEnv(listenAddr string, cfg *tls.Config, clientTimeout time.Duration) (*TSSLServerSocket, error) {
+	addr, err := net.ResolveTCPAddr("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := adoptListener(addr)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		return NewTSSLServerSocketFromListener(l, cfg, clientTimeout), nil
+	}
+	return &TSSLServerSocket{addr: addr, clientTimeout: clientTimeout, cfg: cfg}, nil
+}
+
+// listenerFile returns a duplicate of the file descriptor of l.
+func listenerFile(l net.Listener) (*os.File, error) {
+	if l == nil {
+		return nil, NewTTransportException(NOT_OPEN, "No underlying server socket")
+	}
+	f, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.New("Listener has no file descriptor")
+	}
+	return f.File()
+}
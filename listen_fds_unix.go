@@ -0,0 +1,78 @@
+//go:build unix
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func listenersFromEnv() ([]TInheritedListener, error) {
+	defer func() {
+		for _, name := range []string{LISTEN_FDS_ENV, LISTEN_PID_ENV, LISTEN_FDNAMES_ENV, LISTEN_PPID_ENV} {
+			os.Unsetenv(name)
+		}
+	}()
+	fds := os.Getenv(LISTEN_FDS_ENV)
+	if fds == "" {
+		return nil, nil
+	}
+	// The variables are meant for this process only, and not for one that
+	// inherited them by mistake.
+	if pid := os.Getenv(LISTEN_PID_ENV); pid != "" {
+		if pid != strconv.Itoa(os.Getpid()) {
+			return nil, nil
+		}
+	} else if os.Getenv(LISTEN_PPID_ENV) != strconv.Itoa(os.Getppid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.New("Invalid " + LISTEN_FDS_ENV + ": " + fds)
+	}
+	names := strings.Split(os.Getenv(LISTEN_FDNAMES_ENV), ":")
+	listeners := make([]TInheritedListener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := LISTEN_FDS_START + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener duplicates the descriptor.
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, TInheritedListener{l, name})
+	}
+	return listeners, nil
+}
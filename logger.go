@@ -0,0 +1,91 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// TLogger receives the messages servers and transports report, as a
+// message followed by alternating keys and values. A *slog.Logger is a
+// TLogger; slog.New(slog.DiscardHandler) silences the package. Protocols
+// log nothing: they report every problem as a returned error.
+type TLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+var (
+	defaultLoggerMu sync.RWMutex
+	defaultLogger   TLogger
+)
+
+// Sets the logger used where no other has been set. Passing nil restores
+// slog.Default().
+func SetDefaultLogger(logger TLogger) {
+	defaultLoggerMu.Lock()
+	defer defaultLoggerMu.Unlock()
+	defaultLogger = logger
+}
+
+// Returns the logger set with SetDefaultLogger, or slog.Default().
+func DefaultLogger() TLogger {
+	defaultLoggerMu.RLock()
+	defer defaultLoggerMu.RUnlock()
+	if defaultLogger == nil {
+		return slog.Default()
+	}
+	return defaultLogger
+}
+
+// errorType names the kind of err for log messages.
+func errorType(err error) string {
+	// TTransportException and TProtocolException have the same methods, so
+	// only their implementations tell them apart.
+	switch err.(type) {
+	case *tTransportException:
+		return "transport"
+	case *tProtocolException:
+		return "protocol"
+	case TApplicationException:
+		return "application"
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+// logAttrs returns the attributes common to the package's log messages.
+func logAttrs(remote net.Addr, method string, err error) []interface{} {
+	attrs := []interface{}{}
+	if remote != nil {
+		attrs = append(attrs, "remote", remote.String())
+	}
+	if method != "" {
+		attrs = append(attrs, "method", method)
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error(), "error_type", errorType(err))
+	}
+	return attrs
+}
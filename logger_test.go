@@ -0,0 +1,170 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A bytes.Buffer safe to write from server goroutines while a test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newTestLogger() (TLogger, *lockedBuffer) {
+	buf := &lockedBuffer{}
+	return slog.New(slog.NewTextHandler(buf, nil)), buf
+}
+
+func TestErrorType(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{NewTTransportException(END_OF_FILE, "eof"), "transport"},
+		{NewTProtocolExceptionWithType(INVALID_DATA, errors.New("bad")), "protocol"},
+		{NewTApplicationException(INTERNAL_ERROR, "failed"), "application"},
+		{errors.New("other"), "*errors.errorString"},
+	} {
+		if got := errorType(tc.err); got != tc.expected {
+			t.Errorf("errorType(%v) = %q, want %q", tc.err, got, tc.expected)
+		}
+	}
+}
+
+func TestDefaultLogger(t *testing.T) {
+	if DefaultLogger() != slog.Default() {
+		t.Error("Expected slog.Default() as the default logger")
+	}
+	logger, _ := newTestLogger()
+	SetDefaultLogger(logger)
+	defer SetDefaultLogger(nil)
+	if DefaultLogger() != logger {
+		t.Error("SetDefaultLogger did not take effect")
+	}
+	if server := NewTSimpleServer2(NewTBaseProcessor(), &failingServerTransport{}); server.Logger() != logger {
+		t.Error("Server does not fall back to the default logger")
+	}
+}
+
+func TestFramedTransportFactoryLogger(t *testing.T) {
+	logger, _ := newTestLogger()
+	factory := NewTFramedTransportFactory2(NewTTransportFactory(), logger)
+	trans := factory.GetTransport(NewTMemoryBuffer()).(*TFramedTransport)
+	if trans.Logger() != logger {
+		t.Error("Framed transport does not use the factory's logger")
+	}
+	trans = NewTFramedTransportFactory(NewTTransportFactory()).GetTransport(NewTMemoryBuffer()).(*TFramedTransport)
+	if trans.Logger() != DefaultLogger() {
+		t.Error("Framed transport does not fall back to the default logger")
+	}
+}
+
+// A server transport whose Accept always fails.
+type failingServerTransport struct {
+	accepts     int32
+	interrupted int32
+}
+
+func (p *failingServerTransport) Listen() error { return nil }
+func (p *failingServerTransport) Close() error  { return nil }
+
+func (p *failingServerTransport) Accept() (TTransport, error) {
+	atomic.AddInt32(&p.accepts, 1)
+	if atomic.LoadInt32(&p.interrupted) != 0 {
+		return nil, errTransportInterrupted
+	}
+	return nil, errors.New("too many open files")
+}
+
+func (p *failingServerTransport) Interrupt() error {
+	atomic.StoreInt32(&p.interrupted, 1)
+	return nil
+}
+
+func TestSimpleServerAcceptBackoff(t *testing.T) {
+	transport := &failingServerTransport{}
+	server := NewTSimpleServer2(NewTBaseProcessor(), transport)
+	logger, logs := newTestLogger()
+	server.SetLogger(logger)
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	time.Sleep(150 * time.Millisecond)
+	server.Stop()
+	waitServe(t, done)
+	// 5, 10, 20, 40 and 80ms delays fit in 150ms.
+	if n := atomic.LoadInt32(&transport.accepts); n > 8 {
+		t.Errorf("Accept retried %d times without backing off", n)
+	}
+	if l := logs.String(); !strings.Contains(l, "accept failed") || !strings.Contains(l, "error_type=*errors.errorString") {
+		t.Errorf("Unexpected accept log: %q", l)
+	}
+}
+
+// A processor function failing with a protocol error.
+type failingFunction struct{}
+
+func (p *failingFunction) Process(seqId int32, in, out TProtocol) (bool, TException) {
+	return false, NewTProtocolExceptionWithType(INVALID_DATA, errors.New("corrupt arguments"))
+}
+
+func TestSimpleServerLogsRequestErrors(t *testing.T) {
+	processor := NewTBaseProcessor()
+	processor.AddToProcessorMap("fail", &failingFunction{})
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTSimpleServer2(processor, serverSocket)
+	logger, logs := newTestLogger()
+	server.SetLogger(logger)
+	done := startServing(t, server, serverSocket)
+	prot := openTestClient(t, addr)
+	sendTestCall(prot, "fail", 1, 0)
+	// The server closes the connection after the error.
+	var b [1]byte
+	prot.Transport().Read(b[:])
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+	l := logs.String()
+	for _, expected := range []string{"error processing request", "method=fail", "error_type=protocol", "remote=127.0.0.1:"} {
+		if !strings.Contains(l, expected) {
+			t.Errorf("Request error log %q lacks %q", l, expected)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TMetricsCollector is told by a server of the connections it accepts and
+// the calls it processes. It must be safe for concurrent use.
+type TMetricsCollector interface {
+	ConnectionOpened()
+	ConnectionClosed()
+	// Called once the header of a call to method has been read.
+	CallStarted(method string)
+	// Called once the call has been processed, with the bytes read and
+	// written for it. errorType is empty if the call succeeded, and
+	// otherwise one of "transport", "protocol", "application" (including
+	// exceptions sent to the caller) or "panic".
+	CallFinished(method string, duration time.Duration, requestBytes, responseBytes int64, errorType string)
+}
+
+// Default number of method names TMetrics keeps metrics for separately.
+const DEFAULT_METRICS_MAX_METHODS = 256
+
+// The method name calls to further methods are counted under, as names come
+// from callers and could otherwise grow the metrics without bound.
+const METRICS_UNKNOWN_METHOD = "unknown"
+
+// Default bounds of the latency histogram buckets, in seconds.
+var DEFAULT_LATENCY_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default bounds of the request and response size histogram buckets, in
+// bytes.
+var DEFAULT_SIZE_BUCKETS = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+// TMetrics is a TMetricsCollector keeping per-method counts, errors by
+// type, in-flight gauges and histograms of latencies and sizes, along with
+// connection counts.
+//
+// It is an expvar.Var, so it can be published with expvar.Publish, and an
+// http.Handler serving the metrics in the Prometheus text format.
+type TMetrics struct {
+	latencyBuckets []float64
+	sizeBuckets    []float64
+	maxMethods     int
+
+	mu               sync.Mutex
+	connectionsOpen  int64
+	connectionsTotal int64
+	methods          map[string]*tMethodMetrics
+	rateLimiters     []*TRateLimiter
+}
+
+type tMethodMetrics struct {
+	requests      int64
+	inFlight      int64
+	errors        map[string]int64
+	latency       *tHistogram
+	requestBytes  *tHistogram
+	responseBytes *tHistogram
+}
+
+type tHistogram struct {
+	bounds []float64
+	// counts[i] counts the observations no greater than bounds[i] and
+	// greater than the bound before; the last counts the rest.
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newTHistogram(bounds []float64) *tHistogram {
+	return &tHistogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (p *tHistogram) observe(v float64) {
+	p.counts[sort.SearchFloat64s(p.bounds, v)]++
+	p.sum += v
+	p.count++
+}
+
+func NewTMetrics() *TMetrics {
+	return NewTMetrics2(DEFAULT_LATENCY_BUCKETS, DEFAULT_SIZE_BUCKETS)
+}
+
+// Creates a TMetrics with the given ascending histogram bucket bounds, in
+// seconds for latencies and bytes for sizes.
+func NewTMetrics2(latencyBuckets, sizeBuckets []float64) *TMetrics {
+	return &TMetrics{
+		latencyBuckets: latencyBuckets,
+		sizeBuckets:    sizeBuckets,
+		maxMethods:     DEFAULT_METRICS_MAX_METHODS,
+		methods:        make(map[string]*tMethodMetrics),
+	}
+}
+
+// Sets how many method names are kept separately. Calls to methods seen
+// once the limit is reached are counted as METRICS_UNKNOWN_METHOD.
+func (p *TMetrics) SetMaxMethods(max int) {
+	p.mu.Lock()
+	p.maxMethods = max
+	p.mu.Unlock()
+}
+
+func (p *TMetrics) ConnectionOpened() {
+	p.mu.Lock()
+	p.connectionsOpen++
+	p.connectionsTotal++
+	p.mu.Unlock()
+}
+
+func (p *TMetrics) ConnectionClosed() {
+	p.mu.Lock()
+	p.connectionsOpen--
+	p.mu.Unlock()
+}
+
+func (p *TMetrics) CallStarted(method string) {
+	p.mu.Lock()
+	p.method(method).inFlight++
+	p.mu.Unlock()
+}
+
+func (p *TMetrics) CallFinished(method string, duration time.Duration, requestBytes, responseBytes int64, errorType string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.method(method)
+	m.inFlight--
+	m.requests++
+	if errorType != "" {
+		m.errors[errorType]++
+	}
+	m.latency.observe(duration.Seconds())
+	m.requestBytes.observe(float64(requestBytes))
+	m.responseBytes.observe(float64(responseBytes))
+}
+
+// Includes the counts of limiter in the metrics served.
+func (p *TMetrics) AddRateLimiter(limiter *TRateLimiter) {
+	p.mu.Lock()
+	p.rateLimiters = append(p.rateLimiters, limiter)
+	p.mu.Unlock()
+}
+
+// method returns the metrics of the named method. Must be called with p.mu
+// held.
+func (p *TMetrics) method(name string) *tMethodMetrics {
+	m, ok := p.methods[name]
+	if !ok && len(p.methods) >= p.maxMethods {
+		name = METRICS_UNKNOWN_METHOD
+		m, ok = p.methods[name]
+	}
+	if !ok {
+		m = &tMethodMetrics{
+			errors:        make(map[string]int64),
+			latency:       newTHistogram(p.latencyBuckets),
+			requestBytes:  newTHistogram(p.sizeBuckets),
+			responseBytes: newTHistogram(p.sizeBuckets),
+		}
+		p.methods[name] = m
+	}
+	return m
+}
+
+// Method names in order. Must be called with p.mu held.
+func (p *TMetrics) methodNames() []string {
+	names := make([]string, 0, len(p.methods))
+	for name := range p.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns the metrics as JSON, making TMetrics an expvar.Var.
+func (p *TMetrics) String() string {
+	type histogram struct {
+		Buckets map[string]int64 `json:"buckets"`
+		Sum     float64          `json:"sum"`
+		Count   int64            `json:"count"`
+	}
+	type method struct {
+		Requests      int64            `json:"requests"`
+		InFlight      int64            `json:"in_flight"`
+		Errors        map[string]int64 `json:"errors"`
+		Latency       histogram        `json:"latency_seconds"`
+		RequestBytes  histogram        `json:"request_bytes"`
+		ResponseBytes histogram        `json:"response_bytes"`
+	}
+	toJSON := func(h *tHistogram) histogram {
+		buckets := make(map[string]int64, len(h.counts))
+		var cumulative int64
+		for i, n := range h.counts {
+			cumulative += n
+			buckets[bucketLabel(h.bounds, i)] = cumulative
+		}
+		return histogram{buckets, h.sum, h.count}
+	}
+	p.mu.Lock()
+	type rateLimiter struct {
+		Allowed   int64 `json:"allowed"`
+		Throttled int64 `json:"throttled"`
+	}
+	v := struct {
+		ConnectionsOpen  int64                  `json:"connections_open"`
+		ConnectionsTotal int64                  `json:"connections_total"`
+		Methods          map[string]method      `json:"methods"`
+		RateLimiters     map[string]rateLimiter `json:"rate_limiters,omitempty"`
+	}{p.connectionsOpen, p.connectionsTotal, make(map[string]method, len(p.methods)), make(map[string]rateLimiter)}
+	for _, l := range p.rateLimiters {
+		allowed, throttled := l.Counts()
+		v.RateLimiters[l.Name()] = rateLimiter{allowed, throttled}
+	}
+	for name, m := range p.methods {
+		errors := make(map[string]int64, len(m.errors))
+		for t, n := range m.errors {
+			errors[t] = n
+		}
+		v.Methods[name] = method{m.requests, m.inFlight, errors, toJSON(m.latency), toJSON(m.requestBytes), toJSON(m.responseBytes)}
+	}
+	p.mu.Unlock()
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (p *TMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(p.prometheusText())
+}
+
+func (p *TMetrics) prometheusText() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var b bytes.Buffer
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	header("thrift_server_connections_open", "gauge", "Connections currently open.")
+	fmt.Fprintf(&b, "thrift_server_connections_open %d\n", p.connectionsOpen)
+	header("thrift_server_connections_total", "counter", "Connections accepted.")
+	fmt.Fprintf(&b, "thrift_server_connections_total %d\n", p.connectionsTotal)
+	names := p.methodNames()
+
+	header("thrift_server_requests_total", "counter", "Calls processed, by method.")
+	for _, name := range names {
+		fmt.Fprintf(&b, "thrift_server_requests_total{method=%s} %d\n", quoteLabel(name), p.methods[name].requests)
+	}
+	header("thrift_server_errors_total", "counter", "Calls that failed, by method and error type.")
+	for _, name := range names {
+		m := p.methods[name]
+		types := make([]string, 0, len(m.errors))
+		for t := range m.errors {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			fmt.Fprintf(&b, "thrift_server_errors_total{method=%s,type=%s} %d\n", quoteLabel(name), quoteLabel(t), m.errors[t])
+		}
+	}
+	header("thrift_server_in_flight", "gauge", "Calls being processed, by method.")
+	for _, name := range names {
+		fmt.Fprintf(&b, "thrift_server_in_flight{method=%s} %d\n", quoteLabel(name), p.methods[name].inFlight)
+	}
+	histograms := []struct {
+		name, help string
+		get        func(*tMethodMetrics) *tHistogram
+	}{
+		{"thrift_server_request_duration_seconds", "Time taken to process calls, by method.", func(m *tMethodMetrics) *tHistogram { return m.latency }},
+		{"thrift_server_request_size_bytes", "Sizes of calls, by method.", func(m *tMethodMetrics) *tHistogram { return m.requestBytes }},
+		{"thrift_server_response_size_bytes", "Sizes of replies, by method.", func(m *tMethodMetrics) *tHistogram { return m.responseBytes }},
+	}
+	if len(p.rateLimiters) > 0 {
+		header("thrift_server_rate_limit_allowed_total", "counter", "Calls allowed, by rate limiter.")
+		for _, l := range p.rateLimiters {
+			allowed, _ := l.Counts()
+			fmt.Fprintf(&b, "thrift_server_rate_limit_allowed_total{limiter=%s} %d\n", quoteLabel(l.Name()), allowed)
+		}
+		header("thrift_server_rate_limit_throttled_total", "counter", "Calls throttled, by rate limiter.")
+		for _, l := range p.rateLimiters {
+			_, throttled := l.Counts()
+			fmt.Fprintf(&b, "thrift_server_rate_limit_throttled_total{limiter=%s} %d\n", quoteLabel(l.Name()), throttled)
+		}
+	}
+	for _, hist := range histograms {
+		header(hist.name, "histogram", hist.help)
+		for _, name := range names {
+			h := hist.get(p.methods[name])
+			var cumulative int64
+			for i, n := range h.counts {
+				cumulative += n
+				fmt.Fprintf(&b, "%s_bucket{method=%s,le=\"%s\"} %d\n", hist.name, quoteLabel(name), bucketLabel(h.bounds, i), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_sum{method=%s} %s\n", hist.name, quoteLabel(name), strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(&b, "%s_count{method=%s} %d\n", hist.name, quoteLabel(name), h.count)
+		}
+	}
+	return b.Bytes()
+}
+
+// bucketLabel returns the upper bound of bucket i of a histogram with the
+// given bounds.
+func bucketLabel(bounds []float64, i int) string {
+	if i == len(bounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bounds[i], 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
@@ -0,0 +1,123 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerMetrics(t *testing.T) {
+	processor := NewTBaseProcessor()
+	processor.AddToProcessorMap("echo", &emptyReplyFunction{})
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTSimpleServer2(processor, serverSocket)
+	metrics := NewTMetrics()
+	server.SetMetricsCollector(metrics)
+	done := startServing(t, server, serverSocket)
+	prot := openTestClient(t, addr)
+	for i := int32(1); i <= 2; i++ {
+		if err := callTestServer(prot, "echo", i, 0); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+	}
+	if err := callTestServer(prot, "missing", 3, 0); err == nil {
+		t.Fatal("Expected an unknown method error")
+	}
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+	text := string(body)
+	for _, line := range []string{
+		"thrift_server_connections_open 0",
+		"thrift_server_connections_total 1",
+		`thrift_server_requests_total{method="echo"} 2`,
+		`thrift_server_requests_total{method="missing"} 1`,
+		`thrift_server_errors_total{method="missing",type="application"} 1`,
+		`thrift_server_in_flight{method="echo"} 0`,
+		`thrift_server_request_duration_seconds_bucket{method="echo",le="+Inf"} 2`,
+		`thrift_server_request_duration_seconds_count{method="echo"} 2`,
+		`thrift_server_response_size_bytes_count{method="echo"} 2`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Metrics lack %q:\n%s", line, text)
+		}
+	}
+	if strings.Contains(text, `thrift_server_errors_total{method="echo"`) {
+		t.Errorf("Unexpected errors for echo:\n%s", text)
+	}
+
+	var v struct {
+		Methods map[string]struct {
+			Requests     int64 `json:"requests"`
+			RequestBytes struct {
+				Sum float64 `json:"sum"`
+			} `json:"request_bytes"`
+		} `json:"methods"`
+	}
+	if err := json.Unmarshal([]byte(metrics.String()), &v); err != nil {
+		t.Fatalf("Invalid expvar JSON: %v", err)
+	}
+	// Each echo call is a 4 byte version, 8 byte name, 4 byte seqid and an
+	// 8 byte argument struct.
+	if m := v.Methods["echo"]; m.Requests != 2 || m.RequestBytes.Sum != 2*24 {
+		t.Errorf("Unexpected expvar metrics for echo: %+v", m)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	if got := quoteLabel("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("Unexpected escaped label %s", got)
+	}
+}
+
+func TestMetricsMaxMethods(t *testing.T) {
+	m := NewTMetrics()
+	m.SetMaxMethods(2)
+	for _, name := range []string{"a", "b", "c", "d", "a"} {
+		m.CallStarted(name)
+		m.CallFinished(name, time.Millisecond, 10, 10, "")
+	}
+	text := string(m.prometheusText())
+	for _, series := range []string{
+		`thrift_server_requests_total{method="a"} 2`,
+		`thrift_server_requests_total{method="b"} 1`,
+		`thrift_server_requests_total{method="unknown"} 2`,
+		`thrift_server_in_flight{method="unknown"} 0`,
+	} {
+		if !strings.Contains(text, series) {
+			t.Errorf("Expected %s in:\n%s", series, text)
+		}
+	}
+	if strings.Contains(text, `method="c"`) {
+		t.Errorf("Expected no series for methods past the limit:\n%s", text)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+)
+
+// The identity a caller proved with a verified TLS client certificate.
+type TPeerIdentity struct {
+	// The verified chain, from the caller's certificate to a trusted root.
+	Chain          []*x509.Certificate
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	// The URI SANs in the spiffe scheme, as SPIFFE IDs.
+	SPIFFEIDs []string
+}
+
+// Returns a name for the identity: its first SPIFFE ID, or else its first
+// URI SAN, or else the common name of its subject.
+func (p *TPeerIdentity) Name() string {
+	if len(p.SPIFFEIDs) > 0 {
+		return p.SPIFFEIDs[0]
+	}
+	if len(p.URIs) > 0 {
+		return p.URIs[0].String()
+	}
+	return p.Subject.CommonName
+}
+
+// newPeerIdentity returns the identity of the verified client certificate
+// of a TLS connection, or nil if there is none.
+func newPeerIdentity(state *tls.ConnectionState) *TPeerIdentity {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	chain := state.VerifiedChains[0]
+	cert := chain[0]
+	identity := &TPeerIdentity{
+		Chain:          chain,
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			identity.SPIFFEIDs = append(identity.SPIFFEIDs, uri.String())
+		}
+	}
+	return identity
+}
+
+// Returns a copy of ctx carrying identity.
+func NewContextWithPeerIdentity(ctx context.Context, identity *TPeerIdentity) context.Context {
+	return context.WithValue(ctx, peerIdentityKey, identity)
+}
+
+// Returns the verified identity of the caller of the call being processed,
+// if it presented a client certificate.
+func PeerIdentityFromContext(ctx context.Context) (*TPeerIdentity, bool) {
+	identity, ok := ctx.Value(peerIdentityKey).(*TPeerIdentity)
+	return identity, ok && identity != nil
+}
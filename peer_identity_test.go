@@ -0,0 +1,103 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestPeerIdentityAuthorization(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	addr, err := FindAvailableTCPServerPort(40000)
+	if err != nil {
+		t.Fatalf("Unable to find available tcp port addr: %s", err)
+	}
+	serverSocket, err := NewTSSLServerSocket(addr.String(), &tls.Config{
+		Certificates: []tls.Certificate{ca.keyPair(t, "server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create server socket: %s", err)
+	}
+	policy := NewTMethodPolicy()
+	policy.Allow("spiffe://example.org/alice", "echo")
+	policy.Allow(POLICY_ANY, "ping")
+	processor := newContextProcessor()
+	server := NewTSimpleServer2(WrapProcessor(NewTProcessorFromContext(processor), NewTAuthorizationMiddleware(policy.Authorize)), serverSocket)
+	done := startServing(t, server, serverSocket)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+
+	connect := func(cert tls.Certificate) TProtocol {
+		socket, err := NewTSSLSocketTimeout(addr.String(), &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}, 2*time.Second)
+		if err != nil {
+			t.Fatalf("Unable to create client socket: %s", err)
+		}
+		if err := socket.Open(); err != nil {
+			t.Fatalf("Unable to connect: %s", err)
+		}
+		return NewTBinaryProtocolTransport(socket)
+	}
+	alice := connect(ca.keyPair(t, "alice", "spiffe://example.org/alice"))
+	defer alice.Transport().Close()
+	if err := callTestServer(alice, "echo", 1, 0); err != nil {
+		t.Fatalf("Allowed call failed: %v", err)
+	}
+	identity, ok := PeerIdentityFromContext(<-processor.calls)
+	if !ok {
+		t.Fatal("No peer identity in the handler context")
+	}
+	if identity.Name() != "spiffe://example.org/alice" || identity.Subject.CommonName != "alice" || len(identity.Chain) != 2 || len(identity.SPIFFEIDs) != 1 {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+	err = callTestServer(alice, "admin", 2, 0)
+	if e, ok := err.(TApplicationException); !ok || e.TypeId() != PERMISSION_DENIED {
+		t.Errorf("Expected PERMISSION_DENIED, got %v", err)
+	}
+
+	bob := connect(ca.keyPair(t, "bob"))
+	defer bob.Transport().Close()
+	if err := callTestServer(bob, "echo", 1, 0); err == nil {
+		t.Error("Expected bob to be denied")
+	}
+	if err := callTestServer(bob, "ping", 2, 0); err != nil {
+		t.Errorf("Call allowed to any identity failed: %v", err)
+	}
+}
+
+func TestMethodPolicyDeniesAnonymous(t *testing.T) {
+	policy := NewTMethodPolicy()
+	policy.Allow(POLICY_ANY, POLICY_ANY)
+	if err := policy.Authorize(context.Background(), nil, "echo"); err == nil {
+		t.Error("Expected callers without an identity to be denied")
+	}
+	if err := policy.Authorize(context.Background(), &TPeerIdentity{}, "echo"); err != nil {
+		t.Errorf("Expected any identity to be allowed: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	DEFAULT_PIPELINE_MAX_IN_FLIGHT = 32
+	DEFAULT_PIPELINE_MAX_FRAME     = 16 * 1024 * 1024
+)
+
+// Server for framed clients that pipeline calls on a single connection.
+// Frames are read ahead and handed to the processor concurrently, up to a
+// per-connection limit, and each reply frame is written as soon as it is
+// ready. Replies may therefore be sent in a different order than the calls
+// arrived; clients match them to their calls by seqid.
+//
+// The server does the framing itself, so it takes no transport factories,
+// and the processor must be safe for concurrent use.
+type TPipelinedServer struct {
+	*TSimpleServer
+
+	maxInFlight  int
+	maxFrameSize int
+}
+
+func NewTPipelinedServer2(processor TProcessor, serverTransport TServerTransport) *TPipelinedServer {
+	return NewTPipelinedServerFactory2(NewTProcessorFactory(processor), serverTransport)
+}
+
+func NewTPipelinedServer3(processor TProcessor, serverTransport TServerTransport, protocolFactory TProtocolFactory) *TPipelinedServer {
+	return NewTPipelinedServerFactory3(NewTProcessorFactory(processor), serverTransport, protocolFactory)
+}
+
+func NewTPipelinedServerFactory2(processorFactory TProcessorFactory, serverTransport TServerTransport) *TPipelinedServer {
+	return NewTPipelinedServerFactory3(processorFactory, serverTransport, NewTBinaryProtocolFactoryDefault())
+}
+
+func NewTPipelinedServerFactory3(processorFactory TProcessorFactory, serverTransport TServerTransport, protocolFactory TProtocolFactory) *TPipelinedServer {
+	return &TPipelinedServer{
+		TSimpleServer: NewTSimpleServerFactory4(processorFactory,
+			serverTransport,
+			NewTTransportFactory(),
+			protocolFactory,
+		),
+		maxInFlight:  DEFAULT_PIPELINE_MAX_IN_FLIGHT,
+		maxFrameSize: DEFAULT_PIPELINE_MAX_FRAME,
+	}
+}
+
+// Sets how many calls of one connection may be processed at the same time.
+// Once the limit is reached the server stops reading from the connection.
+func (p *TPipelinedServer) SetMaxInFlight(n int) {
+	p.maxInFlight = n
+}
+
+// Sets the largest frame accepted; connections sending larger frames are
+// closed.
+func (p *TPipelinedServer) SetMaxFrameSize(n int) {
+	p.maxFrameSize = n
+}
+
+func (p *TPipelinedServer) MaxInFlight() int {
+	return p.maxInFlight
+}
+
+func (p *TPipelinedServer) MaxFrameSize() int {
+	return p.maxFrameSize
+}
+
+// Serve accepts connections until the server is stopped, then waits for
+// the remaining connections to finish before returning.
+func (p *TPipelinedServer) Serve() error {
+	return p.serve(func(conn *tServerConn) {
+		go func() {
+			defer p.removeConn(conn)
+			p.startLimits(conn)
+			defer conn.stopLimits()
+			if err := p.processPipelined(conn); err != nil {
+				p.logRequestError(conn, err)
+			}
+		}()
+	})
+}
+
+func (p *TPipelinedServer) processPipelined(conn *tServerConn) error {
+	defer conn.Close()
+	processor := NewTContextProcessor(p.processorFactory.GetProcessor(conn.TTransport))
+	ctx, err := conn.newContext()
+	// Calls still running when the client goes away are cancelled as soon
+	// as the reader notices.
+	defer conn.cancelContext()
+	if err != nil {
+		return err
+	}
+	if p.eventHandler != nil {
+		in := p.inputProtocolFactory.GetProtocol(conn)
+		out := p.outputProtocolFactory.GetProtocol(conn)
+		conn.serverContext = p.eventHandler.CreateContext(in, out)
+		defer p.eventHandler.DeleteContext(conn.serverContext, in, out)
+		ctx = NewContextWithServerContext(ctx, conn.serverContext)
+	}
+	maxInFlight := p.maxInFlight
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	slots := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+
+	var mu sync.Mutex
+	var failure error
+	fail := func(err error) {
+		mu.Lock()
+		if failure == nil {
+			failure = err
+			// Stop the reader; replies still being written will fail.
+			conn.forceClose()
+		}
+		mu.Unlock()
+	}
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return failure
+	}
+
+	var writeMu sync.Mutex
+	// A draining connection is closed once the calls read so far have been
+	// answered.
+	for failed() == nil && !p.isStopped() && !conn.isDraining() {
+		// Take the slot first so no frame is buffered beyond the limit.
+		slots <- struct{}{}
+		frame, err := p.readFrame(conn)
+		if err != nil {
+			<-slots
+			if e, ok := err.(TTransportException); ok && e.TypeId() == END_OF_FILE {
+				// A half-closed client still waits for its replies.
+				break
+			}
+			conn.cancelContext()
+			if failed() != nil || p.isStopped() || conn.isClosed() {
+				break
+			}
+			return err
+		}
+		conn.beginRequest()
+		if p.eventHandler != nil {
+			p.eventHandler.ProcessContext(conn.serverContext, conn.TTransport)
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				conn.endRequest()
+				wg.Done()
+			}()
+			reply, ok, err := p.processFrame(ctx, processor, conn, frame)
+			if e, isApp := err.(TApplicationException); isApp && e.TypeId() == UNKNOWN_METHOD {
+				// The caller has been told; keep the connection.
+				err, ok = nil, true
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			if len(reply) > 0 {
+				writeMu.Lock()
+				err = writeFrame(conn, reply)
+				writeMu.Unlock()
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+			if !ok {
+				fail(errPipelineStopped)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := failed(); err != nil && err != errPipelineStopped && !p.isStopped() {
+		return err
+	}
+	return nil
+}
+
+// Reported by a processor returning false, which ends the connection
+// without being an error.
+var errPipelineStopped = errors.New("Processor ended the connection")
+
+func (p *TPipelinedServer) processFrame(ctx context.Context, processor TContextProcessor, conn *tServerConn, frame []byte) ([]byte, bool, error) {
+	in := NewTMemoryBuffer()
+	in.Write(frame)
+	out := NewTMemoryBuffer()
+	inputProtocol, outputProtocol := newTServerProtocols(p.inputProtocolFactory.GetProtocol(in), p.outputProtocolFactory.GetProtocol(out), conn, false)
+	ok, err := p.processCall(ctx, processor, inputProtocol, outputProtocol)
+	if inputProtocol.call.begun {
+		var written int64
+		if out.Len() > 0 {
+			written = int64(out.Len()) + 4
+		}
+		p.finishCall(inputProtocol.call, int64(len(frame))+4, written, err)
+	}
+	return out.Bytes(), ok, err
+}
+
+func (p *TPipelinedServer) readFrame(conn TTransport) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, NewTTransportExceptionFromError(err)
+	}
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if size > int64(p.maxFrameSize) {
+		return nil, NewTTransportException(UNKNOWN_TRANSPORT_EXCEPTION, fmt.Sprintf("Frame size %d exceeds limit of %d", size, p.maxFrameSize))
+	}
+	// Grow the buffer as the body arrives rather than trusting the header.
+	var frame bytes.Buffer
+	if _, err := io.CopyN(&frame, conn, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, NewTTransportExceptionFromError(err)
+	}
+	return frame.Bytes(), nil
+}
+
+func writeFrame(trans TTransport, frame []byte) error {
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+	if _, err := trans.Write(buf); err != nil {
+		return NewTTransportExceptionFromError(err)
+	}
+	return NewTTransportExceptionFromError(trans.Flush())
+}
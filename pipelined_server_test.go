@@ -0,0 +1,125 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipelinedServerOutOfOrderReplies(t *testing.T) {
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTPipelinedServer2(&sleepProcessor{}, serverSocket)
+	server.SetMaxInFlight(4)
+	done := startServing(t, server, serverSocket)
+
+	socket, err := NewTSocketTimeout(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create client socket: %s", err)
+	}
+	if err := socket.Open(); err != nil {
+		t.Fatalf("Unable to connect to %s: %s", addr, err)
+	}
+	client := NewTBinaryProtocolTransport(NewTFramedTransport(socket))
+	defer client.Transport().Close()
+
+	if err := sendTestCall(client, "slow", 1, 200); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	if err := sendTestCall(client, "fast", 2, 0); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	for _, expected := range []int32{2, 1} {
+		_, _, seqId, err := readTestReply(client)
+		if err != nil {
+			t.Fatalf("Unable to read reply: %s", err)
+		}
+		if seqId != expected {
+			t.Errorf("Expected reply for seqid %d, got %d", expected, seqId)
+		}
+	}
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestPipelinedServerInFlightLimit(t *testing.T) {
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTPipelinedServer2(&sleepProcessor{}, serverSocket)
+	server.SetMaxInFlight(1)
+	done := startServing(t, server, serverSocket)
+
+	socket, err := NewTSocketTimeout(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create client socket: %s", err)
+	}
+	if err := socket.Open(); err != nil {
+		t.Fatalf("Unable to connect to %s: %s", addr, err)
+	}
+	client := NewTBinaryProtocolTransport(NewTFramedTransport(socket))
+	defer client.Transport().Close()
+
+	sendTestCall(client, "slow", 1, 100)
+	sendTestCall(client, "fast", 2, 0)
+	for _, expected := range []int32{1, 2} {
+		_, _, seqId, err := readTestReply(client)
+		if err != nil {
+			t.Fatalf("Unable to read reply: %s", err)
+		}
+		if seqId != expected {
+			t.Errorf("Expected reply for seqid %d, got %d", expected, seqId)
+		}
+	}
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestPipelinedServerHalfClose(t *testing.T) {
+	processor := newContextProcessor()
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTPipelinedServer2(NewTProcessorFromContext(processor), serverSocket)
+	done := startServing(t, server, serverSocket)
+
+	socket, err := NewTSocketTimeout(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create client socket: %s", err)
+	}
+	if err := socket.Open(); err != nil {
+		t.Fatalf("Unable to connect to %s: %s", addr, err)
+	}
+	client := NewTBinaryProtocolTransport(NewTFramedTransport(socket))
+	defer client.Transport().Close()
+
+	if err := sendTestCall(client, "wait", 1, 0); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	<-processor.calls
+	if err := socket.Conn().(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Unable to half-close: %s", err)
+	}
+	if <-processor.cancelled {
+		t.Errorf("Expected the call to outlive a half-close")
+	}
+	if _, _, seqId, err := readTestReply(client); err != nil || seqId != 1 {
+		t.Errorf("Expected the reply for seqid 1, got %d: %v", seqId, err)
+	}
+	server.Stop()
+	waitServe(t, done)
+}
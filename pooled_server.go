@@ -0,0 +1,231 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"sync"
+	"time"
+)
+
+// What a TPooledServer does with a new connection when all workers are busy
+// and the accept queue is full.
+type TPoolOverflowPolicy int
+
+const (
+	// Stop accepting until a slot frees up, leaving further connections in
+	// the listen backlog.
+	POOL_OVERFLOW_BLOCK TPoolOverflowPolicy = iota
+	// Close the connection straight away.
+	POOL_OVERFLOW_CLOSE
+	// Read the first call and reply with an OVERLOADED
+	// TApplicationException before closing the connection.
+	POOL_OVERFLOW_EXCEPTION
+)
+
+const (
+	DEFAULT_POOL_MAX_CONNECTIONS = 100
+	DEFAULT_POOL_QUEUE_SIZE      = 100
+
+	// Upper bound on connections being rejected with an exception at the
+	// same time; beyond it, connections are simply closed.
+	maxPoolRejections = 16
+	// Time allowed for reading the call and writing the exception when
+	// rejecting a connection.
+	poolRejectTimeout = time.Second
+)
+
+// Server that serves connections with a fixed number of worker goroutines.
+// Connections that arrive while all workers are busy wait in a bounded
+// accept queue; once that is full, the overflow policy applies.
+type TPooledServer struct {
+	*TSimpleServer
+
+	maxConnections int
+	queueSize      int
+	overflowPolicy TPoolOverflowPolicy
+	rejections     chan struct{}
+}
+
+func NewTPooledServer2(processor TProcessor, serverTransport TServerTransport) *TPooledServer {
+	return NewTPooledServerFactory2(NewTProcessorFactory(processor), serverTransport)
+}
+
+func NewTPooledServer4(processor TProcessor, serverTransport TServerTransport, transportFactory TTransportFactory, protocolFactory TProtocolFactory) *TPooledServer {
+	return NewTPooledServerFactory4(NewTProcessorFactory(processor),
+		serverTransport,
+		transportFactory,
+		protocolFactory,
+	)
+}
+
+func NewTPooledServer6(processor TProcessor, serverTransport TServerTransport, inputTransportFactory TTransportFactory, outputTransportFactory TTransportFactory, inputProtocolFactory TProtocolFactory, outputProtocolFactory TProtocolFactory) *TPooledServer {
+	return NewTPooledServerFactory6(NewTProcessorFactory(processor),
+		serverTransport,
+		inputTransportFactory,
+		outputTransportFactory,
+		inputProtocolFactory,
+		outputProtocolFactory,
+	)
+}
+
+func NewTPooledServerFactory2(processorFactory TProcessorFactory, serverTransport TServerTransport) *TPooledServer {
+	return NewTPooledServerFactory6(processorFactory,
+		serverTransport,
+		NewTTransportFactory(),
+		NewTTransportFactory(),
+		NewTBinaryProtocolFactoryDefault(),
+		NewTBinaryProtocolFactoryDefault(),
+	)
+}
+
+func NewTPooledServerFactory4(processorFactory TProcessorFactory, serverTransport TServerTransport, transportFactory TTransportFactory, protocolFactory TProtocolFactory) *TPooledServer {
+	return NewTPooledServerFactory6(processorFactory,
+		serverTransport,
+		transportFactory,
+		transportFactory,
+		protocolFactory,
+		protocolFactory,
+	)
+}
+
+func NewTPooledServerFactory6(processorFactory TProcessorFactory, serverTransport TServerTransport, inputTransportFactory TTransportFactory, outputTransportFactory TTransportFactory, inputProtocolFactory TProtocolFactory, outputProtocolFactory TProtocolFactory) *TPooledServer {
+	return &TPooledServer{
+		TSimpleServer: NewTSimpleServerFactory6(processorFactory,
+			serverTransport,
+			inputTransportFactory,
+			outputTransportFactory,
+			inputProtocolFactory,
+			outputProtocolFactory,
+		),
+		maxConnections: DEFAULT_POOL_MAX_CONNECTIONS,
+		queueSize:      DEFAULT_POOL_QUEUE_SIZE,
+		overflowPolicy: POOL_OVERFLOW_BLOCK,
+		rejections:     make(chan struct{}, maxPoolRejections),
+	}
+}
+
+// Sets the number of connections served concurrently. Must be called
+// before Serve.
+func (p *TPooledServer) SetMaxConnections(n int) {
+	p.maxConnections = n
+}
+
+// Sets how many accepted connections may wait for a free worker. Must be
+// called before Serve.
+func (p *TPooledServer) SetQueueSize(n int) {
+	p.queueSize = n
+}
+
+// Sets what happens to connections arriving when the server is saturated.
+// Must be called before Serve.
+func (p *TPooledServer) SetOverflowPolicy(policy TPoolOverflowPolicy) {
+	p.overflowPolicy = policy
+}
+
+func (p *TPooledServer) MaxConnections() int {
+	return p.maxConnections
+}
+
+func (p *TPooledServer) QueueSize() int {
+	return p.queueSize
+}
+
+func (p *TPooledServer) OverflowPolicy() TPoolOverflowPolicy {
+	return p.overflowPolicy
+}
+
+// Serve accepts connections until the server is stopped, then waits for
+// the remaining connections to finish before returning.
+func (p *TPooledServer) Serve() error {
+	workers := p.maxConnections
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan *tServerConn, p.queueSize)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for conn := range queue {
+				p.handleConn(conn)
+			}
+		}()
+	}
+	err := p.serve(func(conn *tServerConn) {
+		p.dispatch(queue, conn)
+	})
+	close(queue)
+	wg.Wait()
+	return err
+}
+
+func (p *TPooledServer) dispatch(queue chan *tServerConn, conn *tServerConn) {
+	if p.overflowPolicy == POOL_OVERFLOW_BLOCK {
+		select {
+		case queue <- conn:
+		case <-p.quitChan():
+			p.rejectConn(conn)
+		}
+		return
+	}
+	select {
+	case queue <- conn:
+		return
+	default:
+	}
+	if p.overflowPolicy == POOL_OVERFLOW_EXCEPTION {
+		select {
+		case p.rejections <- struct{}{}:
+			go func() {
+				defer func() { <-p.rejections }()
+				p.rejectWithException(conn)
+			}()
+			return
+		default:
+		}
+	}
+	p.rejectConn(conn)
+}
+
+// rejectWithException answers the first call on conn with an OVERLOADED
+// TApplicationException and closes it.
+func (p *TPooledServer) rejectWithException(conn *tServerConn) {
+	defer p.rejectConn(conn)
+	if s, ok := conn.TTransport.(interface {
+		SetTimeout(time.Duration) error
+	}); ok {
+		s.SetTimeout(poolRejectTimeout)
+	}
+	inputProtocol := p.inputProtocolFactory.GetProtocol(p.inputTransportFactory.GetTransport(conn))
+	outputProtocol := p.outputProtocolFactory.GetProtocol(p.outputTransportFactory.GetTransport(conn))
+	name, typeId, seqId, err := inputProtocol.ReadMessageBegin()
+	if err != nil {
+		return
+	}
+	if err := inputProtocol.Skip(STRUCT); err != nil {
+		return
+	}
+	if err := inputProtocol.ReadMessageEnd(); err != nil || typeId == ONEWAY {
+		return
+	}
+	exc := NewTApplicationException(OVERLOADED, "Server is at its connection limit")
+	writeApplicationException(outputProtocol, name, seqId, exc)
+}
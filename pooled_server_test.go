@@ -0,0 +1,104 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"testing"
+	"time"
+)
+
+func startTestPooledServer(t *testing.T, policy TPoolOverflowPolicy, queueSize int) (*TPooledServer, string, chan error) {
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTPooledServer2(&sleepProcessor{}, serverSocket)
+	server.SetMaxConnections(1)
+	server.SetQueueSize(queueSize)
+	server.SetOverflowPolicy(policy)
+	return server, addr, startServing(t, server, serverSocket)
+}
+
+func TestPooledServerOverflowException(t *testing.T) {
+	server, addr, done := startTestPooledServer(t, POOL_OVERFLOW_EXCEPTION, 0)
+	busy := openTestClient(t, addr)
+	defer busy.Transport().Close()
+	if err := sendTestCall(busy, "test", 1, 300); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	rejected := openTestClient(t, addr)
+	defer rejected.Transport().Close()
+	err := callTestServer(rejected, "test", 7, 0)
+	if e, ok := err.(TApplicationException); !ok || e.TypeId() != OVERLOADED {
+		t.Errorf("Expected OVERLOADED application exception, got %v", err)
+	}
+	if _, _, _, err := readTestReply(busy); err != nil {
+		t.Errorf("Call in progress failed: %s", err)
+	}
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestPooledServerOverflowClose(t *testing.T) {
+	server, addr, done := startTestPooledServer(t, POOL_OVERFLOW_CLOSE, 0)
+	busy := openTestClient(t, addr)
+	defer busy.Transport().Close()
+	if err := sendTestCall(busy, "test", 1, 300); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	rejected := openTestClient(t, addr)
+	defer rejected.Transport().Close()
+	if err := callTestServer(rejected, "test", 1, 0); err == nil {
+		t.Errorf("Expected connection beyond the limit to be closed")
+	}
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestPooledServerOverflowBlock(t *testing.T) {
+	server, addr, done := startTestPooledServer(t, POOL_OVERFLOW_BLOCK, 1)
+	busy := openTestClient(t, addr)
+	if err := sendTestCall(busy, "test", 1, 100); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	queued := openTestClient(t, addr)
+	defer queued.Transport().Close()
+	start := time.Now()
+	// The first connection must be closed for its worker to pick up the
+	// queued one.
+	closed := make(chan struct{})
+	go func() {
+		readTestReply(busy)
+		busy.Transport().Close()
+		close(closed)
+	}()
+	if err := callTestServer(queued, "test", 1, 0); err != nil {
+		t.Errorf("Queued call failed: %s", err)
+	}
+	<-closed
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Queued call was served before a worker was free")
+	}
+	server.Stop()
+	waitServe(t, done)
+}
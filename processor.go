@@ -19,6 +19,10 @@
 
 package thrift
 
+import (
+	"context"
+)
+
 // A processor is a generic object which operates upon an input stream and
 // writes to some output stream.
 type TProcessor interface {
@@ -28,3 +32,94 @@ type TProcessor interface {
 type TProcessorFunction interface {
 	Process(seqId int32, in, out TProtocol) (bool, TException)
 }
+
+// A processor that also receives a context.Context, carrying the call's
+// deadline and cancellation as well as the details of the connection it
+// arrived on (see ConnectionInfoFromContext).
+type TContextProcessor interface {
+	Process(ctx context.Context, in, out TProtocol) (bool, TException)
+}
+
+type TContextProcessorFunction interface {
+	Process(ctx context.Context, seqId int32, in, out TProtocol) (bool, TException)
+}
+
+// Adapts a TProcessor to TContextProcessor. The context is ignored unless
+// the processor is context-aware itself, like processors adapted with
+// NewTProcessorFromContext and TBaseProcessor.
+func NewTContextProcessor(p TProcessor) TContextProcessor {
+	if a, ok := p.(tContextAware); ok {
+		return a.contextProcessor()
+	}
+	return &tContextProcessor{processor: p}
+}
+
+// Implemented by processors that can make use of a context.
+type tContextAware interface {
+	contextProcessor() TContextProcessor
+}
+
+// Adapts a TContextProcessor to TProcessor, so it can be used wherever a
+// TProcessor is expected. Servers recognise the adapter and pass their own
+// context to the wrapped processor; other callers get context.Background().
+func NewTProcessorFromContext(p TContextProcessor) TProcessor {
+	if a, ok := p.(*tContextProcessor); ok {
+		return a.processor
+	}
+	return &tProcessorFromContext{processor: p}
+}
+
+// Adapts a TProcessorFunction to TContextProcessorFunction; the context is
+// ignored.
+func NewTContextProcessorFunction(f TProcessorFunction) TContextProcessorFunction {
+	if a, ok := f.(*tProcessorFunctionFromContext); ok {
+		return a.function
+	}
+	return &tContextProcessorFunction{function: f}
+}
+
+// Adapts a TContextProcessorFunction to TProcessorFunction. Callers that
+// recognise the adapter pass their own context to the wrapped function;
+// others get context.Background().
+func NewTProcessorFunctionFromContext(f TContextProcessorFunction) TProcessorFunction {
+	if a, ok := f.(*tContextProcessorFunction); ok {
+		return a.function
+	}
+	return &tProcessorFunctionFromContext{function: f}
+}
+
+type tContextProcessor struct {
+	processor TProcessor
+}
+
+func (p *tContextProcessor) Process(ctx context.Context, in, out TProtocol) (bool, TException) {
+	return p.processor.Process(in, out)
+}
+
+type tProcessorFromContext struct {
+	processor TContextProcessor
+}
+
+func (p *tProcessorFromContext) Process(in, out TProtocol) (bool, TException) {
+	return p.processor.Process(context.Background(), in, out)
+}
+
+func (p *tProcessorFromContext) contextProcessor() TContextProcessor {
+	return p.processor
+}
+
+type tContextProcessorFunction struct {
+	function TProcessorFunction
+}
+
+func (p *tContextProcessorFunction) Process(ctx context.Context, seqId int32, in, out TProtocol) (bool, TException) {
+	return p.function.Process(seqId, in, out)
+}
+
+type tProcessorFunctionFromContext struct {
+	function TContextProcessorFunction
+}
+
+func (p *tProcessorFunctionFromContext) Process(seqId int32, in, out TProtocol) (bool, TException) {
+	return p.function.Process(context.Background(), seqId, in, out)
+}
@@ -0,0 +1,168 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"time"
+)
+
+// A call passing through a middleware chain. When a middleware runs, the
+// message header has been read already and the input protocol is
+// positioned at the call's arguments.
+type TCall struct {
+	Name   string
+	SeqId  int32
+	TypeId TMessageType
+	// When the call entered the chain.
+	Start time.Time
+	// The type of the reply written so far: REPLY, EXCEPTION, or
+	// INVALID_TMESSAGE_TYPE if nothing has been written, as for oneway
+	// calls.
+	ReplyType TMessageType
+	// The exception the call was rejected with by RejectCall, if any.
+	Rejection TApplicationException
+}
+
+// Processes a call whose header has been read.
+type TCallHandler func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException)
+
+// A middleware wraps a TCallHandler, for example to log, measure or
+// authorize calls. It may also answer a call itself without calling next,
+// using RejectCall.
+type TMiddleware func(next TCallHandler) TCallHandler
+
+// RejectCall answers call with exc instead of processing it: the arguments
+// are skipped and, unless the call is oneway, exc is sent as the reply. The
+// connection is kept open.
+func RejectCall(call *TCall, in, out TProtocol, exc TApplicationException) (bool, TException) {
+	call.Rejection = exc
+	if err := in.Skip(STRUCT); err != nil {
+		return false, err
+	}
+	if err := in.ReadMessageEnd(); err != nil {
+		return false, err
+	}
+	if call.TypeId == ONEWAY {
+		return true, nil
+	}
+	if err := writeApplicationException(out, call.Name, call.SeqId, exc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WrapProcessor returns a processor running every call through the given
+// middleware before handing it to processor. The first middleware is the
+// outermost, so it sees the call first and the result last. The returned
+// processor passes the server's context on to middleware and, if it is
+// context-aware, to processor.
+func WrapProcessor(processor TProcessor, middleware ...TMiddleware) TProcessor {
+	contextProcessor := NewTContextProcessor(processor)
+	handler := chainMiddleware(func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+		// Let the processor read the header again.
+		in = &tMessageHeaderProtocol{TProtocol: in, name: call.Name, typeId: call.TypeId, seqId: call.SeqId}
+		return contextProcessor.Process(ctx, in, out)
+	}, middleware)
+	return NewTProcessorFromContext(&tMiddlewareProcessor{handler: handler})
+}
+
+// WrapProcessorFunction returns a processor function running every call
+// through the given middleware before handing it to function. name is the
+// method function handles. Processors dispatching to the result with
+// NewTContextProcessorFunction pass their context on. The call's TypeId is
+// the message type read by TBaseProcessor; with other processors it is CALL.
+func WrapProcessorFunction(name string, function TProcessorFunction, middleware ...TMiddleware) TProcessorFunction {
+	contextFunction := NewTContextProcessorFunction(function)
+	handler := chainMiddleware(func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+		return contextFunction.Process(ctx, call.SeqId, in, out)
+	}, middleware)
+	return NewTProcessorFunctionFromContext(&tMiddlewareFunction{name: name, handler: handler})
+}
+
+func chainMiddleware(handler TCallHandler, middleware []TMiddleware) TCallHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+type tMiddlewareProcessor struct {
+	handler TCallHandler
+}
+
+func (p *tMiddlewareProcessor) Process(ctx context.Context, in, out TProtocol) (bool, TException) {
+	name, typeId, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	call := &TCall{Name: name, SeqId: seqId, TypeId: typeId, Start: time.Now()}
+	return p.handler(ctx, call, in, &tReplyRecordingProtocol{TProtocol: out, call: call})
+}
+
+type tMiddlewareFunction struct {
+	name    string
+	handler TCallHandler
+}
+
+func (p *tMiddlewareFunction) Process(ctx context.Context, seqId int32, in, out TProtocol) (bool, TException) {
+	typeId := CALL
+	if header, ok := in.(*tMessageHeaderProtocol); ok {
+		typeId = header.typeId
+	}
+	call := &TCall{Name: p.name, SeqId: seqId, TypeId: typeId, Start: time.Now()}
+	return p.handler(ctx, call, in, &tReplyRecordingProtocol{TProtocol: out, call: call})
+}
+
+// Replays a message header that has already been read.
+type tMessageHeaderProtocol struct {
+	TProtocol
+	name     string
+	typeId   TMessageType
+	seqId    int32
+	replayed bool
+}
+
+func (p *tMessageHeaderProtocol) ReadMessageBegin() (string, TMessageType, int32, error) {
+	if p.replayed {
+		return p.TProtocol.ReadMessageBegin()
+	}
+	p.replayed = true
+	return p.name, p.typeId, p.seqId, nil
+}
+
+func (p *tMessageHeaderProtocol) wrappedProtocol() TProtocol {
+	return p.TProtocol
+}
+
+// Records the type of the reply written for a call.
+type tReplyRecordingProtocol struct {
+	TProtocol
+	call *TCall
+}
+
+func (p *tReplyRecordingProtocol) WriteMessageBegin(name string, typeId TMessageType, seqId int32) error {
+	p.call.ReplyType = typeId
+	return p.TProtocol.WriteMessageBegin(name, typeId, seqId)
+}
+
+func (p *tReplyRecordingProtocol) wrappedProtocol() TProtocol {
+	return p.TProtocol
+}
@@ -0,0 +1,214 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type middlewareLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (p *middlewareLog) add(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = append(p.entries, fmt.Sprintf(format, args...))
+}
+
+func (p *middlewareLog) get() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.entries...)
+}
+
+func loggingMiddleware(log *middlewareLog, tag string) TMiddleware {
+	return func(next TCallHandler) TCallHandler {
+		return func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+			log.add("%s>%s:%d", tag, call.Name, call.SeqId)
+			ok, err := next(ctx, call, in, out)
+			log.add("%s<%s:%d:%d:%v", tag, call.Name, call.SeqId, call.ReplyType, call.Rejection != nil)
+			return ok, err
+		}
+	}
+}
+
+func denyingMiddleware(method string) TMiddleware {
+	return func(next TCallHandler) TCallHandler {
+		return func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+			if call.Name == method {
+				return RejectCall(call, in, out, NewTApplicationException(UNKNOWN_APPLICATION_EXCEPTION, "denied"))
+			}
+			return next(ctx, call, in, out)
+		}
+	}
+}
+
+func TestMiddlewareWithServer(t *testing.T) {
+	log := &middlewareLog{}
+	processor := WrapProcessor(&sleepProcessor{},
+		loggingMiddleware(log, "a"),
+		loggingMiddleware(log, "b"),
+		denyingMiddleware("forbidden"),
+	)
+	server, addr, done := startTestServer(t, processor)
+	client := openTestClient(t, addr)
+	defer client.Transport().Close()
+
+	if err := callTestServer(client, "allowed", 1, 0); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	err := callTestServer(client, "forbidden", 2, 0)
+	if e, ok := err.(TApplicationException); !ok || e.Error() != "denied" {
+		t.Fatalf("Expected call to be denied, got %v", err)
+	}
+	if err := callTestServer(client, "allowed", 3, 0); err != nil {
+		t.Fatalf("Call after denied call failed: %s", err)
+	}
+	server.Stop()
+	waitServe(t, done)
+
+	expected := []string{
+		"a>allowed:1", "b>allowed:1", "b<allowed:1:2:false", "a<allowed:1:2:false",
+		"a>forbidden:2", "b>forbidden:2", "b<forbidden:2:3:true", "a<forbidden:2:3:true",
+		"a>allowed:3", "b>allowed:3", "b<allowed:3:2:false", "a<allowed:3:2:false",
+	}
+	if entries := log.get(); fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected middleware order:\n got %v\nwant %v", entries, expected)
+	}
+}
+
+func TestMiddlewareWithHttpHandler(t *testing.T) {
+	log := &middlewareLog{}
+	processor := WrapProcessor(&sleepProcessor{}, loggingMiddleware(log, "a"))
+	pf := NewTBinaryProtocolFactoryDefault()
+	server := httptest.NewServer(http.HandlerFunc(NewThriftHandlerFunc(processor, pf, pf)))
+	defer server.Close()
+	trans, err := NewTHttpPostClient(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to create http client: %s", err)
+	}
+	if err := callTestServer(pf.GetProtocol(trans), "test", 5, 0); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	expected := []string{"a>test:5", "a<test:5:2:false"}
+	if entries := log.get(); fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected middleware log: got %v, want %v", entries, expected)
+	}
+}
+
+func TestWrapProcessorFunction(t *testing.T) {
+	log := &middlewareLog{}
+	f := WrapProcessorFunction("echo", &emptyReplyFunction{}, loggingMiddleware(log, "a"))
+	in := NewTMemoryBuffer()
+	out := NewTMemoryBuffer()
+	pf := NewTBinaryProtocolFactoryDefault()
+	sendTestCall(pf.GetProtocol(in), "echo", 9, 0)
+	prot := pf.GetProtocol(in)
+	prot.ReadMessageBegin()
+	if ok, err := f.Process(9, prot, pf.GetProtocol(out)); !ok || err != nil {
+		t.Fatalf("Processor function failed: %v %v", ok, err)
+	}
+	expected := []string{"a>echo:9", "a<echo:9:2:false"}
+	if entries := log.get(); fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected middleware log: got %v, want %v", entries, expected)
+	}
+}
+
+func newDenyingBaseProcessor() *TBaseProcessor {
+	processor := NewTBaseProcessor()
+	processor.AddToProcessorMap("echo", WrapProcessorFunction("echo", &emptyReplyFunction{}, denyingMiddleware("echo")))
+	return processor
+}
+
+func TestWrapProcessorFunctionRejectsOneway(t *testing.T) {
+	server, addr, done := startTestServer(t, newDenyingBaseProcessor())
+	client := openTestClient(t, addr)
+	defer client.Transport().Close()
+
+	client.WriteMessageBegin("echo", ONEWAY, 1)
+	client.WriteStructBegin("args")
+	client.WriteFieldStop()
+	client.WriteStructEnd()
+	client.WriteMessageEnd()
+	if err := client.Flush(); err != nil {
+		t.Fatalf("Unable to send oneway call: %s", err)
+	}
+	// The rejected oneway call gets no reply, so the next reply read is
+	// that of the following call.
+	if err := sendTestCall(client, "echo", 2, 0); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	_, typeId, seqId, err := readTestReply(client)
+	if typeId != EXCEPTION || seqId != 2 {
+		t.Errorf("Expected the call with seqid 2 rejected, got type %d seqid %d: %v", typeId, seqId, err)
+	}
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestWrapProcessorFunctionRejectsOnewayOverHttp(t *testing.T) {
+	pf := NewTBinaryProtocolFactoryDefault()
+	server := httptest.NewServer(http.HandlerFunc(NewThriftHandlerFunc(newDenyingBaseProcessor(), pf, pf)))
+	defer server.Close()
+
+	body := NewTMemoryBuffer()
+	prot := pf.GetProtocol(body)
+	prot.WriteMessageBegin("echo", ONEWAY, 1)
+	prot.WriteStructBegin("args")
+	prot.WriteFieldStop()
+	prot.WriteStructEnd()
+	prot.WriteMessageEnd()
+	resp, err := http.Post(server.URL, "application/x-thrift", body)
+	if err != nil {
+		t.Fatalf("Unable to send oneway call: %s", err)
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unable to read response: %s", err)
+	}
+	if len(reply) != 0 {
+		t.Errorf("Expected no reply to a rejected oneway call, got %d bytes", len(reply))
+	}
+}
+
+// A processor function answering with an empty reply.
+type emptyReplyFunction struct{}
+
+func (p *emptyReplyFunction) Process(seqId int32, in, out TProtocol) (bool, TException) {
+	if err := in.Skip(STRUCT); err != nil {
+		return false, err
+	}
+	in.ReadMessageEnd()
+	out.WriteMessageBegin("echo", REPLY, seqId)
+	out.WriteStructBegin("result")
+	out.WriteFieldStop()
+	out.WriteStructEnd()
+	out.WriteMessageEnd()
+	return true, out.Flush()
+}
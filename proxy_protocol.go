@@ -0,0 +1,342 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a client may take to send its PROXY protocol header, unless
+// configured otherwise.
+const DEFAULT_PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+// Types of PROXY protocol v2 TLVs.
+const (
+	PROXY_TLV_ALPN      = 0x01
+	PROXY_TLV_AUTHORITY = 0x02
+	PROXY_TLV_CRC32C    = 0x03
+	PROXY_TLV_NOOP      = 0x04
+	PROXY_TLV_UNIQUE_ID = 0x05
+	PROXY_TLV_SSL       = 0x20
+	PROXY_TLV_NETNS     = 0x30
+)
+
+// The signature starting a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Settings for accepting connections through a proxy or load balancer
+// speaking the PROXY protocol.
+type TProxyProtocolConfig struct {
+	// The networks of the proxies allowed to send a header. Connections
+	// from elsewhere are used as they are, and a header they send is
+	// treated as data. If empty, no source is trusted.
+	TrustedSources []*net.IPNet
+	// How long a trusted source may take to send the header, or
+	// DEFAULT_PROXY_HEADER_TIMEOUT if zero.
+	HeaderTimeout time.Duration
+	// Whether trusted sources may omit the header, as in health checks.
+	Optional bool
+}
+
+func (p *TProxyProtocolConfig) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range p.TrustedSources {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// A PROXY protocol v2 TLV.
+type TProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// The PROXY protocol header a connection began with.
+type TProxyHeader struct {
+	// 1 or 2.
+	Version int
+	// Whether the proxy relays a client, rather than connecting on its own
+	// behalf, as for health checks, in which case there are no addresses.
+	Proxied bool
+	// The addresses of the client and of the server it connected to.
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	TLVs       []TProxyTLV
+}
+
+// Returns the value of the first TLV of type typ.
+func (p *TProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range p.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the PROXY protocol header of the connection underneath an
+// accepted transport, if it began with one.
+func ProxyHeaderOf(trans TTransport) (*TProxyHeader, bool) {
+	if c := proxyConnOf(netConnOf(trans)); c != nil {
+		c.init()
+		return c.header, c.header != nil
+	}
+	return nil, false
+}
+
+// proxyConnOf returns the connection reading the PROXY protocol header
+// underneath conn, if any.
+func proxyConnOf(conn net.Conn) *tProxyConn {
+	if c, ok := conn.(interface {
+		NetConn() net.Conn
+	}); ok {
+		conn = c.NetConn()
+	}
+	c, _ := conn.(*tProxyConn)
+	return c
+}
+
+// A listener reading the PROXY protocol header of each connection.
+type tProxyListener struct {
+	net.Listener
+	cfg *TProxyProtocolConfig
+}
+
+func (p *tProxyListener) Accept() (net.Conn, error) {
+	conn, err := p.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newTProxyConn(conn, p.cfg), nil
+}
+
+// tProxyConn reads the PROXY protocol header of a connection on first use,
+// so as not to hold up the accepting goroutine, and then reports the
+// addresses it carries.
+type tProxyConn struct {
+	net.Conn
+	cfg    *TProxyProtocolConfig
+	once   sync.Once
+	reader *bufio.Reader
+	header *TProxyHeader
+	err    error
+}
+
+func newTProxyConn(conn net.Conn, cfg *TProxyProtocolConfig) *tProxyConn {
+	return &tProxyConn{Conn: conn, cfg: cfg}
+}
+
+func (p *tProxyConn) init() {
+	p.once.Do(func() {
+		p.reader = bufio.NewReader(p.Conn)
+		if !p.cfg.trusts(p.Conn.RemoteAddr()) {
+			return
+		}
+		timeout := p.cfg.HeaderTimeout
+		if timeout <= 0 {
+			timeout = DEFAULT_PROXY_HEADER_TIMEOUT
+		}
+		p.Conn.SetReadDeadline(time.Now().Add(timeout))
+		p.header, p.err = readProxyHeader(p.reader, p.cfg.Optional)
+		p.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (p *tProxyConn) Read(b []byte) (int, error) {
+	p.init()
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.reader.Read(b)
+}
+
+func (p *tProxyConn) RemoteAddr() net.Addr {
+	p.init()
+	if p.header != nil && p.header.SourceAddr != nil {
+		return p.header.SourceAddr
+	}
+	return p.Conn.RemoteAddr()
+}
+
+func (p *tProxyConn) LocalAddr() net.Addr {
+	p.init()
+	if p.header != nil && p.header.DestAddr != nil {
+		return p.header.DestAddr
+	}
+	return p.Conn.LocalAddr()
+}
+
+// Returns the address of the proxy the connection came through.
+func (p *tProxyConn) ProxyAddr() net.Addr {
+	return p.Conn.RemoteAddr()
+}
+
+// peerAddr returns the address at the other end of conn without waiting
+// for the PROXY protocol header conn may begin with, which is left to the
+// goroutine serving the connection.
+func peerAddr(conn net.Conn) net.Addr {
+	if c := proxyConnOf(conn); c != nil {
+		return c.ProxyAddr()
+	}
+	return conn.RemoteAddr()
+}
+
+var errMissingProxyHeader = errors.New("PROXY protocol header missing")
+
+func proxyHeaderError(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid PROXY protocol header: "+format, args...)
+}
+
+// readProxyHeader reads a v1 or v2 header from r. If optional, a
+// connection starting with neither yields no header and no error.
+func readProxyHeader(r *bufio.Reader, optional bool) (*TProxyHeader, error) {
+	if prefix, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+		return readProxyHeaderV1(r)
+	} else if err != nil && (!optional || r.Buffered() == 0) {
+		return nil, err
+	}
+	if optional {
+		return nil, nil
+	}
+	return nil, errMissingProxyHeader
+}
+
+// The longest v1 header, including its CRLF.
+const maxProxyHeaderV1 = 107
+
+func readProxyHeaderV1(r *bufio.Reader) (*TProxyHeader, error) {
+	var line []byte
+	for len(line) < maxProxyHeaderV1 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, proxyHeaderError("v1 line not terminated")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &TProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, proxyHeaderError("%q", line)
+	}
+	src, err1 := parseProxyAddrV1(fields[2], fields[4], fields[1] == "TCP4")
+	dst, err2 := parseProxyAddrV1(fields[3], fields[5], fields[1] == "TCP4")
+	if err1 != nil || err2 != nil {
+		return nil, proxyHeaderError("%q", line)
+	}
+	header.Proxied = true
+	header.SourceAddr, header.DestAddr = src, dst
+	return header, nil
+}
+
+func parseProxyAddrV1(ip, port string, v4 bool) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (addr.To4() != nil) != v4 {
+		return nil, errors.New("bad address")
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || port != strconv.FormatUint(n, 10) {
+		return nil, errors.New("bad port")
+	}
+	return &net.TCPAddr{IP: addr, Port: int(n)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*TProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, proxyHeaderError("version %d", fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0f
+	if command > 1 {
+		return nil, proxyHeaderError("command %d", command)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	header := &TProxyHeader{Version: 2, Proxied: command == 1}
+	family, protocol := fixed[13]>>4, fixed[13]&0x0f
+	var addrLen int
+	switch family {
+	case 1:
+		addrLen = 12
+	case 2:
+		addrLen = 36
+	case 3:
+		addrLen = 216
+	}
+	if len(payload) < addrLen {
+		return nil, proxyHeaderError("address block of %d bytes", len(payload))
+	}
+	// Addresses other than TCP over IP are skipped, along with those of
+	// LOCAL connections, leaving the real ones in place.
+	if header.Proxied && protocol == 1 && (family == 1 || family == 2) {
+		ipLen := 4
+		if family == 2 {
+			ipLen = 16
+		}
+		a := payload[:addrLen]
+		header.SourceAddr = &net.TCPAddr{IP: net.IP(append([]byte(nil), a[:ipLen]...)), Port: int(binary.BigEndian.Uint16(a[2*ipLen:]))}
+		header.DestAddr = &net.TCPAddr{IP: net.IP(append([]byte(nil), a[ipLen:2*ipLen]...)), Port: int(binary.BigEndian.Uint16(a[2*ipLen+2:]))}
+	}
+	tlvs := payload[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, proxyHeaderError("truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, proxyHeaderError("truncated TLV")
+		}
+		header.TLVs = append(header.TLVs, TProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+	return header, nil
+}
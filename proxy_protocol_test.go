@@ -0,0 +1,314 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyHeaderV2 builds a v2 PROXY header relaying a TCP over IPv4
+// connection from src to dst, followed by tlvs.
+func proxyHeaderV2(src, dst *net.TCPAddr, tlvs ...TProxyTLV) []byte {
+	payload := append([]byte(nil), src.IP.To4()...)
+	payload = append(payload, dst.IP.To4()...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(src.Port))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(dst.Port))
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.Type)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x21, 0x11)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 4242}
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 9090}
+	local := append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0, 0)
+	tests := []struct {
+		input    string
+		optional bool
+		header   *TProxyHeader
+		fail     bool
+	}{
+		{input: "PROXY TCP4 203.0.113.7 10.0.0.1 4242 9090\r\ndata", header: &TProxyHeader{Version: 1, Proxied: true, SourceAddr: src, DestAddr: dst}},
+		{input: "PROXY TCP6 2001:db8::1 2001:db8::2 4242 9090\r\ndata", header: &TProxyHeader{Version: 1, Proxied: true,
+			SourceAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242}, DestAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 9090}}},
+		{input: "PROXY UNKNOWN\r\ndata", header: &TProxyHeader{Version: 1}},
+		{input: "PROXY TCP4 203.0.113.7 10.0.0.1 4242\r\ndata", fail: true},
+		{input: "PROXY TCP4 2001:db8::1 10.0.0.1 4242 9090\r\ndata", fail: true},
+		{input: "PROXY TCP4 203.0.113.7 10.0.0.1 4242 99999\r\ndata", fail: true},
+		{input: "PROXY TCP4 203.0.113.7 10.0.0.1 4242 9090" + strings.Repeat(" ", 100) + "\r\n", fail: true},
+		{input: string(proxyHeaderV2(src, dst, TProxyTLV{PROXY_TLV_AUTHORITY, []byte("example.org")}, TProxyTLV{PROXY_TLV_UNIQUE_ID, []byte{1, 2}})) + "data",
+			header: &TProxyHeader{Version: 2, Proxied: true, SourceAddr: src, DestAddr: dst,
+				TLVs: []TProxyTLV{{PROXY_TLV_AUTHORITY, []byte("example.org")}, {PROXY_TLV_UNIQUE_ID, []byte{1, 2}}}}},
+		{input: string(local) + "data", header: &TProxyHeader{Version: 2}},
+		{input: string(proxyHeaderV2(src, dst, TProxyTLV{PROXY_TLV_NOOP, nil}))[:30], fail: true},
+		{input: "data", fail: true},
+		{input: "data", optional: true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		header, err := readProxyHeader(r, test.optional)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unable to read %q: %v", test.input, err)
+			continue
+		}
+		if !proxyHeadersEqual(header, test.header) {
+			t.Errorf("Read %#v from %q, expected %#v", header, test.input, test.header)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "data" {
+			t.Errorf("Expected the data following %q to be left, got %q", test.input, rest)
+		}
+	}
+}
+
+func proxyHeadersEqual(a, b *TProxyHeader) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	addrString := func(addr net.Addr) string {
+		if addr == nil {
+			return ""
+		}
+		return addr.String()
+	}
+	if a.Version != b.Version || a.Proxied != b.Proxied || len(a.TLVs) != len(b.TLVs) ||
+		addrString(a.SourceAddr) != addrString(b.SourceAddr) || addrString(a.DestAddr) != addrString(b.DestAddr) {
+		return false
+	}
+	for i := range a.TLVs {
+		if a.TLVs[i].Type != b.TLVs[i].Type || string(a.TLVs[i].Value) != string(b.TLVs[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// loopbackProxyConfig returns settings trusting the proxies of local tests.
+func loopbackProxyConfig() *TProxyProtocolConfig {
+	_, v4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, v6, _ := net.ParseCIDR("::1/128")
+	return &TProxyProtocolConfig{TrustedSources: []*net.IPNet{v4, v6}}
+}
+
+func TestProxyProtocolConfigTrusts(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+	if (&TProxyProtocolConfig{}).trusts(local) {
+		t.Error("Expected no source trusted without trusted sources")
+	}
+	if !loopbackProxyConfig().trusts(local) {
+		t.Error("Expected a source in the trusted networks to be trusted")
+	}
+	if loopbackProxyConfig().trusts(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}) {
+		t.Error("Expected a source outside the trusted networks not to be trusted")
+	}
+}
+
+// dialProxied connects to addr and sends header ahead of anything else.
+func dialProxied(t *testing.T, addr string, header []byte) net.Conn {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("Unable to connect to %s: %v", addr, err)
+	}
+	if _, err := conn.Write(header); err != nil {
+		t.Fatalf("Unable to send PROXY header: %v", err)
+	}
+	return conn
+}
+
+func TestServerSocketProxyProtocol(t *testing.T) {
+	serverSocket, addr := newTestServerSocket(t)
+	cfg := loopbackProxyConfig()
+	cfg.HeaderTimeout = 200 * time.Millisecond
+	serverSocket.SetProxyProtocol(cfg)
+	processor := newContextProcessor()
+	server := NewTSimpleServer2(NewTProcessorFromContext(processor), serverSocket)
+	done := startServing(t, server, serverSocket)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+
+	conn := dialProxied(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 9090\r\n"))
+	client := NewTBinaryProtocolTransport(NewTSocketFromConnTimeout(conn, 2*time.Second))
+	defer client.Transport().Close()
+	if err := callTestServer(client, "test", 1, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	info, _ := ConnectionInfoFromContext(<-processor.calls)
+	if info.RemoteAddr.String() != "203.0.113.7:4242" || info.LocalAddr.String() != "10.0.0.1:9090" {
+		t.Errorf("Expected the addresses of the PROXY header, got %v and %v", info.RemoteAddr, info.LocalAddr)
+	}
+	if info.Proxy == nil || info.Proxy.Version != 1 {
+		t.Errorf("Expected the PROXY header in the connection info, got %#v", info.Proxy)
+	}
+
+	// A trusted source must send a header in time.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	expectClosed(t, NewTBinaryProtocolTransport(NewTSocketFromConnTimeout(conn, 2*time.Second)))
+	conn.Close()
+}
+
+func TestServerSocketProxyProtocolSilentClient(t *testing.T) {
+	serverSocket, addr := newTestServerSocket(t)
+	cfg := loopbackProxyConfig()
+	cfg.HeaderTimeout = 5 * time.Second
+	serverSocket.SetProxyProtocol(cfg)
+	server := NewTSimpleServer2(&sleepProcessor{}, serverSocket)
+	done := startServing(t, server, serverSocket)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+
+	// A client yet to send its header must not hold up the next one.
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	conn := dialProxied(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 9090\r\n"))
+	client := NewTBinaryProtocolTransport(NewTSocketFromConnTimeout(conn, time.Second))
+	defer client.Transport().Close()
+	if err := callTestServer(client, "test", 1, 0); err != nil {
+		t.Fatalf("Call behind a silent client failed: %v", err)
+	}
+}
+
+func TestSocketFromProxyConnDoesNotReadHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Unable to accept: %v", err)
+	}
+	defer conn.Close()
+
+	proxyConn := newTProxyConn(conn, loopbackProxyConfig())
+	created := make(chan struct{})
+	go func() {
+		NewTSocketFromConnTimeout(proxyConn, 0)
+		NewTSSLSocketFromConnTimeout(tls.Server(proxyConn, &tls.Config{}), &tls.Config{}, 0)
+		close(created)
+	}()
+	select {
+	case <-created:
+	case <-time.After(time.Second):
+		t.Fatal("Creating a socket waited for the PROXY header")
+	}
+}
+
+func TestServerSocketProxyProtocolUntrusted(t *testing.T) {
+	serverSocket, addr := newTestServerSocket(t)
+	_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+	serverSocket.SetProxyProtocol(&TProxyProtocolConfig{TrustedSources: []*net.IPNet{trusted}})
+	processor := newContextProcessor()
+	server := NewTSimpleServer2(NewTProcessorFromContext(processor), serverSocket)
+	done := startServing(t, server, serverSocket)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+
+	client := openTestClient(t, addr)
+	defer client.Transport().Close()
+	if err := callTestServer(client, "test", 1, 0); err != nil {
+		t.Fatalf("Call without a header from an untrusted source failed: %v", err)
+	}
+	info, _ := ConnectionInfoFromContext(<-processor.calls)
+	if !info.RemoteAddr.(*net.TCPAddr).IP.IsLoopback() || info.Proxy != nil {
+		t.Errorf("Expected the real address of the client, got %v and %#v", info.RemoteAddr, info.Proxy)
+	}
+
+	// A header from an untrusted source is not honoured.
+	conn := dialProxied(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 9090\r\n"))
+	spoofed := NewTBinaryProtocolTransport(NewTSocketFromConnTimeout(conn, 200*time.Millisecond))
+	defer spoofed.Transport().Close()
+	if err := callTestServer(spoofed, "test", 1, 0); err == nil {
+		t.Error("Expected a header from an untrusted source to be treated as data")
+	}
+}
+
+func TestSSLServerSocketProxyProtocol(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	addr, err := FindAvailableTCPServerPort(40000)
+	if err != nil {
+		t.Fatalf("Unable to find available tcp port addr: %s", err)
+	}
+	serverSocket, err := NewTSSLServerSocket(addr.String(), &tls.Config{Certificates: []tls.Certificate{ca.keyPair(t, "server")}})
+	if err != nil {
+		t.Fatalf("Unable to create server socket: %s", err)
+	}
+	serverSocket.SetProxyProtocol(loopbackProxyConfig())
+	processor := newContextProcessor()
+	server := NewTSimpleServer2(NewTProcessorFromContext(processor), serverSocket)
+	done := startServing(t, server, serverSocket)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+
+	src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 4242}
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 9090}
+	conn := dialProxied(t, addr.String(), proxyHeaderV2(src, dst, TProxyTLV{PROXY_TLV_AUTHORITY, []byte("example.org")}))
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	client := NewTBinaryProtocolTransport(NewTSocketFromConnTimeout(tlsConn, 2*time.Second))
+	defer client.Transport().Close()
+	if err := callTestServer(client, "test", 1, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	info, _ := ConnectionInfoFromContext(<-processor.calls)
+	if info.RemoteAddr.String() != src.String() || info.TLS == nil {
+		t.Errorf("Unexpected connection info: %#v", info)
+	}
+	if authority, ok := info.Proxy.TLV(PROXY_TLV_AUTHORITY); !ok || string(authority) != "example.org" {
+		t.Errorf("Expected the authority TLV, got %q", authority)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// A sustained rate of calls, in calls per second, allowing bursts of up to
+// Burst calls.
+type TRateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Returns the key a TRateLimiter counts a call against, or false if the
+// call is not limited.
+type TRateLimitKey func(ctx context.Context, call *TCall) (string, bool)
+
+// Keys calls by the IP address of the caller.
+func RateLimitByRemoteIP(ctx context.Context, call *TCall) (string, bool) {
+	info, ok := ConnectionInfoFromContext(ctx)
+	if !ok || info.RemoteAddr == nil {
+		return "", false
+	}
+	addr := info.RemoteAddr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host, true
+	}
+	return addr, true
+}
+
+// Keys calls by method name.
+func RateLimitByMethod(ctx context.Context, call *TCall) (string, bool) {
+	return call.Name, true
+}
+
+// Keys calls by the name of the caller's verified TLS identity, as
+// returned by TPeerIdentity.Name. Calls without one are not limited.
+func RateLimitByIdentity(ctx context.Context, call *TCall) (string, bool) {
+	identity, ok := PeerIdentityFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	name := identity.Name()
+	return name, name != ""
+}
+
+// How often a TRateLimiter forgets the buckets of keys not seen lately.
+const rateLimitSweepInterval = time.Minute
+
+// TRateLimiter limits calls with a token bucket per key. Calls over the
+// limit are answered with an OVERLOADED TApplicationException by the
+// middleware it returns. Several limiters, keyed differently, can be
+// chained to limit by caller and by method at once.
+type TRateLimiter struct {
+	name  string
+	key   TRateLimitKey
+	limit TRateLimit
+	// Replaced in tests.
+	now func() time.Time
+
+	mu        sync.Mutex
+	overrides map[string]TRateLimit
+	buckets   map[string]*tTokenBucket
+	lastSweep time.Time
+	allowed   int64
+	throttled int64
+}
+
+type tTokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Creates a limiter allowing limit for each key returned by key. The name
+// identifies the limiter in metrics.
+func NewTRateLimiter(name string, key TRateLimitKey, limit TRateLimit) *TRateLimiter {
+	return &TRateLimiter{
+		name:      name,
+		key:       key,
+		limit:     limit,
+		now:       time.Now,
+		overrides: make(map[string]TRateLimit),
+		buckets:   make(map[string]*tTokenBucket),
+	}
+}
+
+func (p *TRateLimiter) Name() string {
+	return p.name
+}
+
+// Sets the limit for one key in place of the default, as a quota for a
+// particular caller or method.
+func (p *TRateLimiter) SetLimit(key string, limit TRateLimit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.overrides[key] = limit
+	delete(p.buckets, key)
+}
+
+// Takes a token for key, reporting whether the call is within the limit.
+func (p *TRateLimiter) Allow(key string) bool {
+	now := p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.lastSweep) >= rateLimitSweepInterval {
+		p.sweep(now)
+	}
+	limit, burst := p.limitFor(key)
+	b, ok := p.buckets[key]
+	if !ok {
+		b = &tTokenBucket{tokens: burst, last: now}
+		p.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * limit.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		p.throttled++
+		return false
+	}
+	b.tokens--
+	p.allowed++
+	return true
+}
+
+// sweep forgets the buckets that have refilled, as they are the same as a
+// new one. Must be called with p.mu held.
+func (p *TRateLimiter) sweep(now time.Time) {
+	p.lastSweep = now
+	for key, b := range p.buckets {
+		limit, burst := p.limitFor(key)
+		if limit.Rate > 0 && b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= burst {
+			delete(p.buckets, key)
+		}
+	}
+}
+
+// limitFor returns the limit for key and its burst, which is at least one
+// call. Must be called with p.mu held.
+func (p *TRateLimiter) limitFor(key string) (TRateLimit, float64) {
+	limit, ok := p.overrides[key]
+	if !ok {
+		limit = p.limit
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return limit, burst
+}
+
+// Returns the number of calls allowed and throttled so far.
+func (p *TRateLimiter) Counts() (allowed, throttled int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.allowed, p.throttled
+}
+
+// String returns the counts as JSON, making TRateLimiter an expvar.Var.
+func (p *TRateLimiter) String() string {
+	allowed, throttled := p.Counts()
+	b, _ := json.Marshal(map[string]int64{"allowed": allowed, "throttled": throttled})
+	return string(b)
+}
+
+// Returns a middleware answering calls over the limit with an OVERLOADED
+// TApplicationException.
+func (p *TRateLimiter) Middleware() TMiddleware {
+	return func(next TCallHandler) TCallHandler {
+		return func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+			if key, ok := p.key(ctx, call); ok && !p.Allow(key) {
+				exc := NewTApplicationException(OVERLOADED, "Rate limit "+p.name+" exceeded")
+				return RejectCall(call, in, out, exc)
+			}
+			return next(ctx, call, in, out)
+		}
+	}
+}
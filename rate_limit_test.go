@@ -0,0 +1,115 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewTRateLimiter("test", RateLimitByMethod, TRateLimit{Rate: 2, Burst: 3})
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("a") {
+			t.Fatalf("Call %d within the burst throttled", i)
+		}
+	}
+	if limiter.Allow("a") {
+		t.Error("Call over the burst allowed")
+	}
+	if !limiter.Allow("b") {
+		t.Error("Other key throttled")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow("a") {
+		t.Error("Refilled token not granted")
+	}
+	if limiter.Allow("a") {
+		t.Error("Refill exceeded the rate")
+	}
+	limiter.SetLimit("c", TRateLimit{Rate: 1, Burst: 1})
+	if !limiter.Allow("c") || limiter.Allow("c") {
+		t.Error("Per-key limit not applied")
+	}
+	if allowed, throttled := limiter.Counts(); allowed != 6 || throttled != 3 {
+		t.Errorf("Unexpected counts %d allowed, %d throttled", allowed, throttled)
+	}
+	// Refilled buckets are forgotten.
+	now = now.Add(rateLimitSweepInterval)
+	limiter.Allow("b")
+	if n := len(limiter.buckets); n != 1 {
+		t.Errorf("Expected refilled buckets to be swept, %d left", n)
+	}
+}
+
+func TestRateLimitByRemoteIP(t *testing.T) {
+	ctx := NewContextWithConnectionInfo(context.Background(), &TConnectionInfo{RemoteAddr: httpAddr("10.1.2.3:4567")})
+	if key, ok := RateLimitByRemoteIP(ctx, &TCall{Name: "echo"}); !ok || key != "10.1.2.3" {
+		t.Errorf("Unexpected key %q", key)
+	}
+	if _, ok := RateLimitByIdentity(ctx, &TCall{Name: "echo"}); ok {
+		t.Error("Expected calls without a client certificate to be unlimited")
+	}
+	ctx = NewContextWithPeerIdentity(ctx, &TPeerIdentity{})
+	if _, ok := RateLimitByIdentity(ctx, &TCall{Name: "echo"}); ok {
+		t.Error("Expected calls from an unnamed identity to be unlimited")
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := NewTRateLimiter("per-ip", RateLimitByRemoteIP, TRateLimit{Rate: 0.001, Burst: 2})
+	metrics := NewTMetrics()
+	metrics.AddRateLimiter(limiter)
+	server, addr, done := startTestServer(t, WrapProcessor(&sleepProcessor{}, limiter.Middleware()))
+	prot := openTestClient(t, addr)
+	for i := int32(1); i <= 2; i++ {
+		if err := callTestServer(prot, "call", i, 0); err != nil {
+			t.Fatalf("Call %d failed: %v", i, err)
+		}
+	}
+	err := callTestServer(prot, "call", 3, 0)
+	if e, ok := err.(TApplicationException); !ok || e.TypeId() != OVERLOADED {
+		t.Fatalf("Expected OVERLOADED, got %v", err)
+	}
+	// The connection stays usable, though still throttled.
+	if err := callTestServer(prot, "call", 4, 0); err == nil {
+		t.Fatal("Expected the call to be throttled")
+	}
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	text := recorder.Body.String()
+	for _, line := range []string{
+		`thrift_server_rate_limit_allowed_total{limiter="per-ip"} 2`,
+		`thrift_server_rate_limit_throttled_total{limiter="per-ip"} 2`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Metrics lack %q:\n%s", line, text)
+		}
+	}
+}
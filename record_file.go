@@ -0,0 +1,732 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Compression applied to each chunk of a record file.
+type TRecordCompression byte
+
+const (
+	RECORD_COMPRESSION_NONE  TRecordCompression = 0
+	RECORD_COMPRESSION_FLATE TRecordCompression = 1
+	RECORD_COMPRESSION_GZIP  TRecordCompression = 2
+)
+
+const (
+	// Marks the start of every chunk, used to resynchronise after damage.
+	RECORD_CHUNK_MAGIC = 0x5448524946434831 // "THRIFCH1"
+	// Size of the header that precedes each chunk payload.
+	RECORD_CHUNK_HEADER_SIZE = 32
+	// Size of each entry in a record index file.
+	RECORD_INDEX_ENTRY_SIZE = 16
+
+	DEFAULT_RECORD_CHUNK_SIZE         = 1024 * 1024
+	DEFAULT_RECORD_TAIL_POLL_INTERVAL = 250 * time.Millisecond
+
+	// Chunks claiming a larger payload than this are treated as damaged.
+	maxRecordChunkPayload = 1 << 30
+	// Suffix of the offset index kept alongside a record file.
+	recordIndexSuffix = ".idx"
+)
+
+var (
+	errRecordFileClosed    = NewTTransportException(NOT_OPEN, "Record file closed")
+	errRecordChunkTooLarge = errors.New("Record chunk larger than the chunk size")
+)
+
+// Settings shared by TRecordFileWriter and TRecordFileReader. The zero value
+// is usable and selects uncompressed 1MB chunks without an index.
+//
+// A record file is a sequence of chunks. Each chunk starts with a 32 byte
+// header (magic, compression, payload length, record count, number of its
+// first record and a CRC32 over header and payload) followed by the
+// optionally compressed payload, which holds uvarint length-prefixed records.
+// Records never span chunks, so a damaged chunk only loses the records it
+// holds. When Index is set an offset index is kept in a file named after the
+// record file with an ".idx" suffix.
+type TRecordFileConfig struct {
+	// Uncompressed size at which a chunk is closed and written out, and the
+	// largest a chunk may get. Records must fit into a chunk, and readers
+	// reject chunks larger than their own ChunkSize, so it must be at least
+	// that of the writer.
+	ChunkSize int
+	// Compression applied to each chunk written.
+	Compression TRecordCompression
+	// Compression level passed to compress/flate and compress/gzip.
+	CompressionLevel int
+	// Maintain (writer) or use (reader) the offset index.
+	Index bool
+	// Makes the reader wait for more records at the end of the file instead
+	// of returning io.EOF, for files that are still being written.
+	Tail bool
+	// How often a tailing reader checks the file for new chunks.
+	TailPollInterval time.Duration
+}
+
+func (p *TRecordFileConfig) chunkSize() int {
+	if p == nil || p.ChunkSize <= 0 {
+		return DEFAULT_RECORD_CHUNK_SIZE
+	}
+	return p.ChunkSize
+}
+
+func (p *TRecordFileConfig) pollInterval() time.Duration {
+	if p == nil || p.TailPollInterval <= 0 {
+		return DEFAULT_RECORD_TAIL_POLL_INTERVAL
+	}
+	return p.TailPollInterval
+}
+
+type recordIndexEntry struct {
+	first  int64
+	offset int64
+}
+
+// Writes TStruct records to a chunked record file. Records are serialized
+// with the given protocol and numbered from zero. A TRecordFileWriter is not
+// safe for concurrent use.
+type TRecordFileWriter struct {
+	file       *os.File
+	trans      TTransport
+	index      *os.File
+	indexTrans TTransport
+	cfg        TRecordFileConfig
+
+	offset     int64
+	nextRecord int64
+	chunkFirst int64
+	chunkCount int
+	chunk      bytes.Buffer
+
+	recordBuffer   *TMemoryBuffer
+	recordProtocol TProtocol
+}
+
+// NewTRecordFileWriter opens path for writing, creating it if needed. If the
+// file already holds records, new records are appended and numbered after
+// the existing ones.
+func NewTRecordFileWriter(path string, protoFactory TProtocolFactory, cfg *TRecordFileConfig) (*TRecordFileWriter, error) {
+	w := &TRecordFileWriter{recordBuffer: NewTMemoryBufferLen(1024)}
+	if cfg != nil {
+		w.cfg = *cfg
+	}
+	w.cfg.ChunkSize = cfg.chunkSize()
+	w.recordProtocol = protoFactory.GetProtocol(w.recordBuffer)
+
+	if _, err := os.Stat(path); err == nil {
+		r, err := NewTRecordFileReader(path, protoFactory, &TRecordFileConfig{Index: w.cfg.Index})
+		if err != nil {
+			return nil, err
+		}
+		next, err := r.recordCount()
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		w.nextRecord = next
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if w.offset, err = file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if w.cfg.Index {
+		if w.index, err = os.OpenFile(path+recordIndexSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			file.Close()
+			return nil, err
+		}
+		w.indexTrans = NewStreamTransportW(w.index)
+	}
+	w.file = file
+	w.trans = NewStreamTransportW(file)
+	w.chunkFirst = w.nextRecord
+	return w, nil
+}
+
+// Returns the number the next record written will get.
+func (p *TRecordFileWriter) NextRecord() int64 {
+	return p.nextRecord
+}
+
+// Write appends v to the current chunk, writing the chunk out first if v
+// would not fit into it.
+func (p *TRecordFileWriter) Write(v TStruct) error {
+	p.recordBuffer.Reset()
+	if err := v.Write(p.recordProtocol); err != nil {
+		return err
+	}
+	if err := p.recordProtocol.Flush(); err != nil {
+		return err
+	}
+	record := p.recordBuffer.Bytes()
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(record)))
+	if n+len(record) > p.cfg.ChunkSize {
+		return NewTProtocolExceptionWithType(SIZE_LIMIT, fmt.Errorf("Record of %d bytes does not fit into a chunk of %d", len(record), p.cfg.ChunkSize))
+	}
+	if p.chunk.Len() > 0 && p.chunk.Len()+n+len(record) > p.cfg.ChunkSize {
+		if err := p.Flush(); err != nil {
+			return err
+		}
+	}
+	p.chunk.Write(lenBuf[:n])
+	p.chunk.Write(record)
+	p.chunkCount++
+	p.nextRecord++
+	if p.chunk.Len() >= p.cfg.ChunkSize {
+		return p.Flush()
+	}
+	return nil
+}
+
+// Flush writes out the current chunk, even if it is not full, so readers
+// can see the records written so far.
+func (p *TRecordFileWriter) Flush() error {
+	if p.chunkCount == 0 {
+		return nil
+	}
+	payload, err := compressRecordChunk(p.chunk.Bytes(), p.cfg.Compression, p.cfg.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, RECORD_CHUNK_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint64(buf[0:8], RECORD_CHUNK_MAGIC)
+	buf[8] = byte(p.cfg.Compression)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[16:20], uint32(p.chunkCount))
+	binary.BigEndian.PutUint64(buf[20:28], uint64(p.chunkFirst))
+	copy(buf[RECORD_CHUNK_HEADER_SIZE:], payload)
+	binary.BigEndian.PutUint32(buf[28:32], recordChunkChecksum(buf))
+	// The chunk is flushed on its own, and so written to the file with a
+	// single call, so a tailing reader sees at most one incomplete chunk at
+	// the end of the file.
+	if _, err := p.trans.Write(buf); err != nil {
+		return NewTTransportExceptionFromError(err)
+	}
+	if err := p.trans.Flush(); err != nil {
+		return NewTTransportExceptionFromError(err)
+	}
+	if p.indexTrans != nil {
+		var entry [RECORD_INDEX_ENTRY_SIZE]byte
+		binary.BigEndian.PutUint64(entry[0:8], uint64(p.chunkFirst))
+		binary.BigEndian.PutUint64(entry[8:16], uint64(p.offset))
+		if _, err := p.indexTrans.Write(entry[:]); err != nil {
+			return NewTTransportExceptionFromError(err)
+		}
+		if err := p.indexTrans.Flush(); err != nil {
+			return NewTTransportExceptionFromError(err)
+		}
+	}
+	p.offset += int64(len(buf))
+	p.chunk.Reset()
+	p.chunkCount = 0
+	p.chunkFirst = p.nextRecord
+	return nil
+}
+
+// Flushes the current chunk and closes the file.
+func (p *TRecordFileWriter) Close() error {
+	err := p.Flush()
+	if p.index != nil {
+		if e := p.index.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := p.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Reads TStruct records from a chunked record file written by
+// TRecordFileWriter. Damaged chunks are skipped, and a reader created with
+// Tail set keeps waiting for records appended by a concurrent writer.
+//
+// Read and SeekRecord must not be called concurrently; Close may be called from
+// another goroutine to stop a tailing reader.
+type TRecordFileReader struct {
+	mu           sync.Mutex
+	file         *os.File
+	cfg          TRecordFileConfig
+	protoFactory TProtocolFactory
+
+	// Chunks seen so far, ordered by offset.
+	index []recordIndexEntry
+	// Offset of the next chunk to load.
+	offset  int64
+	chunk   *recordChunk
+	skipped int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type recordChunk struct {
+	first int64
+	count int
+	data  []byte
+	// Position of the next record within data and its index in the chunk.
+	pos  int
+	next int
+}
+
+type recordChunkStatus int
+
+const (
+	recordChunkOK recordChunkStatus = iota
+	// No chunk magic at the offset.
+	recordChunkNoMagic
+	// The file ends before the chunk does.
+	recordChunkIncomplete
+	// The chunk is present but fails validation.
+	recordChunkDamaged
+)
+
+// NewTRecordFileReader opens the record file at path for reading.
+func NewTRecordFileReader(path string, protoFactory TProtocolFactory, cfg *TRecordFileConfig) (*TRecordFileReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &TRecordFileReader{file: file, protoFactory: protoFactory, done: make(chan struct{})}
+	if cfg != nil {
+		r.cfg = *cfg
+	}
+	if r.cfg.Index {
+		if err := r.loadIndex(path + recordIndexSuffix); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (p *TRecordFileReader) loadIndex(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	trans := NewStreamTransportR(file)
+	var entry [RECORD_INDEX_ENTRY_SIZE]byte
+	for {
+		// An entry cut short is one being written.
+		if _, err := io.ReadFull(trans, entry[:]); isEndOfFile(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p.remember(recordIndexEntry{
+			first:  int64(binary.BigEndian.Uint64(entry[0:8])),
+			offset: int64(binary.BigEndian.Uint64(entry[8:16])),
+		})
+	}
+}
+
+func (p *TRecordFileReader) remember(e recordIndexEntry) {
+	if n := len(p.index); n > 0 && (e.offset <= p.index[n-1].offset || e.first < p.index[n-1].first) {
+		return
+	}
+	p.index = append(p.index, e)
+}
+
+// Returns the number of damaged chunks skipped so far.
+func (p *TRecordFileReader) SkippedChunks() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.skipped
+}
+
+// Returns the number of the record the next call to Read returns.
+func (p *TRecordFileReader) Position() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.chunk == nil {
+		return 0
+	}
+	return p.chunk.first + int64(p.chunk.next)
+}
+
+// Read decodes the next record into v. At the end of the file it returns
+// io.EOF, unless the reader is tailing, in which case it waits until more
+// records are written or the reader is closed.
+func (p *TRecordFileReader) Read(v TStruct) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.isClosed() {
+			return errRecordFileClosed
+		}
+		if p.chunk != nil && p.chunk.next < p.chunk.count {
+			record, err := p.chunk.advance()
+			if err != nil {
+				// The rest of the chunk is lost; carry on with the next.
+				p.skipped++
+				continue
+			}
+			buf := &TMemoryBuffer{Buffer: bytes.NewBuffer(record)}
+			return v.Read(p.protoFactory.GetProtocol(buf))
+		}
+		err := p.loadNext()
+		if err == io.EOF && p.cfg.Tail {
+			if err = p.wait(); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SeekRecord positions the reader so the next call to Read returns the record
+// with the given number. It returns io.EOF if the file holds no such record.
+func (p *TRecordFileReader) SeekRecord(record int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isClosed() {
+		return errRecordFileClosed
+	}
+	i := sort.Search(len(p.index), func(i int) bool { return p.index[i].first > record }) - 1
+	p.offset = 0
+	if i >= 0 {
+		p.offset = p.index[i].offset
+	}
+	p.chunk = nil
+	for {
+		if err := p.loadNext(); err != nil {
+			return err
+		}
+		if record < p.chunk.first {
+			return NewTProtocolExceptionWithType(INVALID_DATA, fmt.Errorf("record %d was in a damaged chunk", record))
+		}
+		if record < p.chunk.first+int64(p.chunk.count) {
+			for p.chunk.first+int64(p.chunk.next) < record {
+				if _, err := p.chunk.advance(); err != nil {
+					p.skipped++
+					return NewTProtocolExceptionWithType(INVALID_DATA, fmt.Errorf("record %d was in a damaged chunk", record))
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// Closes the file, waking up a tailing Read.
+func (p *TRecordFileReader) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+func (p *TRecordFileReader) isClosed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait sleeps for one poll interval with the lock released.
+func (p *TRecordFileReader) wait() error {
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	select {
+	case <-p.done:
+		return errRecordFileClosed
+	case <-time.After(p.cfg.pollInterval()):
+		return nil
+	}
+}
+
+// recordCount scans to the end of the file and returns the number of the
+// record that would follow the last one.
+func (p *TRecordFileReader) recordCount() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset = 0
+	if n := len(p.index); n > 0 {
+		p.offset = p.index[n-1].offset
+	}
+	var next int64
+	for {
+		err := p.loadNext()
+		if err == io.EOF {
+			return next, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		next = p.chunk.first + int64(p.chunk.count)
+	}
+}
+
+// loadNext loads the next intact chunk at or after the current offset,
+// skipping over damaged data.
+func (p *TRecordFileReader) loadNext() error {
+	for {
+		size, err := p.fileSize()
+		if err != nil {
+			return err
+		}
+		chunk, next, status, err := p.readChunkAt(p.offset, size)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case recordChunkOK:
+			p.remember(recordIndexEntry{first: chunk.first, offset: p.offset})
+			p.chunk = chunk
+			p.offset = next
+			return nil
+		case recordChunkNoMagic:
+			found, err := p.findMagic(p.offset, size)
+			if err != nil {
+				return err
+			}
+			if found < 0 {
+				// A chunk may be in the middle of being written at the
+				// very end of the file, so keep the last bytes around.
+				if end := size - 7; end > p.offset {
+					p.offset = end
+				}
+				return io.EOF
+			}
+			p.offset = found
+		case recordChunkIncomplete:
+			// Either the writer has not finished this chunk yet or its
+			// length is damaged. It is only the latter if another chunk
+			// follows it.
+			found, err := p.findMagic(p.offset+1, size)
+			if err != nil {
+				return err
+			}
+			if found < 0 {
+				return io.EOF
+			}
+			p.skipped++
+			p.offset = found
+		case recordChunkDamaged:
+			p.skipped++
+			p.offset++
+		}
+	}
+}
+
+func (p *TRecordFileReader) fileSize() (int64, error) {
+	if p.file == nil {
+		return 0, errRecordFileClosed
+	}
+	info, err := p.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// transportAt returns a transport reading the file from offset up to size.
+func (p *TRecordFileReader) transportAt(offset, size int64) TTransport {
+	return NewStreamTransportR(io.NewSectionReader(p.file, offset, size-offset))
+}
+
+func (p *TRecordFileReader) readChunkAt(offset, size int64) (*recordChunk, int64, recordChunkStatus, error) {
+	if offset+8 > size {
+		return nil, 0, recordChunkNoMagic, nil
+	}
+	trans := p.transportAt(offset, size)
+	buf := make([]byte, RECORD_CHUNK_HEADER_SIZE)
+	n, err := io.ReadFull(trans, buf)
+	if err != nil && !isEndOfFile(err) {
+		return nil, 0, 0, err
+	}
+	if n < 8 || binary.BigEndian.Uint64(buf[0:8]) != RECORD_CHUNK_MAGIC {
+		return nil, 0, recordChunkNoMagic, nil
+	}
+	if n < RECORD_CHUNK_HEADER_SIZE {
+		return nil, 0, recordChunkIncomplete, nil
+	}
+	length := int64(binary.BigEndian.Uint32(buf[12:16]))
+	if length > maxRecordChunkPayload {
+		return nil, 0, recordChunkDamaged, nil
+	}
+	next := offset + RECORD_CHUNK_HEADER_SIZE + length
+	if next > size {
+		return nil, 0, recordChunkIncomplete, nil
+	}
+	buf = append(buf, make([]byte, length)...)
+	if _, err := io.ReadFull(trans, buf[RECORD_CHUNK_HEADER_SIZE:]); isEndOfFile(err) {
+		return nil, 0, recordChunkIncomplete, nil
+	} else if err != nil {
+		return nil, 0, 0, err
+	}
+	if recordChunkChecksum(buf) != binary.BigEndian.Uint32(buf[28:32]) {
+		return nil, 0, recordChunkDamaged, nil
+	}
+	data, err := decompressRecordChunk(buf[RECORD_CHUNK_HEADER_SIZE:], TRecordCompression(buf[8]), p.cfg.chunkSize())
+	if err != nil {
+		return nil, 0, recordChunkDamaged, nil
+	}
+	chunk := &recordChunk{
+		first: int64(binary.BigEndian.Uint64(buf[20:28])),
+		count: int(binary.BigEndian.Uint32(buf[16:20])),
+		data:  data,
+	}
+	return chunk, next, recordChunkOK, nil
+}
+
+// findMagic returns the offset of the first chunk magic at or after from, or
+// -1 if there is none before size.
+func (p *TRecordFileReader) findMagic(from, size int64) (int64, error) {
+	var magic [8]byte
+	binary.BigEndian.PutUint64(magic[:], RECORD_CHUNK_MAGIC)
+	buf := make([]byte, 64*1024)
+	for from+8 <= size {
+		n, err := io.ReadFull(p.transportAt(from, size), buf)
+		if err != nil && !isEndOfFile(err) {
+			return -1, err
+		}
+		if i := bytes.Index(buf[:n], magic[:]); i >= 0 {
+			return from + int64(i), nil
+		}
+		if n < len(buf) {
+			break
+		}
+		// Overlap the blocks so a magic spanning them is not missed.
+		from += int64(n - 7)
+	}
+	return -1, nil
+}
+
+// isEndOfFile reports whether err comes from reading past the end of a
+// file through a transport.
+func isEndOfFile(err error) bool {
+	if e, ok := err.(TTransportException); ok {
+		return e.TypeId() == END_OF_FILE
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// advance returns the next record of the chunk. If the chunk turns out to
+// be malformed it returns an error and skips the rest of the chunk.
+func (p *recordChunk) advance() ([]byte, error) {
+	length, n := binary.Uvarint(p.data[p.pos:])
+	if n <= 0 || uint64(len(p.data)-p.pos-n) < length {
+		p.next = p.count
+		return nil, NewTProtocolExceptionWithType(INVALID_DATA, errors.New("Malformed record in chunk"))
+	}
+	start := p.pos + n
+	p.pos = start + int(length)
+	p.next++
+	return p.data[start:p.pos], nil
+}
+
+func recordChunkChecksum(chunk []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write(chunk[8:28])
+	crc.Write(chunk[RECORD_CHUNK_HEADER_SIZE:])
+	return crc.Sum32()
+}
+
+func compressRecordChunk(data []byte, compression TRecordCompression, level int) ([]byte, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case RECORD_COMPRESSION_NONE:
+		return data, nil
+	case RECORD_COMPRESSION_FLATE:
+		w, err = flate.NewWriter(&buf, level)
+	case RECORD_COMPRESSION_GZIP:
+		w, err = gzip.NewWriterLevel(&buf, level)
+	default:
+		return nil, NewTProtocolExceptionWithType(NOT_IMPLEMENTED, fmt.Errorf("Unknown record compression %d", compression))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressRecordChunk decompresses the payload of a chunk, failing if it
+// holds more than limit bytes.
+func decompressRecordChunk(data []byte, compression TRecordCompression, limit int) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch compression {
+	case RECORD_COMPRESSION_NONE:
+		if len(data) > limit {
+			return nil, errRecordChunkTooLarge
+		}
+		return data, nil
+	case RECORD_COMPRESSION_FLATE:
+		r = flate.NewReader(bytes.NewReader(data))
+	case RECORD_COMPRESSION_GZIP:
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown record compression %d", compression)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, errRecordChunkTooLarge
+	}
+	return out, nil
+}
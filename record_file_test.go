@@ -0,0 +1,230 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestRecords(t *testing.T, path string, cfg *TRecordFileConfig, first, count int) {
+	w, err := NewTRecordFileWriter(path, NewTBinaryProtocolFactoryDefault(), cfg)
+	if err != nil {
+		t.Fatalf("Unable to open record file writer: %s", err)
+	}
+	if w.NextRecord() != int64(first) {
+		t.Fatalf("Expected writer to continue at record %d, got %d", first, w.NextRecord())
+	}
+	for i := first; i < first+count; i++ {
+		m := NewTestStruct()
+		m.Int64 = int64(i)
+		m.St = "event"
+		if err := w.Write(m); err != nil {
+			t.Fatalf("Unable to write record %d: %s", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unable to close record file writer: %s", err)
+	}
+}
+
+func readTestRecord(t *testing.T, r *TRecordFileReader, expected int64) {
+	m := NewTestStruct()
+	if err := r.Read(m); err != nil {
+		t.Fatalf("Unable to read record %d: %s", expected, err)
+	}
+	if m.Int64 != expected {
+		t.Fatalf("Expected record %d, got %d", expected, m.Int64)
+	}
+}
+
+func TestRecordFileReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	for _, compression := range []TRecordCompression{RECORD_COMPRESSION_NONE, RECORD_COMPRESSION_FLATE, RECORD_COMPRESSION_GZIP} {
+		path := filepath.Join(dir, "records")
+		os.Remove(path)
+		os.Remove(path + ".idx")
+		cfg := &TRecordFileConfig{ChunkSize: 256, Compression: compression, Index: true}
+		writeTestRecords(t, path, cfg, 0, 100)
+		writeTestRecords(t, path, cfg, 100, 50)
+
+		r, err := NewTRecordFileReader(path, NewTBinaryProtocolFactoryDefault(), cfg)
+		if err != nil {
+			t.Fatalf("Unable to open record file reader: %s", err)
+		}
+		for i := int64(0); i < 150; i++ {
+			readTestRecord(t, r, i)
+		}
+		if err := r.Read(NewTestStruct()); err != io.EOF {
+			t.Fatalf("Expected io.EOF, got %v", err)
+		}
+		for _, n := range []int64{137, 3, 99, 100, 0} {
+			if err := r.SeekRecord(n); err != nil {
+				t.Fatalf("Unable to seek to record %d: %s", n, err)
+			}
+			if r.Position() != n {
+				t.Fatalf("Expected position %d after seek, got %d", n, r.Position())
+			}
+			readTestRecord(t, r, n)
+		}
+		if err := r.SeekRecord(150); err != io.EOF {
+			t.Fatalf("Expected io.EOF seeking past the end, got %v", err)
+		}
+		r.Close()
+	}
+}
+
+func TestRecordFileSkipsDamagedChunks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records")
+	writeTestRecords(t, path, &TRecordFileConfig{ChunkSize: 128}, 0, 50)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[RECORD_CHUNK_HEADER_SIZE+5] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewTRecordFileReader(path, NewTBinaryProtocolFactoryDefault(), nil)
+	if err != nil {
+		t.Fatalf("Unable to open record file reader: %s", err)
+	}
+	defer r.Close()
+	m := NewTestStruct()
+	if err := r.Read(m); err != nil {
+		t.Fatalf("Unable to read past damaged chunk: %s", err)
+	}
+	if m.Int64 == 0 {
+		t.Fatalf("Expected the first chunk to be skipped")
+	}
+	last := m.Int64
+	for {
+		if err := r.Read(m); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Unable to read record: %s", err)
+		}
+		last = m.Int64
+	}
+	if last != 49 {
+		t.Errorf("Expected to read up to record 49, got %d", last)
+	}
+	if r.SkippedChunks() != 1 {
+		t.Errorf("Expected 1 skipped chunk, got %d", r.SkippedChunks())
+	}
+}
+
+func TestRecordFileTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records")
+	writeTestRecords(t, path, nil, 0, 1)
+
+	r, err := NewTRecordFileReader(path, NewTBinaryProtocolFactoryDefault(), &TRecordFileConfig{Tail: true, TailPollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to open record file reader: %s", err)
+	}
+	readTestRecord(t, r, 0)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		writeTestRecords(t, path, nil, 1, 1)
+	}()
+	readTestRecord(t, r, 1)
+
+	done := make(chan error)
+	go func() {
+		done <- r.Read(NewTestStruct())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	if err := <-done; err == nil {
+		t.Fatalf("Expected tailing read to fail after close")
+	}
+}
+
+// appendTestChunk appends a chunk with a valid checksum holding payload as
+// the records first to first+count-1.
+func appendTestChunk(t *testing.T, path string, first int64, count int, compression TRecordCompression, payload []byte) {
+	buf := make([]byte, RECORD_CHUNK_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint64(buf[0:8], RECORD_CHUNK_MAGIC)
+	buf[8] = byte(compression)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[16:20], uint32(count))
+	binary.BigEndian.PutUint64(buf[20:28], uint64(first))
+	copy(buf[RECORD_CHUNK_HEADER_SIZE:], payload)
+	binary.BigEndian.PutUint32(buf[28:32], recordChunkChecksum(buf))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordFileSkipsMalformedChunks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records")
+	writeTestRecords(t, path, nil, 0, 3)
+	// A record claiming to be longer than its chunk.
+	appendTestChunk(t, path, 3, 2, RECORD_COMPRESSION_NONE, []byte{0x7f, 1, 2})
+	// A small chunk decompressing to more than the chunk size.
+	compressed, err := compressRecordChunk(make([]byte, 4*DEFAULT_RECORD_CHUNK_SIZE), RECORD_COMPRESSION_FLATE, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTestChunk(t, path, 5, 1, RECORD_COMPRESSION_FLATE, compressed)
+	// The writer does not count the records of the chunk it cannot read.
+	writeTestRecords(t, path, nil, 5, 2)
+
+	r, err := NewTRecordFileReader(path, NewTBinaryProtocolFactoryDefault(), nil)
+	if err != nil {
+		t.Fatalf("Unable to open record file reader: %s", err)
+	}
+	defer r.Close()
+	for _, expected := range []int64{0, 1, 2, 5, 6} {
+		readTestRecord(t, r, expected)
+	}
+	if err := r.Read(NewTestStruct()); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	if r.SkippedChunks() != 2 {
+		t.Errorf("Expected 2 skipped chunks, got %d", r.SkippedChunks())
+	}
+}
+
+func TestRecordFileRejectsOversizedRecords(t *testing.T) {
+	w, err := NewTRecordFileWriter(filepath.Join(t.TempDir(), "records"), NewTBinaryProtocolFactoryDefault(), &TRecordFileConfig{ChunkSize: 16})
+	if err != nil {
+		t.Fatalf("Unable to open record file writer: %s", err)
+	}
+	defer w.Close()
+	m := NewTestStruct()
+	m.St = "a record larger than a chunk"
+	if err := w.Write(m); err == nil {
+		t.Error("Expected a record larger than a chunk to be rejected")
+	}
+}
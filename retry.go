@@ -0,0 +1,299 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults of a TRetryingClient.
+const (
+	DEFAULT_RETRY_ATTEMPTS        = 3
+	DEFAULT_RETRY_INITIAL_BACKOFF = 50 * time.Millisecond
+	DEFAULT_RETRY_MAX_BACKOFF     = time.Second
+	DEFAULT_RETRY_JITTER          = 0.2
+)
+
+// Reports whether a failed call may succeed if made again, given whether
+// its message may have reached the server. By default, calls are retried
+// after failing to connect, or being refused with an OVERLOADED exception,
+// and calls to idempotent methods also after the connection failed with a
+// NOT_OPEN, TIMED_OUT or END_OF_FILE TTransportException.
+type TRetryable func(method string, sent bool, err error) bool
+
+// Limits retries to a fraction of calls, so that retries cannot multiply
+// the load on a failing server. Every call adds ratio to the budget, which
+// also refills by minPerSecond each second, and every retry takes one from
+// it. A budget may be shared by several clients.
+type TRetryBudget struct {
+	ratio        float64
+	minPerSecond float64
+	max          float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// Creates a budget allowing retries of a fraction ratio of calls, and at
+// least minPerSecond retries a second. At most ten seconds' worth of
+// minPerSecond, or ten retries if more, can be saved up.
+func NewTRetryBudget(ratio, minPerSecond float64) *TRetryBudget {
+	max := 10 * minPerSecond
+	if max < 10 {
+		max = 10
+	}
+	return &TRetryBudget{ratio: ratio, minPerSecond: minPerSecond, max: max, tokens: max, now: time.Now}
+}
+
+func (p *TRetryBudget) refillLocked() {
+	now := p.now()
+	if !p.last.IsZero() {
+		p.tokens += now.Sub(p.last).Seconds() * p.minPerSecond
+	}
+	p.last = now
+	if p.tokens > p.max {
+		p.tokens = p.max
+	}
+}
+
+// Records a call.
+func (p *TRetryBudget) Deposit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refillLocked()
+	p.tokens += p.ratio
+	if p.tokens > p.max {
+		p.tokens = p.max
+	}
+}
+
+// Takes a retry from the budget, if there is one left.
+func (p *TRetryBudget) Withdraw() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refillLocked()
+	if p.tokens < 1 {
+		return false
+	}
+	p.tokens--
+	return true
+}
+
+// A TClient making each call on a transport borrowed from a pool or
+// balancer, and making it again after a transient failure, waiting longer
+// after each attempt. Transports that failed are discarded by the pool, so
+// retries reconnect as needed, and a balancer may pick another endpoint for
+// them. A pool limited to one open transport keeps a single connection.
+type TRetryingClient struct {
+	source    TTransportSource
+	iprotFact TProtocolFactory
+	oprotFact TProtocolFactory
+
+	mu             sync.RWMutex
+	attempts       int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	idempotent     map[string]bool
+	retryable      TRetryable
+	budget         *TRetryBudget
+	// Returns a random number in [0, 1).
+	random func() float64
+}
+
+func NewTRetryingClient(source TTransportSource, protocolFactory TProtocolFactory) *TRetryingClient {
+	return NewTRetryingClient3(source, protocolFactory, protocolFactory)
+}
+
+func NewTRetryingClient3(source TTransportSource, inputProtocolFactory, outputProtocolFactory TProtocolFactory) *TRetryingClient {
+	p := &TRetryingClient{
+		source:         source,
+		iprotFact:      inputProtocolFactory,
+		oprotFact:      outputProtocolFactory,
+		attempts:       DEFAULT_RETRY_ATTEMPTS,
+		initialBackoff: DEFAULT_RETRY_INITIAL_BACKOFF,
+		maxBackoff:     DEFAULT_RETRY_MAX_BACKOFF,
+		jitter:         DEFAULT_RETRY_JITTER,
+		idempotent:     make(map[string]bool),
+		random:         rand.Float64,
+	}
+	p.retryable = p.defaultRetryable
+	return p
+}
+
+// Sets how many times a call is made at most, including the first.
+func (p *TRetryingClient) SetMaxAttempts(attempts int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts = attempts
+}
+
+// Sets the wait before the first retry, doubling for each further one up to
+// max.
+func (p *TRetryingClient) SetBackoff(initial, max time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.initialBackoff = initial
+	p.maxBackoff = max
+}
+
+// Sets the fraction of each wait that is random, so that clients failing
+// together do not retry together.
+func (p *TRetryingClient) SetJitter(jitter float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jitter = jitter
+}
+
+// Marks methods as idempotent, so that calls to them are retried even if
+// the server may have received them already.
+func (p *TRetryingClient) SetIdempotent(methods ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, method := range methods {
+		p.idempotent[method] = true
+	}
+}
+
+// Replaces the check deciding which failures are retried.
+func (p *TRetryingClient) SetRetryable(retryable TRetryable) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retryable = retryable
+}
+
+// Sets the budget retries are taken from. Without one, retries are only
+// limited by the number of attempts.
+func (p *TRetryingClient) SetRetryBudget(budget *TRetryBudget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.budget = budget
+}
+
+func (p *TRetryingClient) isIdempotent(method string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.idempotent[method]
+}
+
+func (p *TRetryingClient) defaultRetryable(method string, sent bool, err error) bool {
+	if err == errPoolClosed {
+		return false
+	}
+	switch e := err.(type) {
+	case *tTransportException:
+		if !sent {
+			return true
+		}
+		switch e.TypeId() {
+		case NOT_OPEN, TIMED_OUT, END_OF_FILE:
+			return p.isIdempotent(method)
+		}
+	case TApplicationException:
+		// The server refused the call without processing it.
+		return e.TypeId() == OVERLOADED
+	}
+	return false
+}
+
+func (p *TRetryingClient) Call(ctx context.Context, method string, args, result TStruct) error {
+	return p.retry(ctx, method, CALL, args, result)
+}
+
+// Sends a oneway call to method with args.
+func (p *TRetryingClient) Oneway(ctx context.Context, method string, args TStruct) error {
+	return p.retry(ctx, method, ONEWAY, args, nil)
+}
+
+func (p *TRetryingClient) retry(ctx context.Context, method string, typeId TMessageType, args, result TStruct) error {
+	p.mu.RLock()
+	attempts, retryable, budget := p.attempts, p.retryable, p.budget
+	p.mu.RUnlock()
+	if budget != nil {
+		budget.Deposit()
+	}
+	for attempt := 1; ; attempt++ {
+		sent, err := p.attempt(ctx, method, typeId, args, result)
+		if err == nil || attempt >= attempts || ctx.Err() != nil || !retryable(method, sent, err) {
+			return err
+		}
+		if budget != nil && !budget.Withdraw() {
+			return err
+		}
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt makes a call once, on a transport borrowed for it.
+func (p *TRetryingClient) attempt(ctx context.Context, method string, typeId TMessageType, args, result TStruct) (bool, error) {
+	trans, err := p.source.Get(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer trans.Close()
+	client := NewTStandardClient(p.iprotFact.GetProtocol(trans), p.oprotFact.GetProtocol(trans))
+	sent, err := client.call(ctx, method, typeId, args, result)
+	if err != nil && !reusableAfter(err) {
+		trans.Discard()
+	}
+	return sent, err
+}
+
+// reusableAfter reports whether a transport can still be used after a call
+// on it failed with err: only once a regular exception reply has been read.
+// Replies out of step with the call may be followed by others, and servers
+// close connections they reject calls on as OVERLOADED.
+func reusableAfter(err error) bool {
+	e, ok := err.(TApplicationException)
+	if !ok {
+		return false
+	}
+	switch e.TypeId() {
+	case OVERLOADED, WRONG_METHOD_NAME, BAD_SEQUENCE_ID, INVALID_MESSAGE_TYPE_EXCEPTION:
+		return false
+	}
+	return true
+}
+
+// backoff returns how long to wait before retrying after the given
+// attempt.
+func (p *TRetryingClient) backoff(attempt int) time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	backoff := p.initialBackoff
+	for i := 1; i < attempt && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	return backoff - time.Duration(p.jitter*p.random()*float64(backoff))
+}
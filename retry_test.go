@@ -0,0 +1,227 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake connection answering each request it is sent in the way given by
+// behavior: "ok" replies, "overloaded" replies with an OVERLOADED
+// exception, and "eof" fails reading the reply.
+type testRetryTransport struct {
+	behavior string
+	requests *TMemoryBuffer
+	replies  *TMemoryBuffer
+	seen     func(name string)
+}
+
+func (p *testRetryTransport) IsOpen() bool { return true }
+func (p *testRetryTransport) Open() error  { return nil }
+func (p *testRetryTransport) Close() error { return nil }
+func (p *testRetryTransport) Peek() bool   { return true }
+
+func (p *testRetryTransport) Write(buf []byte) (int, error) {
+	return p.requests.Write(buf)
+}
+
+func (p *testRetryTransport) Read(buf []byte) (int, error) {
+	if p.behavior == "eof" {
+		return 0, NewTTransportException(END_OF_FILE, "EOF")
+	}
+	return p.replies.Read(buf)
+}
+
+func (p *testRetryTransport) Flush() error {
+	in := NewTBinaryProtocolTransport(p.requests)
+	name, typeId, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	in.Skip(STRUCT)
+	in.ReadMessageEnd()
+	p.seen(name)
+	if typeId == ONEWAY || p.behavior == "eof" {
+		return nil
+	}
+	out := NewTBinaryProtocolTransport(p.replies)
+	if p.behavior == "overloaded" {
+		return writeApplicationException(out, name, seqId, NewTApplicationException(OVERLOADED, "busy"))
+	}
+	out.WriteMessageBegin(name, REPLY, seqId)
+	(&testEmptyResult{}).Write(out)
+	return out.WriteMessageEnd()
+}
+
+// Dials a fake connection of each behavior in turn, "refuse" failing to
+// connect, repeating the last one.
+type testRetryDialer struct {
+	mu        sync.Mutex
+	behaviors []string
+	dials     int
+	requests  []string
+}
+
+func (p *testRetryDialer) script(behaviors ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.behaviors = behaviors
+	p.dials = 0
+	p.requests = nil
+}
+
+func (p *testRetryDialer) dial(ctx context.Context) (TTransport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	behavior := p.behaviors[len(p.behaviors)-1]
+	if p.dials < len(p.behaviors) {
+		behavior = p.behaviors[p.dials]
+	}
+	p.dials++
+	if behavior == "refuse" {
+		return nil, NewTTransportException(NOT_OPEN, "connection refused")
+	}
+	return &testRetryTransport{behavior: behavior, requests: NewTMemoryBuffer(), replies: NewTMemoryBuffer(), seen: func(name string) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.requests = append(p.requests, name)
+	}}, nil
+}
+
+func (p *testRetryDialer) counts() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dials, len(p.requests)
+}
+
+func newTestRetryingClient(dialer *testRetryDialer) *TRetryingClient {
+	client := NewTRetryingClient(NewTTransportPool(dialer.dial), NewTBinaryProtocolFactoryDefault())
+	client.SetBackoff(time.Millisecond, time.Millisecond)
+	client.SetIdempotent("get")
+	return client
+}
+
+func TestRetryingClientIdempotency(t *testing.T) {
+	dialer := &testRetryDialer{}
+	client := newTestRetryingClient(dialer)
+
+	dialer.script("refuse", "eof", "ok")
+	err := client.Call(context.Background(), "put", &testSleepArgs{}, &testEmptyResult{})
+	if exc, ok := err.(TTransportException); !ok || exc.TypeId() != END_OF_FILE {
+		t.Errorf("Expected a sent call to a method not idempotent to fail, got %v", err)
+	}
+	if dials, requests := dialer.counts(); dials != 2 || requests != 1 {
+		t.Errorf("Expected the call to be retried after failing to connect only: %d dials, %d requests", dials, requests)
+	}
+
+	dialer.script("refuse", "eof", "ok")
+	if err := client.Call(context.Background(), "get", &testSleepArgs{}, &testEmptyResult{}); err != nil {
+		t.Errorf("Expected the idempotent call to succeed on retry: %v", err)
+	}
+	if dials, requests := dialer.counts(); dials != 3 || requests != 2 {
+		t.Errorf("Expected the call to reconnect for each retry: %d dials, %d requests", dials, requests)
+	}
+
+	// The transport that succeeded is reused unless the pool is replaced.
+	client = newTestRetryingClient(dialer)
+	dialer.script("overloaded")
+	err = client.Call(context.Background(), "put", &testSleepArgs{}, &testEmptyResult{})
+	if exc, ok := err.(TApplicationException); !ok || exc.TypeId() != OVERLOADED {
+		t.Errorf("Expected an OVERLOADED exception, got %v", err)
+	}
+	if _, requests := dialer.counts(); requests != DEFAULT_RETRY_ATTEMPTS {
+		t.Errorf("Expected calls refused as overloaded to be retried: %d requests", requests)
+	}
+
+	// Servers close connections they refuse calls on, so retries
+	// reconnect.
+	client = newTestRetryingClient(dialer)
+	dialer.script("overloaded", "ok")
+	if err := client.Call(context.Background(), "put", &testSleepArgs{}, &testEmptyResult{}); err != nil {
+		t.Errorf("Expected the call to succeed on retry: %v", err)
+	}
+	if dials, requests := dialer.counts(); dials != 2 || requests != 2 {
+		t.Errorf("Expected the retry to reconnect: %d dials, %d requests", dials, requests)
+	}
+
+	dialer.script("ok")
+	if err := client.Oneway(context.Background(), "notify", &testSleepArgs{}); err != nil {
+		t.Errorf("Oneway call failed: %v", err)
+	}
+}
+
+func TestRetryingClientBudget(t *testing.T) {
+	dialer := &testRetryDialer{}
+	client := newTestRetryingClient(dialer)
+	client.SetMaxAttempts(100)
+	budget := NewTRetryBudget(0.5, 0)
+	now := time.Now()
+	budget.now = func() time.Time { return now }
+	client.SetRetryBudget(budget)
+
+	dialer.script("refuse")
+	client.Call(context.Background(), "get", &testSleepArgs{}, &testEmptyResult{})
+	if dials, _ := dialer.counts(); dials != 11 {
+		t.Errorf("Expected the budget to allow 10 retries, got %d", dials-1)
+	}
+	dialer.script("refuse")
+	client.Call(context.Background(), "get", &testSleepArgs{}, &testEmptyResult{})
+	client.Call(context.Background(), "get", &testSleepArgs{}, &testEmptyResult{})
+	if dials, _ := dialer.counts(); dials != 3 {
+		t.Errorf("Expected calls to add half a retry each to the budget, got %d dials", dials)
+	}
+
+	budget = NewTRetryBudget(0, 2)
+	budget.now = func() time.Time { return now }
+	for budget.Withdraw() {
+	}
+	now = now.Add(time.Second)
+	if !budget.Withdraw() || !budget.Withdraw() || budget.Withdraw() {
+		t.Error("Expected the budget to refill by two retries a second")
+	}
+}
+
+func TestRetryingClientBackoff(t *testing.T) {
+	client := NewTRetryingClient(NewTTransportPool(nil), NewTBinaryProtocolFactoryDefault())
+	client.SetBackoff(100*time.Millisecond, time.Second)
+	client.random = func() float64 { return 0.5 }
+	for attempt, expected := range []time.Duration{90, 180, 360, 720, 900, 900} {
+		if backoff := client.backoff(attempt + 1); backoff != expected*time.Millisecond {
+			t.Errorf("Expected backoff %v after attempt %d, got %v", expected*time.Millisecond, attempt+1, backoff)
+		}
+	}
+
+	dialer := &testRetryDialer{}
+	dialer.script("refuse")
+	client = NewTRetryingClient(NewTTransportPool(dialer.dial), NewTBinaryProtocolFactoryDefault())
+	client.SetBackoff(time.Second, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.Call(ctx, "get", &testSleepArgs{}, &testEmptyResult{}); err == nil {
+		t.Error("Expected the call to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected waiting to retry to end with the context, took %v", elapsed)
+	}
+}
@@ -0,0 +1,620 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Separates the service name from the method name in the messages of
+// multiplexed services, as in "Calculator:add".
+const MULTIPLEXED_SEPARATOR = ":"
+
+// The number of mirrored calls a TReverseProxy lets run at once; calls to
+// mirror beyond that are dropped.
+const MAX_SHADOW_CALLS = 64
+
+// How many idle connections a TProxyBackend keeps, unless configured
+// otherwise.
+const DEFAULT_PROXY_MAX_IDLE = 8
+
+// The deepest nesting of containers and structs a TReverseProxy forwards.
+const maxProxyDepth = 64
+
+// Splits the name of a message into service and method, the service being
+// empty if the name has no MULTIPLEXED_SEPARATOR.
+func splitServiceName(name string) (string, string) {
+	if i := strings.Index(name, MULTIPLEXED_SEPARATOR); i >= 0 {
+		return name[:i], name[i+len(MULTIPLEXED_SEPARATOR):]
+	}
+	return "", name
+}
+
+// A rule sending the calls it matches to a backend. Empty criteria match
+// any call.
+type TProxyRoute struct {
+	// The multiplexed service name.
+	Service string
+	// The method name, without the service name.
+	Method string
+	// The start of the full message name.
+	Prefix string
+	// Whether to forward the method name without the service name, for
+	// backends serving a single service.
+	StripService bool
+	Backend      *TProxyBackend
+	// How long the backend may take to reply, including connecting. Zero
+	// means no limit other than the server's context.
+	Timeout time.Duration
+	// A backend receiving a copy of a fraction ShadowRate of the calls,
+	// whose replies are discarded.
+	Shadow     *TProxyBackend
+	ShadowRate float64
+}
+
+func (p *TProxyRoute) matches(name string) bool {
+	service, method := splitServiceName(name)
+	return (p.Service == "" || p.Service == service) &&
+		(p.Method == "" || p.Method == method) &&
+		strings.HasPrefix(name, p.Prefix)
+}
+
+// A TProcessor forwarding each call to the backend of the first route
+// matching its name, and the backend's reply to the caller. Only the message
+// header is interpreted: arguments and results are copied byte for byte
+// where both sides use TBinaryProtocol and value by value otherwise, so no
+// IDL is needed and client and backend may use different protocols and
+// framing. The client side uses those of the server running the proxy.
+//
+// Since protocols are translated without knowing the types of fields,
+// binary fields are forwarded as strings. They arrive intact unless only
+// one side uses the JSON protocol, which encodes the two differently.
+//
+// Calls matching no route are answered with an UNKNOWN_METHOD exception, and
+// calls the backend fails with an INTERNAL_ERROR exception.
+type TReverseProxy struct {
+	mu      sync.RWMutex
+	routes  []*TProxyRoute
+	logger  TLogger
+	shadows chan struct{}
+	// Draws the number deciding whether a call is mirrored.
+	random func() float64
+}
+
+func NewTReverseProxy() *TReverseProxy {
+	return &TReverseProxy{
+		logger:  DefaultLogger(),
+		shadows: make(chan struct{}, MAX_SHADOW_CALLS),
+		random:  rand.Float64,
+	}
+}
+
+// Adds a route, to be tried after those added before it.
+func (p *TReverseProxy) AddRoute(route *TProxyRoute) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routes = append(p.routes, route)
+}
+
+// Sets the logger backend failures are reported to, DefaultLogger() if nil.
+func (p *TReverseProxy) SetLogger(logger TLogger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logger = logger
+}
+
+func (p *TReverseProxy) Logger() TLogger {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.logger == nil {
+		return DefaultLogger()
+	}
+	return p.logger
+}
+
+func (p *TReverseProxy) route(name string) *TProxyRoute {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, route := range p.routes {
+		if route.matches(name) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (p *TReverseProxy) Process(in, out TProtocol) (bool, TException) {
+	return p.ProcessContext(context.Background(), in, out)
+}
+
+// Processes a call like Process, giving up on the backend when ctx is done.
+func (p *TReverseProxy) ProcessContext(ctx context.Context, in, out TProtocol) (bool, TException) {
+	name, typeId, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	call := &TCall{Name: name, SeqId: seqId, TypeId: typeId, Start: time.Now()}
+	if typeId != CALL && typeId != ONEWAY {
+		exc := NewTApplicationException(INVALID_MESSAGE_TYPE_EXCEPTION, fmt.Sprintf("Invalid message type %d for %s", typeId, name))
+		return RejectCall(call, in, out, exc)
+	}
+	route := p.route(name)
+	if route == nil {
+		return RejectCall(call, in, out, NewTApplicationException(UNKNOWN_METHOD, "Unknown function "+name))
+	}
+	payload, err := readProxyPayload(in)
+	if err != nil {
+		return false, err
+	}
+	forwardName := name
+	if route.StripService {
+		_, forwardName = splitServiceName(name)
+	}
+	if route.Shadow != nil && p.random() < route.ShadowRate {
+		p.mirror(route.Shadow, route.Timeout, forwardName, typeId, payload)
+	}
+
+	if route.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, route.Timeout)
+		defer cancel()
+	}
+	replyType, reply, err := route.Backend.call(ctx, forwardName, typeId, payload)
+	if err != nil {
+		p.Logger().Warn("thrift: backend call failed", "backend", route.Backend.Name(), "method", name, "error", err)
+		if typeId == ONEWAY {
+			return true, nil
+		}
+		exc := NewTApplicationException(INTERNAL_ERROR, fmt.Sprintf("Backend %s failed processing %s: %v", route.Backend.Name(), name, err))
+		if err := writeApplicationException(out, name, seqId, exc); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if typeId == ONEWAY {
+		return true, nil
+	}
+	if err := out.WriteMessageBegin(name, replyType, seqId); err != nil {
+		return false, err
+	}
+	if err := writeProxyPayload(out, reply); err != nil {
+		return false, err
+	}
+	if err := out.WriteMessageEnd(); err != nil {
+		return false, err
+	}
+	return true, out.Flush()
+}
+
+// mirror sends a copy of a call to backend in the background, unless too
+// many copies are in flight already.
+func (p *TReverseProxy) mirror(backend *TProxyBackend, timeout time.Duration, name string, typeId TMessageType, payload []byte) {
+	select {
+	case p.shadows <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-p.shadows }()
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if _, _, err := backend.call(ctx, name, typeId, payload); err != nil {
+			p.Logger().Debug("thrift: shadow call failed", "backend", backend.Name(), "method", name, "error", err)
+		}
+	}()
+}
+
+func (p *TReverseProxy) contextProcessor() TContextProcessor {
+	return &tReverseProxyContextProcessor{p}
+}
+
+type tReverseProxyContextProcessor struct {
+	proxy *TReverseProxy
+}
+
+func (p *tReverseProxyContextProcessor) Process(ctx context.Context, in, out TProtocol) (bool, TException) {
+	return p.proxy.ProcessContext(ctx, in, out)
+}
+
+// A pool of servers calls are forwarded to, taken in turn. Each connection
+// carries one call at a time, with a sequence id of the backend's own.
+type TProxyBackend struct {
+	name             string
+	addrs            []string
+	transportFactory TTransportFactory
+	protocolFactory  TProtocolFactory
+	seqId            int32
+	next             uint32
+
+	mu             sync.Mutex
+	idle           []*tProxyBackendConn
+	maxIdle        int
+	connectTimeout time.Duration
+	closed         bool
+}
+
+// Creates a backend calling the servers at addrs, each connection being
+// wrapped with transportFactory, for framing, and protocolFactory.
+func NewTProxyBackend(name string, addrs []string, transportFactory TTransportFactory, protocolFactory TProtocolFactory) *TProxyBackend {
+	return &TProxyBackend{
+		name:             name,
+		addrs:            addrs,
+		transportFactory: transportFactory,
+		protocolFactory:  protocolFactory,
+		maxIdle:          DEFAULT_PROXY_MAX_IDLE,
+	}
+}
+
+func (p *TProxyBackend) Name() string {
+	return p.name
+}
+
+// Sets how many connections are kept open between calls.
+func (p *TProxyBackend) SetMaxIdle(maxIdle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxIdle = maxIdle
+}
+
+// Sets how long connecting to a server may take. Connecting also counts
+// towards the route's timeout. Zero means no limit of its own.
+func (p *TProxyBackend) SetConnectTimeout(timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connectTimeout = timeout
+}
+
+// Closes the idle connections. Connections in use are closed once their
+// call completes.
+func (p *TProxyBackend) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, conn := range idle {
+		conn.trans.Close()
+	}
+	return nil
+}
+
+type tProxyBackendConn struct {
+	socket *TSocket
+	trans  TTransport
+	prot   TProtocol
+}
+
+var errProxyBackendClosed = errors.New("backend closed")
+
+func (p *TProxyBackend) get(ctx context.Context) (*tProxyBackendConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errProxyBackendClosed
+	}
+	if n := len(p.idle); n > 0 {
+		conn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	timeout := p.connectTimeout
+	p.mu.Unlock()
+	if len(p.addrs) == 0 {
+		return nil, NewTTransportException(NOT_OPEN, "No backend servers")
+	}
+	addr := p.addrs[int(atomic.AddUint32(&p.next, 1)-1)%len(p.addrs)]
+	dialer := &net.Dialer{Timeout: timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, NewTTransportException(NOT_OPEN, err.Error())
+	}
+	socket := NewTSocketFromConnTimeout(netConn, 0)
+	trans := p.transportFactory.GetTransport(socket)
+	return &tProxyBackendConn{socket: socket, trans: trans, prot: p.protocolFactory.GetProtocol(trans)}, nil
+}
+
+func (p *TProxyBackend) put(conn *tProxyBackendConn) {
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, conn)
+		conn = nil
+	}
+	p.mu.Unlock()
+	if conn != nil {
+		conn.trans.Close()
+	}
+}
+
+// call forwards a message whose arguments are payload and returns the type
+// and body of the reply, or nothing for oneway calls. The connection used
+// is interrupted when ctx is done.
+func (p *TProxyBackend) call(ctx context.Context, name string, typeId TMessageType, payload []byte) (TMessageType, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	conn, err := p.get(ctx)
+	if err != nil {
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	conn.socket.SetTimeout(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.socket.SetTimeout(time.Until(deadline))
+	}
+	netConn := conn.socket.Conn()
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+	replyType, reply, err := p.exchange(conn, name, typeId, payload)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.trans.Close()
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	p.put(conn)
+	return replyType, reply, nil
+}
+
+func (p *TProxyBackend) exchange(conn *tProxyBackendConn, name string, typeId TMessageType, payload []byte) (TMessageType, []byte, error) {
+	seqId := atomic.AddInt32(&p.seqId, 1)
+	if err := conn.prot.WriteMessageBegin(name, typeId, seqId); err != nil {
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	if err := writeProxyPayload(conn.prot, payload); err != nil {
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	if err := conn.prot.WriteMessageEnd(); err != nil {
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	if err := conn.prot.Flush(); err != nil {
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	if typeId == ONEWAY {
+		return INVALID_TMESSAGE_TYPE, nil, nil
+	}
+	replyName, replyType, replySeqId, err := conn.prot.ReadMessageBegin()
+	if err != nil {
+		return INVALID_TMESSAGE_TYPE, nil, err
+	}
+	if replyName != name {
+		return INVALID_TMESSAGE_TYPE, nil, NewTApplicationException(WRONG_METHOD_NAME, fmt.Sprintf("Reply for %s received for %s", replyName, name))
+	}
+	if replySeqId != seqId {
+		return INVALID_TMESSAGE_TYPE, nil, NewTApplicationException(BAD_SEQUENCE_ID, fmt.Sprintf("Reply with sequence id %d received for %d", replySeqId, seqId))
+	}
+	if replyType != REPLY && replyType != EXCEPTION {
+		return INVALID_TMESSAGE_TYPE, nil, NewTApplicationException(INVALID_MESSAGE_TYPE_EXCEPTION, fmt.Sprintf("Invalid reply type %d for %s", replyType, name))
+	}
+	reply, err := readProxyPayload(conn.prot)
+	return replyType, reply, err
+}
+
+// readProxyPayload reads the body and end of a message from in, returning
+// the body encoded with TBinaryProtocol. If in uses TBinaryProtocol, the
+// bytes are copied as they are read rather than decoded and encoded again.
+func readProxyPayload(in TProtocol) ([]byte, error) {
+	buf := NewTMemoryBuffer()
+	if binary, ok := unwrapProxyProtocol(in).(*TBinaryProtocol); ok {
+		tee := NewTBinaryProtocolTransport(&tProxyTeeTransport{TTransport: binary.Transport(), copy: buf})
+		if err := Skip(tee, STRUCT, maxProxyDepth); err != nil {
+			return nil, err
+		}
+	} else if err := copyProxyValue(in, NewTBinaryProtocolTransport(buf), STRUCT, maxProxyDepth); err != nil {
+		return nil, err
+	}
+	if err := in.ReadMessageEnd(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeProxyPayload writes a message body read by readProxyPayload to out,
+// as is if out uses TBinaryProtocol.
+func writeProxyPayload(out TProtocol, payload []byte) error {
+	if binary, ok := unwrapProxyProtocol(out).(*TBinaryProtocol); ok {
+		_, err := binary.Transport().Write(payload)
+		return NewTTransportExceptionFromError(err)
+	}
+	return copyProxyValue(NewTBinaryProtocolTransport(&TMemoryBuffer{Buffer: bytes.NewBuffer(payload)}), out, STRUCT, maxProxyDepth)
+}
+
+// unwrapProxyProtocol returns the protocol underneath the wrappers servers
+// and middleware add around prot.
+func unwrapProxyProtocol(prot TProtocol) TProtocol {
+	for {
+		w, ok := prot.(interface {
+			wrappedProtocol() TProtocol
+		})
+		if !ok {
+			return prot
+		}
+		prot = w.wrappedProtocol()
+	}
+}
+
+// Copies the bytes read from a transport to copy.
+type tProxyTeeTransport struct {
+	TTransport
+	copy io.Writer
+}
+
+func (p *tProxyTeeTransport) Read(buf []byte) (int, error) {
+	n, err := p.TTransport.Read(buf)
+	p.copy.Write(buf[:n])
+	return n, err
+}
+
+// copyProxyValue reads a value of type typeId from in and writes it to out.
+func copyProxyValue(in, out TProtocol, typeId TType, depth int) error {
+	if depth <= 0 {
+		return NewTProtocolExceptionWithType(INVALID_DATA, errors.New("Value nested too deeply"))
+	}
+	switch typeId {
+	case BOOL:
+		v, err := in.ReadBool()
+		if err != nil {
+			return err
+		}
+		return out.WriteBool(v)
+	case BYTE:
+		v, err := in.ReadByte()
+		if err != nil {
+			return err
+		}
+		return out.WriteByte(v)
+	case I16:
+		v, err := in.ReadI16()
+		if err != nil {
+			return err
+		}
+		return out.WriteI16(v)
+	case I32:
+		v, err := in.ReadI32()
+		if err != nil {
+			return err
+		}
+		return out.WriteI32(v)
+	case I64:
+		v, err := in.ReadI64()
+		if err != nil {
+			return err
+		}
+		return out.WriteI64(v)
+	case DOUBLE:
+		v, err := in.ReadDouble()
+		if err != nil {
+			return err
+		}
+		return out.WriteDouble(v)
+	case STRING:
+		v, err := in.ReadString()
+		if err != nil {
+			return err
+		}
+		return out.WriteString(v)
+	case STRUCT:
+		if _, err := in.ReadStructBegin(); err != nil {
+			return err
+		}
+		if err := out.WriteStructBegin(""); err != nil {
+			return err
+		}
+		for {
+			_, fieldType, id, err := in.ReadFieldBegin()
+			if err != nil {
+				return err
+			}
+			if fieldType == STOP {
+				break
+			}
+			if err := out.WriteFieldBegin("", fieldType, id); err != nil {
+				return err
+			}
+			if err := copyProxyValue(in, out, fieldType, depth-1); err != nil {
+				return err
+			}
+			if err := in.ReadFieldEnd(); err != nil {
+				return err
+			}
+			if err := out.WriteFieldEnd(); err != nil {
+				return err
+			}
+		}
+		if err := out.WriteFieldStop(); err != nil {
+			return err
+		}
+		if err := in.ReadStructEnd(); err != nil {
+			return err
+		}
+		return out.WriteStructEnd()
+	case MAP:
+		keyType, valueType, size, err := in.ReadMapBegin()
+		if err != nil {
+			return err
+		}
+		if err := out.WriteMapBegin(keyType, valueType, size); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err := copyProxyValue(in, out, keyType, depth-1); err != nil {
+				return err
+			}
+			if err := copyProxyValue(in, out, valueType, depth-1); err != nil {
+				return err
+			}
+		}
+		if err := in.ReadMapEnd(); err != nil {
+			return err
+		}
+		return out.WriteMapEnd()
+	case SET:
+		elemType, size, err := in.ReadSetBegin()
+		if err != nil {
+			return err
+		}
+		if err := out.WriteSetBegin(elemType, size); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err := copyProxyValue(in, out, elemType, depth-1); err != nil {
+				return err
+			}
+		}
+		if err := in.ReadSetEnd(); err != nil {
+			return err
+		}
+		return out.WriteSetEnd()
+	case LIST:
+		elemType, size, err := in.ReadListBegin()
+		if err != nil {
+			return err
+		}
+		if err := out.WriteListBegin(elemType, size); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err := copyProxyValue(in, out, elemType, depth-1); err != nil {
+				return err
+			}
+		}
+		if err := in.ReadListEnd(); err != nil {
+			return err
+		}
+		return out.WriteListEnd()
+	}
+	return NewTProtocolExceptionWithType(INVALID_DATA, fmt.Errorf("Unknown type %d", typeId))
+}
@@ -0,0 +1,321 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A backend answering calls like sleepProcessor and reporting the name and
+// sequence id of each on calls.
+type testProxyBackend struct {
+	*TProxyBackend
+	calls  chan *TCall
+	server *TSimpleServer
+	done   chan error
+}
+
+func startTestProxyBackend(t *testing.T, name string, transportFactory TTransportFactory, protocolFactory TProtocolFactory) *testProxyBackend {
+	backend := &testProxyBackend{calls: make(chan *TCall, 10)}
+	record := func(next TCallHandler) TCallHandler {
+		return func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+			backend.calls <- call
+			return next(ctx, call, in, out)
+		}
+	}
+	serverSocket, addr := newTestServerSocket(t)
+	backend.server = NewTSimpleServer4(WrapProcessor(&sleepProcessor{}, record), serverSocket, transportFactory, protocolFactory)
+	backend.done = startServing(t, backend.server, serverSocket)
+	backend.TProxyBackend = NewTProxyBackend(name, []string{addr}, transportFactory, protocolFactory)
+	return backend
+}
+
+func (p *testProxyBackend) stop(t *testing.T) {
+	p.Close()
+	p.server.Stop()
+	waitServe(t, p.done)
+}
+
+func (p *testProxyBackend) expectCall(t *testing.T, name string) *TCall {
+	select {
+	case call := <-p.calls:
+		if call.Name != name {
+			t.Errorf("Expected %s to receive %s, got %s", p.Name(), name, call.Name)
+		}
+		return call
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %s to receive %s", p.Name(), name)
+		return nil
+	}
+}
+
+func (p *testProxyBackend) expectNoCall(t *testing.T) {
+	select {
+	case call := <-p.calls:
+		t.Errorf("Unexpected call to %s: %s", p.Name(), call.Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReverseProxyRouting(t *testing.T) {
+	calc := startTestProxyBackend(t, "calc", NewTFramedTransportFactory(NewTTransportFactory()), NewTCompactProtocolFactory())
+	defer calc.stop(t)
+	other := startTestProxyBackend(t, "other", NewTTransportFactory(), NewTBinaryProtocolFactoryDefault())
+	defer other.stop(t)
+	proxy := NewTReverseProxy()
+	proxy.SetLogger(discardLogger())
+	proxy.AddRoute(&TProxyRoute{Service: "calc", StripService: true, Backend: calc.TProxyBackend})
+	proxy.AddRoute(&TProxyRoute{Method: "ping", Backend: other.TProxyBackend})
+	proxy.AddRoute(&TProxyRoute{Prefix: "log", Backend: other.TProxyBackend})
+	server, addr, done := startTestServer(t, proxy)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+	client := openTestClient(t, addr)
+	defer client.Transport().Close()
+
+	for i, test := range []struct {
+		name    string
+		backend *testProxyBackend
+		forward string
+	}{
+		{"calc:add", calc, "add"},
+		{"calc:add", calc, "add"},
+		{"ping", other, "ping"},
+		{"stats:ping", other, "stats:ping"},
+		{"logEvent", other, "logEvent"},
+	} {
+		seqId := int32(1000 + i)
+		if err := sendTestCall(client, test.name, seqId, 0); err != nil {
+			t.Fatalf("Unable to send call: %v", err)
+		}
+		name, typeId, replySeqId, err := readTestReply(client)
+		if err != nil || name != test.name || typeId != REPLY || replySeqId != seqId {
+			t.Errorf("Unexpected reply to %s: %s %d %d %v", test.name, name, typeId, replySeqId, err)
+		}
+		if call := test.backend.expectCall(t, test.forward); call != nil && call.SeqId == seqId {
+			t.Errorf("Expected the sequence id of %s to be rewritten", test.name)
+		}
+	}
+	calc.expectNoCall(t)
+	other.expectNoCall(t)
+
+	if err := callTestServer(client, "unknown", 1, 0); err == nil {
+		t.Error("Expected a call matching no route to fail")
+	} else if exc, ok := err.(TApplicationException); !ok || exc.TypeId() != UNKNOWN_METHOD {
+		t.Errorf("Expected an UNKNOWN_METHOD exception, got %v", err)
+	}
+
+	if err := sendTestCall(client, "calc:add", 1, 0); err != nil {
+		t.Fatalf("Unable to send call: %v", err)
+	}
+	if _, _, _, err := readTestReply(client); err != nil {
+		t.Errorf("Call failed after an unknown method: %v", err)
+	}
+}
+
+func TestReverseProxyTimeoutAndShadow(t *testing.T) {
+	primary := startTestProxyBackend(t, "primary", NewTTransportFactory(), NewTBinaryProtocolFactoryDefault())
+	defer primary.stop(t)
+	shadow := startTestProxyBackend(t, "shadow", NewTFramedTransportFactory(NewTTransportFactory()), NewTCompactProtocolFactory())
+	defer shadow.stop(t)
+	proxy := NewTReverseProxy()
+	proxy.SetLogger(discardLogger())
+	proxy.AddRoute(&TProxyRoute{Method: "mirrored", Backend: primary.TProxyBackend, Shadow: shadow.TProxyBackend, ShadowRate: 0.5})
+	proxy.AddRoute(&TProxyRoute{Backend: primary.TProxyBackend, Timeout: 100 * time.Millisecond})
+	random := 0.7
+	proxy.random = func() float64 { return random }
+	server, addr, done := startTestServer(t, proxy)
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+	client := openTestClient(t, addr)
+	defer client.Transport().Close()
+
+	if err := callTestServer(client, "mirrored", 1, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	primary.expectCall(t, "mirrored")
+	shadow.expectNoCall(t)
+	random = 0.2
+	if err := callTestServer(client, "mirrored", 2, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	primary.expectCall(t, "mirrored")
+	shadow.expectCall(t, "mirrored")
+
+	start := time.Now()
+	err := callTestServer(client, "slow", 3, 500)
+	if exc, ok := err.(TApplicationException); !ok || exc.TypeId() != INTERNAL_ERROR {
+		t.Errorf("Expected an INTERNAL_ERROR exception for a call timing out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Call timed out after %v", elapsed)
+	}
+	primary.expectCall(t, "slow")
+	if err := callTestServer(client, "fast", 4, 0); err != nil {
+		t.Errorf("Call after a timeout failed: %v", err)
+	}
+	primary.expectCall(t, "fast")
+
+	if err := client.WriteMessageBegin("notify", ONEWAY, 5); err != nil {
+		t.Fatalf("Unable to send oneway call: %v", err)
+	}
+	client.WriteStructBegin("args")
+	client.WriteFieldStop()
+	client.WriteStructEnd()
+	client.WriteMessageEnd()
+	client.Flush()
+	primary.expectCall(t, "notify")
+}
+
+func TestCopyProxyValue(t *testing.T) {
+	buf := NewTMemoryBuffer()
+	prot := NewTBinaryProtocolTransport(buf)
+	prot.WriteStructBegin("args")
+	prot.WriteFieldBegin("flag", BOOL, 1)
+	prot.WriteBool(true)
+	prot.WriteFieldEnd()
+	prot.WriteFieldBegin("values", MAP, 2)
+	prot.WriteMapBegin(STRING, LIST, 1)
+	prot.WriteString("key")
+	prot.WriteListBegin(DOUBLE, 2)
+	prot.WriteDouble(1.5)
+	prot.WriteDouble(-2)
+	prot.WriteListEnd()
+	prot.WriteMapEnd()
+	prot.WriteFieldEnd()
+	prot.WriteFieldBegin("nested", STRUCT, 7)
+	prot.WriteStructBegin("nested")
+	prot.WriteFieldBegin("ids", SET, 1)
+	prot.WriteSetBegin(I64, 1)
+	prot.WriteI64(1 << 40)
+	prot.WriteSetEnd()
+	prot.WriteFieldEnd()
+	prot.WriteFieldBegin("small", I16, 2)
+	prot.WriteI16(-3)
+	prot.WriteFieldEnd()
+	prot.WriteFieldBegin("byte", BYTE, 3)
+	prot.WriteByte(9)
+	prot.WriteFieldEnd()
+	prot.WriteFieldStop()
+	prot.WriteStructEnd()
+	prot.WriteFieldEnd()
+	prot.WriteFieldStop()
+	prot.WriteStructEnd()
+	original := append([]byte(nil), buf.Bytes()...)
+
+	for _, factory := range []TProtocolFactory{NewTCompactProtocolFactory(), NewTJSONProtocolFactory()} {
+		translated := NewTMemoryBuffer()
+		if err := copyProxyValue(NewTBinaryProtocolTransport(NewTMemoryBuffer()), factory.GetProtocol(translated), STRUCT, 1); err == nil {
+			t.Error("Expected copying to fail beyond the depth limit")
+		}
+		translated.Reset()
+		out := factory.GetProtocol(translated)
+		if err := copyProxyValue(NewTBinaryProtocolTransport(&TMemoryBuffer{Buffer: bytes.NewBuffer(original)}), out, STRUCT, maxProxyDepth); err != nil {
+			t.Fatalf("Unable to translate to %T: %v", factory, err)
+		}
+		out.Flush()
+		back := NewTMemoryBuffer()
+		if err := copyProxyValue(factory.GetProtocol(translated), NewTBinaryProtocolTransport(back), STRUCT, maxProxyDepth); err != nil {
+			t.Fatalf("Unable to translate from %T: %v", factory, err)
+		}
+		if !bytes.Equal(back.Bytes(), original) {
+			t.Errorf("Value changed translating through %T", factory)
+		}
+	}
+}
+
+func TestWriteProxyPayloadRawUnderServer(t *testing.T) {
+	buf := NewTMemoryBuffer()
+	_, out := newTServerProtocols(NewTBinaryProtocolTransport(NewTMemoryBuffer()), NewTBinaryProtocolTransport(buf), &tServerConn{}, false)
+	// Not a valid struct, so it only gets through unchanged if written raw.
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	if err := writeProxyPayload(&tReplyRecordingProtocol{TProtocol: out, call: &TCall{}}, payload); err != nil {
+		t.Fatalf("Unable to write payload: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Errorf("Expected the payload written raw, got %x", buf.Bytes())
+	}
+}
+
+// A protocol wrapper refusing to decode fields, so that only payloads
+// copied raw get past it.
+type undecodableProtocol struct {
+	TProtocol
+}
+
+func (p *undecodableProtocol) wrappedProtocol() TProtocol {
+	return p.TProtocol
+}
+
+func (p *undecodableProtocol) ReadFieldBegin() (string, TType, int16, error) {
+	return "", STOP, 0, errors.New("field decoded")
+}
+
+func TestReadProxyPayloadRaw(t *testing.T) {
+	buf := NewTMemoryBuffer()
+	prot := NewTBinaryProtocolTransport(buf)
+	prot.WriteStructBegin("args")
+	prot.WriteFieldBegin("name", STRING, 1)
+	prot.WriteString("value")
+	prot.WriteFieldEnd()
+	prot.WriteFieldBegin("items", LIST, 2)
+	prot.WriteListBegin(I64, 2)
+	prot.WriteI64(1)
+	prot.WriteI64(2)
+	prot.WriteListEnd()
+	prot.WriteFieldEnd()
+	prot.WriteFieldStop()
+	prot.WriteStructEnd()
+	expected := append([]byte(nil), buf.Bytes()...)
+	buf.WriteString("trailing")
+
+	payload, err := readProxyPayload(&undecodableProtocol{prot})
+	if err != nil {
+		t.Fatalf("Unable to read payload: %v", err)
+	}
+	if !bytes.Equal(payload, expected) {
+		t.Errorf("Expected payload %x, got %x", expected, payload)
+	}
+}
+
+func TestReverseProxyLoggerDefault(t *testing.T) {
+	proxy := NewTReverseProxy()
+	proxy.SetLogger(nil)
+	if proxy.Logger() != DefaultLogger() {
+		t.Error("Reverse proxy does not fall back to the default logger")
+	}
+}
+
+func TestProxyBackendDialHonoursContext(t *testing.T) {
+	backend := NewTProxyBackend("test", []string{"127.0.0.1:1"}, NewTTransportFactory(), NewTBinaryProtocolFactoryDefault())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := backend.get(ctx); err != context.Canceled {
+		t.Errorf("Expected connecting to stop with the context, got %v", err)
+	}
+}
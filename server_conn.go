@@ -0,0 +1,506 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tServerConn wraps a transport accepted by a server and tracks whether a
+// request is in progress on it, so that idle connections can be closed
+// during shutdown without cutting off requests in flight.
+type tServerConn struct {
+	TTransport
+	// State created for the connection by the server's TServerEventHandler.
+	serverContext interface{}
+	// Called when the first data of a request arrives.
+	onRequest func()
+	// Told of the calls read from the connection, if not nil.
+	metrics TMetricsCollector
+	// Bytes read from and written to the connection, updated atomically.
+	bytesRead    int64
+	bytesWritten int64
+
+	// The network connection underneath, used to notice the client going
+	// away while a handler runs, and the function cancelling the
+	// connection's context when it does.
+	netConn  net.Conn
+	cancel   context.CancelFunc
+	watching chan struct{}
+	// Data and error the watcher read on behalf of the next Read.
+	pushback []byte
+	readErr  error
+
+	mu     sync.Mutex
+	active bool
+	closed bool
+	// The method of the call last read, for log messages.
+	method string
+	// Whether a request has started arriving but has not been read in
+	// full.
+	reading bool
+	// Why the connection is to be closed once idle, if it has reached its
+	// maximum age or number of requests.
+	drainReason string
+	requests    int
+
+	limits      tConnLimits
+	onLimit     func(reason string)
+	idleTimer   *time.Timer
+	headerTimer *time.Timer
+	ageTimer    *time.Timer
+	// Requests read in full but not yet answered, for servers that process
+	// several requests of a connection at once.
+	pending int
+}
+
+// Limits on a connection's lifetime. Zero values mean no limit.
+type tConnLimits struct {
+	idleTimeout   time.Duration
+	headerTimeout time.Duration
+	maxAge        time.Duration
+	maxRequests   int
+}
+
+func newTServerConn(client TTransport) *tServerConn {
+	return &tServerConn{TTransport: client}
+}
+
+// startLimits starts enforcing limits on the connection, which must be
+// idle. onLimit is told why the connection is closed when a limit is
+// reached.
+func (p *tServerConn) startLimits(limits tConnLimits, onLimit func(reason string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limits = limits
+	p.onLimit = onLimit
+	if limits.maxAge > 0 {
+		p.ageTimer = time.AfterFunc(limits.maxAge, func() {
+			p.mu.Lock()
+			if p.drainReason == "" {
+				p.drainReason = "max connection age"
+			}
+			closed, reason := p.updateLocked(), p.drainReason
+			p.mu.Unlock()
+			if closed {
+				p.limitReached(reason)
+			}
+		})
+	}
+	p.updateLocked()
+}
+
+// stopLimits stops the timers started by startLimits.
+func (p *tServerConn) stopLimits() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range []*time.Timer{p.idleTimer, p.headerTimer, p.ageTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	p.idleTimer, p.headerTimer, p.ageTimer = nil, nil, nil
+}
+
+// updateLocked applies the limits after the connection's state changed:
+// it closes a draining connection once it is idle and starts or stops the
+// idle and header timers. It reports whether it closed the connection.
+// Must be called with p.mu held.
+func (p *tServerConn) updateLocked() bool {
+	idle := !p.active && p.pending == 0
+	if idle && p.drainReason != "" && !p.closed {
+		p.interrupt()
+		return true
+	}
+	if idle && p.limits.idleTimeout > 0 && p.idleTimer == nil && !p.closed {
+		p.idleTimer = time.AfterFunc(p.limits.idleTimeout, func() {
+			p.mu.Lock()
+			closed := false
+			if p.idleTimer != nil && !p.active && p.pending == 0 && !p.closed {
+				p.interrupt()
+				closed = true
+			}
+			p.mu.Unlock()
+			if closed {
+				p.limitReached("idle timeout")
+			}
+		})
+	} else if !idle && p.idleTimer != nil {
+		p.idleTimer.Stop()
+		p.idleTimer = nil
+	}
+	if p.reading && p.limits.headerTimeout > 0 && p.headerTimer == nil {
+		p.headerTimer = time.AfterFunc(p.limits.headerTimeout, func() {
+			p.mu.Lock()
+			closed := false
+			if p.headerTimer != nil && p.reading && !p.closed {
+				p.interrupt()
+				if p.cancel != nil {
+					p.cancel()
+				}
+				closed = true
+			}
+			p.mu.Unlock()
+			if closed {
+				p.limitReached("request header timeout")
+			}
+		})
+	} else if !p.reading && p.headerTimer != nil {
+		p.headerTimer.Stop()
+		p.headerTimer = nil
+	}
+	return false
+}
+
+func (p *tServerConn) limitReached(reason string) {
+	if p.onLimit != nil {
+		p.onLimit(reason)
+	}
+}
+
+// requestRead marks the request that was arriving as read in full, and
+// counts it against the connection's maximum number of requests. Must be
+// called with p.mu held.
+func (p *tServerConn) requestReadLocked() {
+	p.reading = false
+	p.requests++
+	if p.limits.maxRequests > 0 && p.requests >= p.limits.maxRequests {
+		p.drainReason = "max requests per connection"
+	}
+}
+
+func (p *tServerConn) requestRead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.reading {
+		return
+	}
+	p.requestReadLocked()
+	p.updateLocked()
+}
+
+// Returns whether the connection is to be closed once idle.
+func (p *tServerConn) isDraining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.drainReason != ""
+}
+
+// Returns whether the server closed the connection.
+func (p *tServerConn) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *tServerConn) Read(buf []byte) (int, error) {
+	p.stopWatch()
+	var n int
+	var err error
+	if len(p.pushback) > 0 {
+		n = copy(buf, p.pushback)
+		p.pushback = p.pushback[n:]
+	} else if p.readErr != nil {
+		err = p.readErr
+	} else {
+		n, err = p.TTransport.Read(buf)
+	}
+	if n > 0 {
+		atomic.AddInt64(&p.bytesRead, int64(n))
+		p.mu.Lock()
+		started := !p.active
+		p.active = true
+		if started {
+			p.reading = true
+			p.updateLocked()
+		}
+		p.mu.Unlock()
+		if started && p.onRequest != nil {
+			p.onRequest()
+		}
+	}
+	return n, err
+}
+
+func (p *tServerConn) Write(buf []byte) (int, error) {
+	n, err := p.TTransport.Write(buf)
+	atomic.AddInt64(&p.bytesWritten, int64(n))
+	return n, err
+}
+
+// byteCounts returns the number of bytes read from and written to the
+// connection so far.
+func (p *tServerConn) byteCounts() (int64, int64) {
+	return atomic.LoadInt64(&p.bytesRead), atomic.LoadInt64(&p.bytesWritten)
+}
+
+// newContext creates the context handed to the processor for calls on this
+// connection, carrying the connection's details. The context is cancelled
+// when the connection is closed by the server or the client goes away
+// during a call.
+func (p *tServerConn) newContext() (context.Context, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.mu.Lock()
+	p.cancel = cancel
+	if p.closed {
+		cancel()
+	}
+	p.mu.Unlock()
+	info, err := newServerConnectionInfo(ctx, p.TTransport)
+	if err != nil {
+		return ctx, err
+	}
+	p.netConn = netConnOf(p.TTransport)
+	ctx = NewContextWithConnectionInfo(ctx, info)
+	if identity := newPeerIdentity(info.TLS); identity != nil {
+		ctx = NewContextWithPeerIdentity(ctx, identity)
+	}
+	return ctx, nil
+}
+
+func (p *tServerConn) remoteAddr() net.Addr {
+	// Closing the transport may drop its connection; prefer the one kept
+	// since the context was created.
+	if p.netConn != nil {
+		return p.netConn.RemoteAddr()
+	}
+	if conn := netConnOf(p.TTransport); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (p *tServerConn) setMethod(name string) {
+	p.mu.Lock()
+	p.method = name
+	p.mu.Unlock()
+}
+
+func (p *tServerConn) lastMethod() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.method
+}
+
+func (p *tServerConn) cancelContext() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+// Marks the end of a request; the connection is idle until more data
+// arrives.
+func (p *tServerConn) setIdle() {
+	p.mu.Lock()
+	p.active = false
+	p.reading = false
+	closed, reason := p.updateLocked(), p.drainReason
+	p.mu.Unlock()
+	if closed {
+		p.limitReached(reason)
+	}
+}
+
+// Marks a request as read and still being processed. The connection counts
+// as busy until the matching call to endRequest.
+func (p *tServerConn) beginRequest() {
+	p.mu.Lock()
+	p.pending++
+	p.active = false
+	p.requestReadLocked()
+	p.updateLocked()
+	p.mu.Unlock()
+}
+
+func (p *tServerConn) endRequest() {
+	p.mu.Lock()
+	p.pending--
+	closed, reason := p.updateLocked(), p.drainReason
+	p.mu.Unlock()
+	if closed {
+		p.limitReached(reason)
+	}
+}
+
+func (p *tServerConn) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return p.TTransport.Close()
+}
+
+// closeIfIdle closes the connection unless a request is in progress and
+// reports whether it did.
+func (p *tServerConn) closeIfIdle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active || p.pending > 0 {
+		return false
+	}
+	p.interrupt()
+	return true
+}
+
+// forceClose closes the connection even if a request is in progress, and
+// cancels its context.
+func (p *tServerConn) forceClose() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interrupt()
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+// startWatch starts watching for the client going away while the request
+// that was just read is handled, cancelling the connection's context if it
+// does. Nothing else may read from the connection until stopWatch.
+func (p *tServerConn) startWatch() {
+	if p.netConn == nil || p.cancel == nil || p.watching != nil || len(p.pushback) > 0 || p.readErr != nil {
+		return
+	}
+	// Clear any deadline left by the transport, so that only stopWatch
+	// makes the read time out.
+	p.netConn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	p.watching = done
+	go func() {
+		defer close(done)
+		var b [1]byte
+		n, err := p.netConn.Read(b[:])
+		p.pushback = append(p.pushback, b[:n]...)
+		if err == nil {
+			return
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return
+		}
+		p.readErr = NewTTransportExceptionFromError(err)
+		p.cancel()
+	}()
+}
+
+// stopWatch stops the watcher started by startWatch and waits for it.
+func (p *tServerConn) stopWatch() {
+	if p.watching == nil {
+		return
+	}
+	p.netConn.SetReadDeadline(time.Now())
+	<-p.watching
+	p.watching = nil
+	p.netConn.SetReadDeadline(time.Time{})
+}
+
+// interrupt unblocks any goroutine reading from the connection. Transports
+// that support it are interrupted rather than closed, as closing races with
+// the reading goroutine. Must be called with p.mu held.
+func (p *tServerConn) interrupt() {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if i, ok := p.TTransport.(interface {
+		Interrupt() error
+	}); ok {
+		i.Interrupt()
+		return
+	}
+	p.TTransport.Close()
+}
+
+// tServerCall records how far the call being processed on a pair of
+// tServerProtocols has got, so that a server can tell whether a failed call
+// can still be answered.
+type tServerCall struct {
+	name   string
+	typeId TMessageType
+	seqId  int32
+	// When the call's header was read.
+	start time.Time
+	// Whether the call's header and all of it have been read, and whether a
+	// reply has begun to be written.
+	begun        bool
+	read         bool
+	replyStarted bool
+	replyType    TMessageType
+	// Whether processing the call panicked.
+	panicked bool
+}
+
+// tServerProtocol wraps the protocols a server hands to its processor. It
+// gives access to the connection's state, tracks the progress of the call
+// and lets the connection watch for the client going away between reading
+// a call and replying to it.
+type tServerProtocol struct {
+	TProtocol
+	conn  *tServerConn
+	call  *tServerCall
+	watch bool
+}
+
+// newTServerProtocols wraps the input and output protocols of a call.
+func newTServerProtocols(in, out TProtocol, conn *tServerConn, watch bool) (*tServerProtocol, *tServerProtocol) {
+	call := &tServerCall{}
+	return &tServerProtocol{TProtocol: in, conn: conn, call: call, watch: watch},
+		&tServerProtocol{TProtocol: out, conn: conn, call: call, watch: watch}
+}
+
+func (p *tServerProtocol) wrappedProtocol() TProtocol {
+	return p.TProtocol
+}
+
+func (p *tServerProtocol) ReadMessageBegin() (string, TMessageType, int32, error) {
+	name, typeId, seqId, err := p.TProtocol.ReadMessageBegin()
+	if err == nil {
+		*p.call = tServerCall{name: name, typeId: typeId, seqId: seqId, start: time.Now(), begun: true}
+		p.conn.setMethod(name)
+		if p.conn.metrics != nil {
+			p.conn.metrics.CallStarted(name)
+		}
+	}
+	return name, typeId, seqId, err
+}
+
+func (p *tServerProtocol) ReadMessageEnd() error {
+	err := p.TProtocol.ReadMessageEnd()
+	if err == nil {
+		p.call.read = true
+		if p.watch {
+			p.conn.requestRead()
+			p.conn.startWatch()
+		}
+	}
+	return err
+}
+
+func (p *tServerProtocol) WriteMessageBegin(name string, typeId TMessageType, seqId int32) error {
+	if p.watch {
+		p.conn.stopWatch()
+	}
+	p.call.replyStarted = true
+	p.call.replyType = typeId
+	return p.TProtocol.WriteMessageBegin(name, typeId, seqId)
+}
@@ -0,0 +1,138 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"testing"
+	"time"
+)
+
+// expectClosed checks that the server closes the connection of prot within
+// a second.
+func expectClosed(t *testing.T, prot TProtocol) {
+	start := time.Now()
+	var b [1]byte
+	if _, err := prot.Transport().Read(b[:]); err == nil {
+		t.Error("Expected the connection to be closed")
+	} else if time.Since(start) > time.Second {
+		t.Errorf("Connection not closed: %v", err)
+	}
+}
+
+func startLimitedTestServer(t *testing.T, configure func(*TSimpleServer)) (*TSimpleServer, string, chan error) {
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTSimpleServer2(&sleepProcessor{}, serverSocket)
+	configure(server)
+	return server, addr, startServing(t, server, serverSocket)
+}
+
+func TestSimpleServerIdleTimeout(t *testing.T) {
+	server, addr, done := startLimitedTestServer(t, func(s *TSimpleServer) {
+		s.SetIdleTimeout(100 * time.Millisecond)
+	})
+	prot := openTestClient(t, addr)
+	// A call running longer than the idle timeout is not cut off.
+	if err := callTestServer(prot, "slow", 1, 200); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := callTestServer(prot, "fast", 2, 0); err != nil {
+		t.Fatalf("Call within the idle timeout failed: %v", err)
+	}
+	expectClosed(t, prot)
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestSimpleServerMaxRequestsPerConnection(t *testing.T) {
+	server, addr, done := startLimitedTestServer(t, func(s *TSimpleServer) {
+		s.SetMaxRequestsPerConnection(2)
+	})
+	prot := openTestClient(t, addr)
+	for i := int32(1); i <= 2; i++ {
+		if err := callTestServer(prot, "call", i, 0); err != nil {
+			t.Fatalf("Call %d failed: %v", i, err)
+		}
+	}
+	expectClosed(t, prot)
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestSimpleServerMaxConnectionAge(t *testing.T) {
+	server, addr, done := startLimitedTestServer(t, func(s *TSimpleServer) {
+		s.SetMaxConnectionAge(100 * time.Millisecond)
+	})
+	prot := openTestClient(t, addr)
+	// The call in progress when the connection expires is answered.
+	if err := callTestServer(prot, "slow", 1, 200); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	expectClosed(t, prot)
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestSimpleServerRequestHeaderTimeout(t *testing.T) {
+	server, addr, done := startLimitedTestServer(t, func(s *TSimpleServer) {
+		s.SetRequestHeaderTimeout(100 * time.Millisecond)
+	})
+	prot := openTestClient(t, addr)
+	if err := callTestServer(prot, "call", 1, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	// Send the start of a header and stall.
+	prot.Transport().Write([]byte{0x80, 0x01})
+	prot.Transport().Flush()
+	expectClosed(t, prot)
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestPipelinedServerMaxRequestsPerConnection(t *testing.T) {
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTPipelinedServer2(&sleepProcessor{}, serverSocket)
+	server.SetMaxRequestsPerConnection(2)
+	done := startServing(t, server, serverSocket)
+	socket, err := NewTSocketTimeout(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create client socket: %s", err)
+	}
+	if err := socket.Open(); err != nil {
+		t.Fatalf("Unable to connect to %s: %s", addr, err)
+	}
+	client := NewTBinaryProtocolTransport(NewTFramedTransport(socket))
+	defer client.Transport().Close()
+	sendTestCall(client, "slow", 1, 100)
+	sendTestCall(client, "fast", 2, 0)
+	// Both calls read before the limit was reached are answered.
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := readTestReply(client); err != nil {
+			t.Fatalf("Unable to read reply: %s", err)
+		}
+	}
+	expectClosed(t, NewTBinaryProtocolTransport(socket))
+	server.Stop()
+	waitServe(t, done)
+}
@@ -0,0 +1,74 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+)
+
+// Callbacks a server makes over the lifetime of its connections, for
+// per-connection setup and cleanup such as authentication state, metrics or
+// logging. The callbacks for different connections may run concurrently.
+type TServerEventHandler interface {
+	// Called once the server is listening, before it accepts connections.
+	PreServe()
+	// Called when a connection is accepted. The returned value is the
+	// per-connection state passed to the other callbacks and returned by
+	// ServerContextFromProtocol for the protocols handed to the processor
+	// and by ServerContextFromContext for the contexts of its calls.
+	CreateContext(in, out TProtocol) interface{}
+	// Called before each request of the connection is processed, once its
+	// first bytes have arrived. trans is the transport accepted by the
+	// server transport.
+	ProcessContext(serverContext interface{}, trans TTransport)
+	// Called when the connection is closed.
+	DeleteContext(serverContext interface{}, in, out TProtocol)
+}
+
+// ServerContextFromProtocol returns the per-connection state created by the
+// server's TServerEventHandler, given a protocol the server passed to the
+// processor. It returns nil if there is none.
+func ServerContextFromProtocol(prot TProtocol) interface{} {
+	for prot != nil {
+		switch p := prot.(type) {
+		case *tServerProtocol:
+			return p.conn.serverContext
+		case interface {
+			wrappedProtocol() TProtocol
+		}:
+			prot = p.wrappedProtocol()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns a copy of ctx carrying the per-connection state serverContext.
+func NewContextWithServerContext(ctx context.Context, serverContext interface{}) context.Context {
+	return context.WithValue(ctx, serverContextKey, serverContext)
+}
+
+// ServerContextFromContext returns the per-connection state created by the
+// server's TServerEventHandler, given the context of a call the server
+// passed to the processor. It returns nil if there is none.
+func ServerContextFromContext(ctx context.Context) interface{} {
+	return ctx.Value(serverContextKey)
+}
@@ -0,0 +1,140 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingEventHandler struct {
+	mu        sync.Mutex
+	preServe  int
+	created   int
+	processed int
+	deleted   int
+}
+
+func (p *recordingEventHandler) PreServe() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.preServe++
+}
+
+func (p *recordingEventHandler) CreateContext(in, out TProtocol) interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.created++
+	return p.created
+}
+
+func (p *recordingEventHandler) ProcessContext(serverContext interface{}, trans TTransport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed++
+}
+
+func (p *recordingEventHandler) DeleteContext(serverContext interface{}, in, out TProtocol) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deleted++
+}
+
+func (p *recordingEventHandler) counts() [4]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return [4]int{p.preServe, p.created, p.processed, p.deleted}
+}
+
+// Checks that the processor sees the state of its connection.
+type serverContextProcessor struct {
+	sleepProcessor
+	mu   sync.Mutex
+	seen []interface{}
+}
+
+func (p *serverContextProcessor) Process(in, out TProtocol) (bool, TException) {
+	p.mu.Lock()
+	p.seen = append(p.seen, ServerContextFromProtocol(in))
+	p.mu.Unlock()
+	return p.sleepProcessor.Process(in, out)
+}
+
+func TestServerEventHandler(t *testing.T) {
+	processor := &serverContextProcessor{}
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTSimpleServer2(processor, serverSocket)
+	handler := &recordingEventHandler{}
+	server.SetServerEventHandler(handler)
+	done := startServing(t, server, serverSocket)
+
+	client := openTestClient(t, addr)
+	for i := int32(1); i <= 2; i++ {
+		if err := callTestServer(client, "test", i, 0); err != nil {
+			t.Fatalf("Call failed: %s", err)
+		}
+	}
+	client.Transport().Close()
+	for i := 0; i < 100 && handler.counts()[3] == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Stop()
+	waitServe(t, done)
+
+	if c := handler.counts(); c != [4]int{1, 1, 2, 1} {
+		t.Errorf("Unexpected callback counts (preServe, create, process, delete): %v", c)
+	}
+	if len(processor.seen) < 2 || processor.seen[0] != 1 || processor.seen[1] != 1 {
+		t.Errorf("Processor did not see the connection state: %v", processor.seen)
+	}
+}
+
+func TestServerContextFromContext(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		processor := newContextProcessor()
+		serverSocket, addr := newTestServerSocket(t)
+		var server interface {
+			TServer
+			SetServerEventHandler(TServerEventHandler)
+		}
+		if pipelined {
+			server = NewTPipelinedServer2(NewTProcessorFromContext(processor), serverSocket)
+		} else {
+			server = NewTSimpleServer2(NewTProcessorFromContext(processor), serverSocket)
+		}
+		server.SetServerEventHandler(&recordingEventHandler{})
+		done := startServing(t, server, serverSocket)
+
+		client := openTestClient(t, addr)
+		if pipelined {
+			client = NewTBinaryProtocolTransport(NewTFramedTransport(client.Transport()))
+		}
+		if err := callTestServer(client, "test", 1, 0); err != nil {
+			t.Fatalf("Call failed: %s", err)
+		}
+		if sc := ServerContextFromContext(<-processor.calls); sc != 1 {
+			t.Errorf("Expected the connection state in the call context (pipelined %v), got %v", pipelined, sc)
+		}
+		client.Transport().Close()
+		server.Stop()
+		waitServe(t, done)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+)
+
+// A TPanicHandler is called with the value and stack trace of a panic
+// recovered while a server processed the call name with sequence id seqId,
+// to report it.
+type TPanicHandler func(ctx context.Context, name string, seqId int32, recovered interface{}, stack []byte)
+
+// processCall runs processor on a call, recovering from any panic in it.
+//
+// A recovered panic is logged and answered with an INTERNAL_ERROR
+// TApplicationException if no reply had been started. The connection is
+// kept only if the call had been read in full and answered; otherwise
+// processCall returns false so that it is closed.
+func (p *TSimpleServer) processCall(ctx context.Context, processor TContextProcessor, in, out *tServerProtocol) (ok bool, err TException) {
+	*in.call = tServerCall{}
+	defer func() {
+		if r := recover(); r != nil {
+			ok, err = p.recoverCall(ctx, in.call, out, r, debug.Stack())
+		}
+	}()
+	return processor.Process(ctx, in, out)
+}
+
+func (p *TSimpleServer) recoverCall(ctx context.Context, call *tServerCall, out TProtocol, r interface{}, stack []byte) (bool, TException) {
+	var remote net.Addr
+	if info, ok := ConnectionInfoFromContext(ctx); ok {
+		remote = info.RemoteAddr
+	}
+	call.panicked = true
+	p.Logger().Error("thrift: panic processing call",
+		append(logAttrs(remote, call.name, nil), "seqid", call.seqId, "panic", r, "stack", string(stack))...)
+	if p.panicHandler != nil {
+		p.panicHandler(ctx, call.name, call.seqId, r, stack)
+	}
+	if !call.begun || call.replyStarted {
+		// Part of a reply may have gone out; the connection can no longer
+		// be trusted.
+		return false, nil
+	}
+	if call.typeId != ONEWAY {
+		exc := NewTApplicationException(INTERNAL_ERROR, "Internal error processing "+call.name)
+		if err := writeApplicationException(out, call.name, call.seqId, exc); err != nil {
+			return false, err
+		}
+	}
+	return call.read, nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+type panicFunction struct {
+	// Whether to panic after starting the reply rather than before.
+	midReply bool
+}
+
+func (p *panicFunction) Process(seqId int32, in, out TProtocol) (bool, TException) {
+	if err := in.Skip(STRUCT); err != nil {
+		return false, err
+	}
+	in.ReadMessageEnd()
+	if p.midReply {
+		out.WriteMessageBegin("panic", REPLY, seqId)
+		out.WriteStructBegin("result")
+		out.Flush()
+	}
+	panic("handler failed")
+}
+
+type recoveredPanic struct {
+	name     string
+	seqId    int32
+	value    interface{}
+	hasStack bool
+}
+
+func startPanicTestServer(t *testing.T, midReply bool) (*TSimpleServer, string, chan error, *bytes.Buffer, chan recoveredPanic) {
+	processor := NewTBaseProcessor()
+	processor.AddToProcessorMap("echo", &emptyReplyFunction{})
+	processor.AddToProcessorMap("panic", &panicFunction{midReply: midReply})
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTSimpleServer2(processor, serverSocket)
+	logs := &bytes.Buffer{}
+	server.SetLogger(slog.New(slog.NewTextHandler(logs, nil)))
+	panics := make(chan recoveredPanic, 1)
+	server.SetPanicHandler(func(ctx context.Context, name string, seqId int32, recovered interface{}, stack []byte) {
+		panics <- recoveredPanic{name, seqId, recovered, len(stack) > 0}
+	})
+	return server, addr, startServing(t, server, serverSocket), logs, panics
+}
+
+func TestSimpleServerRecoversPanic(t *testing.T) {
+	server, addr, done, logs, panics := startPanicTestServer(t, false)
+	prot := openTestClient(t, addr)
+	sendTestCall(prot, "panic", 7, 0)
+	_, typeId, seqId, err := readTestReply(prot)
+	if e, ok := err.(TApplicationException); !ok || e.TypeId() != INTERNAL_ERROR || typeId != EXCEPTION || seqId != 7 {
+		t.Fatalf("Expected INTERNAL_ERROR for seqid 7, got %d %d %v", typeId, seqId, err)
+	}
+	select {
+	case p := <-panics:
+		if p.name != "panic" || p.seqId != 7 || p.value != "handler failed" || !p.hasStack {
+			t.Errorf("Unexpected panic report: %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Panic handler not called")
+	}
+	if l := logs.String(); !strings.Contains(l, "method=panic") || !strings.Contains(l, "stack=") {
+		t.Errorf("Panic not logged with its stack: %q", l)
+	}
+	// The connection stays usable.
+	if err := callTestServer(prot, "echo", 8, 0); err != nil {
+		t.Fatalf("Call after panic failed: %v", err)
+	}
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+}
+
+func TestSimpleServerClosesAfterPanicMidReply(t *testing.T) {
+	server, addr, done, _, panics := startPanicTestServer(t, true)
+	prot := openTestClient(t, addr)
+	sendTestCall(prot, "panic", 1, 0)
+	<-panics
+	// The partial reply is followed by the connection closing.
+	var b [64]byte
+	if _, err := io.ReadFull(prot.Transport(), b[:]); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	prot.Transport().Close()
+	server.Stop()
+	waitServe(t, done)
+}
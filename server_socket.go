@@ -21,6 +21,8 @@ package thrift
 
 import (
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -28,7 +30,12 @@ type TServerSocket struct {
 	listener      net.Listener
 	addr          net.Addr
 	clientTimeout time.Duration
-	interrupted   bool
+
+	// Protects the listener and interrupted fields, as Interrupt may be
+	// called from another goroutine than Accept.
+	mu          sync.RWMutex
+	interrupted bool
+	proxy       *TProxyProtocolConfig
 }
 
 func NewTServerSocket(listenAddr string) (*TServerSocket, error) {
@@ -43,8 +50,31 @@ func NewTServerSocketTimeout(listenAddr string, clientTimeout time.Duration) (*T
 	return &TServerSocket{addr: addr, clientTimeout: clientTimeout}, nil
 }
 
+// Creates a server socket accepting connections from l, such as one
+// inherited from systemd or a parent process.
+func NewTServerSocketFromListener(l net.Listener, clientTimeout time.Duration) *TServerSocket {
+	return &TServerSocket{listener: l, addr: l.Addr(), clientTimeout: clientTimeout}
+}
+
+// Reads a PROXY protocol header at the start of each connection accepted
+// from one of cfg's trusted sources, exposing the addresses of the original client rather than those of the
+// proxy. Must be called before Accept.
+func (p *TServerSocket) SetProxyProtocol(cfg *TProxyProtocolConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proxy = cfg
+}
+
+func (p *TServerSocket) ProxyProtocol() *TProxyProtocolConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.proxy
+}
+
 func (p *TServerSocket) Listen() error {
-	if p.IsListening() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listener != nil {
 		return nil
 	}
 	l, err := net.Listen(p.addr.Network(), p.addr.String())
@@ -56,27 +86,48 @@ func (p *TServerSocket) Listen() error {
 }
 
 func (p *TServerSocket) Accept() (TTransport, error) {
-	if p.interrupted {
+	p.mu.RLock()
+	interrupted := p.interrupted
+	listener := p.listener
+	proxy := p.proxy
+	p.mu.RUnlock()
+	if interrupted {
 		return nil, errTransportInterrupted
 	}
-	if p.listener == nil {
+	if listener == nil {
 		return nil, NewTTransportException(NOT_OPEN, "No underlying server socket")
 	}
-	conn, err := p.listener.Accept()
+	conn, err := listener.Accept()
 	if err != nil {
+		if p.isInterrupted() {
+			return nil, errTransportInterrupted
+		}
 		return nil, NewTTransportExceptionFromError(err)
 	}
+	if proxy != nil {
+		conn = newTProxyConn(conn, proxy)
+	}
 	return NewTSocketFromConnTimeout(conn, p.clientTimeout), nil
 }
 
 // Checks whether the socket is listening.
 func (p *TServerSocket) IsListening() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return p.listener != nil
 }
 
+func (p *TServerSocket) isInterrupted() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.interrupted
+}
+
 // Connects the socket, creating a new socket object if necessary.
 func (p *TServerSocket) Open() error {
-	if p.IsListening() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listener != nil {
 		return NewTTransportException(ALREADY_OPEN, "Server socket already open")
 	}
 	if l, err := net.Listen(p.addr.Network(), p.addr.String()); err != nil {
@@ -92,16 +143,34 @@ func (p *TServerSocket) Addr() net.Addr {
 }
 
 func (p *TServerSocket) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	defer func() {
 		p.listener = nil
 	}()
-	if p.IsListening() {
+	if p.listener != nil {
 		return p.listener.Close()
 	}
 	return nil
 }
 
+// Returns a duplicate of the file descriptor of the listener, to be passed
+// on to another process.
+func (p *TServerSocket) File() (*os.File, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return listenerFile(p.listener)
+}
+
+// Interrupt closes the listener, so a blocked Accept returns, and makes all
+// further calls to Accept fail.
 func (p *TServerSocket) Interrupt() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.interrupted = true
+	if p.listener != nil {
+		p.listener.Close()
+		p.listener = nil
+	}
 	return nil
 }
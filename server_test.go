@@ -20,9 +20,200 @@
 package thrift
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
-func TestNothing(t *testing.T) {
+// A processor answering every call with an empty reply, after sleeping for
+// the number of milliseconds given in the I32 field 1 of the arguments.
+type sleepProcessor struct{}
 
+func (p *sleepProcessor) Process(in, out TProtocol) (bool, TException) {
+	name, _, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	var sleep int32
+	if _, err := in.ReadStructBegin(); err != nil {
+		return false, err
+	}
+	for {
+		_, typeId, id, err := in.ReadFieldBegin()
+		if err != nil {
+			return false, err
+		}
+		if typeId == STOP {
+			break
+		}
+		if id == 1 && typeId == I32 {
+			if sleep, err = in.ReadI32(); err != nil {
+				return false, err
+			}
+		} else if err := in.Skip(typeId); err != nil {
+			return false, err
+		}
+		in.ReadFieldEnd()
+	}
+	in.ReadStructEnd()
+	in.ReadMessageEnd()
+	time.Sleep(time.Duration(sleep) * time.Millisecond)
+	out.WriteMessageBegin(name, REPLY, seqId)
+	out.WriteStructBegin("result")
+	out.WriteFieldStop()
+	out.WriteStructEnd()
+	out.WriteMessageEnd()
+	return true, out.Flush()
+}
+
+func newTestServerSocket(t *testing.T) (*TServerSocket, string) {
+	addr, err := FindAvailableTCPServerPort(40000)
+	if err != nil {
+		t.Fatalf("Unable to find available tcp port addr: %s", err)
+	}
+	serverSocket, err := NewTServerSocket(addr.String())
+	if err != nil {
+		t.Fatalf("Unable to create server socket: %s", err)
+	}
+	return serverSocket, addr.String()
+}
+
+func startServing(t *testing.T, server TServer, serverSocket interface{ IsListening() bool }) chan error {
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	for i := 0; i < 100 && !serverSocket.IsListening(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return done
+}
+
+func startTestServer(t *testing.T, processor TProcessor) (*TSimpleServer, string, chan error) {
+	serverSocket, addr := newTestServerSocket(t)
+	server := NewTSimpleServer2(processor, serverSocket)
+	return server, addr, startServing(t, server, serverSocket)
+}
+
+func openTestClient(t *testing.T, addr string) TProtocol {
+	socket, err := NewTSocketTimeout(addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create client socket: %s", err)
+	}
+	if err := socket.Open(); err != nil {
+		t.Fatalf("Unable to connect to %s: %s", addr, err)
+	}
+	return NewTBinaryProtocolTransport(socket)
+}
+
+func sendTestCall(prot TProtocol, name string, seqId int32, sleep int32) error {
+	if err := prot.WriteMessageBegin(name, CALL, seqId); err != nil {
+		return err
+	}
+	prot.WriteStructBegin("args")
+	prot.WriteFieldBegin("sleep", I32, 1)
+	prot.WriteI32(sleep)
+	prot.WriteFieldEnd()
+	prot.WriteFieldStop()
+	prot.WriteStructEnd()
+	prot.WriteMessageEnd()
+	return prot.Flush()
+}
+
+func readTestReply(prot TProtocol) (string, TMessageType, int32, error) {
+	name, typeId, seqId, err := prot.ReadMessageBegin()
+	if err != nil {
+		return name, typeId, seqId, err
+	}
+	if typeId == EXCEPTION {
+		exc, err := NewTApplicationException(UNKNOWN_APPLICATION_EXCEPTION, "").Read(prot)
+		if err != nil {
+			return name, typeId, seqId, err
+		}
+		prot.ReadMessageEnd()
+		return name, typeId, seqId, exc
+	}
+	if err := prot.Skip(STRUCT); err != nil {
+		return name, typeId, seqId, err
+	}
+	return name, typeId, seqId, prot.ReadMessageEnd()
+}
+
+func callTestServer(prot TProtocol, name string, seqId int32, sleep int32) error {
+	if err := sendTestCall(prot, name, seqId, sleep); err != nil {
+		return err
+	}
+	_, _, _, err := readTestReply(prot)
+	return err
+}
+
+func waitServe(t *testing.T, done chan error) {
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve returned error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return")
+	}
+}
+
+func TestSimpleServerStop(t *testing.T) {
+	server, addr, done := startTestServer(t, &sleepProcessor{})
+	client := openTestClient(t, addr)
+	defer client.Transport().Close()
+	if err := callTestServer(client, "test", 1, 0); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	if err := server.Stop(); err != nil {
+		t.Fatalf("Stop failed: %s", err)
+	}
+	waitServe(t, done)
+
+	again := make(chan error, 1)
+	go func() { again <- server.Serve() }()
+	waitServe(t, again)
+}
+
+func TestSimpleServerShutdown(t *testing.T) {
+	server, addr, done := startTestServer(t, &sleepProcessor{})
+	idle := openTestClient(t, addr)
+	defer idle.Transport().Close()
+	if err := callTestServer(idle, "test", 1, 0); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	busy := openTestClient(t, addr)
+	defer busy.Transport().Close()
+	if err := sendTestCall(busy, "test", 1, 200); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	if _, _, _, err := readTestReply(busy); err != nil {
+		t.Errorf("Request in flight was not completed: %s", err)
+	}
+	if err := callTestServer(idle, "test", 2, 0); err == nil {
+		t.Errorf("Expected idle connection to be closed")
+	}
+	waitServe(t, done)
+}
+
+func TestSimpleServerShutdownDeadline(t *testing.T) {
+	server, addr, done := startTestServer(t, &sleepProcessor{})
+	busy := openTestClient(t, addr)
+	defer busy.Transport().Close()
+	if err := sendTestCall(busy, "test", 1, 500); err != nil {
+		t.Fatalf("Unable to send call: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected Shutdown to time out, got %v", err)
+	}
+	waitServe(t, done)
 }
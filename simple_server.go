@@ -20,12 +20,29 @@
 package thrift
 
 import (
-	"log"
+	"context"
+	"sync"
+	"time"
 )
 
-// Simple, non-concurrent server for testing.
+// How often Shutdown checks whether all connections have finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Bounds of the delay before accepting again after Accept fails.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Simple server that serves each connection in its own goroutine.
 type TSimpleServer struct {
+	// Protects stopped and conns, which are shared between Serve, the
+	// connection goroutines and Stop or Shutdown.
+	mu      sync.Mutex
 	stopped bool
+	quit    chan struct{}
+	conns   map[*tServerConn]struct{}
+	wg      sync.WaitGroup
 
 	processorFactory       TProcessorFactory
 	serverTransport        TServerTransport
@@ -33,6 +50,11 @@ type TSimpleServer struct {
 	outputTransportFactory TTransportFactory
 	inputProtocolFactory   TProtocolFactory
 	outputProtocolFactory  TProtocolFactory
+	eventHandler           TServerEventHandler
+	logger                 TLogger
+	panicHandler           TPanicHandler
+	metrics                TMetricsCollector
+	limits                 tConnLimits
 }
 
 func NewTSimpleServer2(processor TProcessor, serverTransport TServerTransport) *TSimpleServer {
@@ -111,38 +133,298 @@ func (p *TSimpleServer) OutputProtocolFactory() TProtocolFactory {
 	return p.outputProtocolFactory
 }
 
+// Sets the handler notified of connection lifecycle events. Must be called
+// before Serve.
+func (p *TSimpleServer) SetServerEventHandler(handler TServerEventHandler) {
+	p.eventHandler = handler
+}
+
+func (p *TSimpleServer) ServerEventHandler() TServerEventHandler {
+	return p.eventHandler
+}
+
+// Sets the logger the server reports problems to, DefaultLogger() if nil.
+// Must be called before Serve.
+func (p *TSimpleServer) SetLogger(logger TLogger) {
+	p.logger = logger
+}
+
+func (p *TSimpleServer) Logger() TLogger {
+	if p.logger == nil {
+		return DefaultLogger()
+	}
+	return p.logger
+}
+
+// Sets the collector told of connections and calls, such as a TMetrics.
+// Must be called before Serve.
+func (p *TSimpleServer) SetMetricsCollector(metrics TMetricsCollector) {
+	p.metrics = metrics
+}
+
+func (p *TSimpleServer) MetricsCollector() TMetricsCollector {
+	return p.metrics
+}
+
+// Sets how long a connection may wait for its next request before it is
+// closed, or no limit if zero. The timeout of the server transport, if
+// any, also applies to every read and should be longer. Must be called
+// before Serve.
+func (p *TSimpleServer) SetIdleTimeout(timeout time.Duration) {
+	p.limits.idleTimeout = timeout
+}
+
+func (p *TSimpleServer) IdleTimeout() time.Duration {
+	return p.limits.idleTimeout
+}
+
+// Sets how long a request may take to arrive in full once its first bytes
+// have, or no limit if zero. Connections sending requests more slowly are
+// closed. Must be called before Serve.
+func (p *TSimpleServer) SetRequestHeaderTimeout(timeout time.Duration) {
+	p.limits.headerTimeout = timeout
+}
+
+func (p *TSimpleServer) RequestHeaderTimeout() time.Duration {
+	return p.limits.headerTimeout
+}
+
+// Sets how long a connection may stay open, or no limit if zero. A
+// connection older than that is closed once the request in progress, if
+// any, has been answered. Must be called before Serve.
+func (p *TSimpleServer) SetMaxConnectionAge(age time.Duration) {
+	p.limits.maxAge = age
+}
+
+func (p *TSimpleServer) MaxConnectionAge() time.Duration {
+	return p.limits.maxAge
+}
+
+// Sets how many requests a connection may make, or no limit if zero. The
+// connection is closed once the last of them has been answered. Must be
+// called before Serve.
+func (p *TSimpleServer) SetMaxRequestsPerConnection(n int) {
+	p.limits.maxRequests = n
+}
+
+func (p *TSimpleServer) MaxRequestsPerConnection() int {
+	return p.limits.maxRequests
+}
+
+// Sets a function to be told of panics recovered while processing calls,
+// in addition to their being logged. Must be called before Serve.
+func (p *TSimpleServer) SetPanicHandler(handler TPanicHandler) {
+	p.panicHandler = handler
+}
+
+// Serve accepts connections until the server is stopped, then waits for
+// the remaining connections to finish before returning. It returns at once
+// if the server has been stopped already.
 func (p *TSimpleServer) Serve() error {
-	p.stopped = false
+	return p.serve(func(conn *tServerConn) {
+		go p.handleConn(conn)
+	})
+}
+
+// serve runs the accept loop, handing every accepted connection to
+// dispatch, which must eventually call handleConn or rejectConn on it.
+func (p *TSimpleServer) serve(dispatch func(conn *tServerConn)) error {
+	if p.isStopped() {
+		return nil
+	}
 	err := p.serverTransport.Listen()
 	if err != nil {
 		return err
 	}
-	for !p.stopped {
+	notifyHandoffReady()
+	if p.eventHandler != nil {
+		p.eventHandler.PreServe()
+	}
+	var delay time.Duration
+	for {
 		client, err := p.serverTransport.Accept()
 		if err != nil {
-			log.Println("Accept err: ", err)
+			if p.isStopped() || err == errTransportInterrupted {
+				break
+			}
+			// Back off so that a persistent failure, such as running out
+			// of file descriptors, doesn't spin.
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			p.Logger().Error("thrift: accept failed", append(logAttrs(nil, "", err), "retry_in", delay)...)
+			select {
+			case <-time.After(delay):
+			case <-p.quitChan():
+			}
+			continue
 		}
+		delay = 0
 		if client != nil {
-			go func() {
-				if err := p.processRequest(client); err != nil {
-					log.Println("error processing request:", err)
-				}
-			}()
+			conn := newTServerConn(client)
+			if !p.addConn(conn) {
+				conn.Close()
+				break
+			}
+			dispatch(conn)
 		}
 	}
+	p.wg.Wait()
 	return nil
 }
 
+func (p *TSimpleServer) handleConn(conn *tServerConn) {
+	defer p.removeConn(conn)
+	p.startLimits(conn)
+	defer conn.stopLimits()
+	if err := p.processRequest(conn); err != nil {
+		p.logRequestError(conn, err)
+	}
+}
+
+// startLimits starts enforcing the server's connection limits on conn.
+func (p *TSimpleServer) startLimits(conn *tServerConn) {
+	conn.startLimits(p.limits, func(reason string) {
+		attrs := append(logAttrs(conn.remoteAddr(), "", nil), "reason", reason)
+		if reason == "request header timeout" {
+			p.Logger().Warn("thrift: closing connection with slow request", attrs...)
+		} else {
+			p.Logger().Debug("thrift: closing connection", attrs...)
+		}
+	})
+}
+
+func (p *TSimpleServer) logRequestError(conn *tServerConn, err error) {
+	p.Logger().Error("thrift: error processing request", logAttrs(conn.remoteAddr(), conn.lastMethod(), err)...)
+}
+
+// rejectConn closes a connection the server will not serve.
+func (p *TSimpleServer) rejectConn(conn *tServerConn) {
+	conn.Close()
+	p.removeConn(conn)
+}
+
+// Stop closes the listener and all connections immediately, cutting off
+// requests in flight. Use Shutdown to let them complete.
+//
+// Stopping is final: a stopped server cannot be served again, even if Stop
+// is called before Serve. Create a new server, with a new server transport,
+// to serve again.
 func (p *TSimpleServer) Stop() error {
-	p.stopped = true
+	p.setStopped()
 	p.serverTransport.Interrupt()
+	for _, conn := range p.activeConns() {
+		conn.forceClose()
+	}
 	return nil
 }
 
-func (p *TSimpleServer) processRequest(client TTransport) error {
-	processor := p.processorFactory.GetProcessor(client)
-	inputTransport := p.inputTransportFactory.GetTransport(client)
-	outputTransport := p.outputTransportFactory.GetTransport(client)
+// Shutdown stops the server gracefully. It closes the listener so Serve
+// stops accepting, closes connections as soon as they are idle and waits
+// for requests in flight to complete. If ctx expires first, the remaining
+// connections are closed and ctx's error is returned. Like Stop, it is
+// final.
+func (p *TSimpleServer) Shutdown(ctx context.Context) error {
+	p.setStopped()
+	p.serverTransport.Interrupt()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		remaining := 0
+		for _, conn := range p.activeConns() {
+			if !conn.closeIfIdle() {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, conn := range p.activeConns() {
+				conn.forceClose()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *TSimpleServer) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+func (p *TSimpleServer) setStopped() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		if p.quit != nil {
+			close(p.quit)
+		}
+	}
+}
+
+// quitChan returns a channel that is closed once the server is stopping.
+func (p *TSimpleServer) quitChan() chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit == nil {
+		p.quit = make(chan struct{})
+		if p.stopped {
+			close(p.quit)
+		}
+	}
+	return p.quit
+}
+
+// addConn registers a new connection, unless the server is stopping.
+func (p *TSimpleServer) addConn(conn *tServerConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = make(map[*tServerConn]struct{})
+	}
+	p.conns[conn] = struct{}{}
+	p.wg.Add(1)
+	if p.metrics != nil {
+		conn.metrics = p.metrics
+		p.metrics.ConnectionOpened()
+	}
+	return true
+}
+
+func (p *TSimpleServer) removeConn(conn *tServerConn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+	if p.metrics != nil {
+		p.metrics.ConnectionClosed()
+	}
+	p.wg.Done()
+}
+
+func (p *TSimpleServer) activeConns() []*tServerConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := make([]*tServerConn, 0, len(p.conns))
+	for conn := range p.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (p *TSimpleServer) processRequest(conn *tServerConn) error {
+	processor := p.processorFactory.GetProcessor(conn.TTransport)
+	inputTransport := p.inputTransportFactory.GetTransport(conn)
+	outputTransport := p.outputTransportFactory.GetTransport(conn)
 	inputProtocol := p.inputProtocolFactory.GetProtocol(inputTransport)
 	outputProtocol := p.outputProtocolFactory.GetProtocol(outputTransport)
 	if inputTransport != nil {
@@ -151,16 +433,63 @@ func (p *TSimpleServer) processRequest(client TTransport) error {
 	if outputTransport != nil {
 		defer outputTransport.Close()
 	}
+	ctx, err := conn.newContext()
+	defer conn.cancelContext()
+	if err != nil {
+		return err
+	}
+	if p.eventHandler != nil {
+		serverContext := p.eventHandler.CreateContext(inputProtocol, outputProtocol)
+		defer p.eventHandler.DeleteContext(serverContext, inputProtocol, outputProtocol)
+		conn.serverContext = serverContext
+		ctx = NewContextWithServerContext(ctx, serverContext)
+		conn.onRequest = func() {
+			p.eventHandler.ProcessContext(serverContext, conn.TTransport)
+		}
+	}
+	in, out := newTServerProtocols(inputProtocol, outputProtocol, conn, true)
+	contextProcessor := NewTContextProcessor(processor)
 	for {
-		ok, err := processor.Process(inputProtocol, outputProtocol)
-		if err, ok := err.(TTransportException); ok && err.TypeId() == END_OF_FILE{
-			return nil
-		} else if err != nil {
+		read, written := conn.byteCounts()
+		ok, err := p.processCall(ctx, contextProcessor, in, out)
+		if in.call.begun {
+			r, w := conn.byteCounts()
+			p.finishCall(in.call, r-read, w-written, err)
+		}
+		conn.stopWatch()
+		conn.setIdle()
+		if err != nil {
+			if e, ok := err.(TTransportException); ok && e.TypeId() == END_OF_FILE || p.isStopped() || conn.isClosed() {
+				// The client went away, or the server closed the
+				// connection.
+				return nil
+			}
+			if e, ok := err.(TApplicationException); ok && e.TypeId() == UNKNOWN_METHOD {
+				// The caller has been told; carry on with its next call.
+				continue
+			}
 			return err
 		}
-		if !ok || !inputProtocol.Transport().Peek() {
+		if !ok || p.isStopped() || conn.isClosed() || !in.Transport().Peek() {
 			break
 		}
 	}
 	return nil
 }
+
+// finishCall tells the metrics collector that call has been processed.
+func (p *TSimpleServer) finishCall(call *tServerCall, requestBytes, responseBytes int64, err error) {
+	if p.metrics == nil {
+		return
+	}
+	errType := ""
+	switch {
+	case call.panicked:
+		errType = "panic"
+	case err != nil:
+		errType = errorType(err)
+	case call.replyType == EXCEPTION:
+		errType = "application"
+	}
+	p.metrics.CallFinished(call.name, time.Since(call.start), requestBytes, responseBytes, errType)
+}
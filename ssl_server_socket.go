@@ -20,17 +20,28 @@
 package thrift
 
 import (
+	"crypto/tls"
 	"net"
+	"os"
+	"sync"
 	"time"
-	"crypto/tls"
 )
 
 type TSSLServerSocket struct {
-	listener      net.Listener
+	listener net.Listener
+	// The TCP listener underneath listener, or an adopted listener not yet
+	// wrapped in TLS.
+	raw           net.Listener
 	addr          net.Addr
 	clientTimeout time.Duration
-	interrupted   bool
 	cfg           *tls.Config
+
+	// Protects the listener and interrupted fields, as Interrupt may be
+	// called from another goroutine than Accept.
+	mu          sync.RWMutex
+	interrupted bool
+	reloader    *TCertReloader
+	proxy       *TProxyProtocolConfig
 }
 
 func NewTSSLServerSocket(listenAddr string, cfg *tls.Config) (*TSSLServerSocket, error) {
@@ -45,48 +56,113 @@ func NewTSSLServerSocketTimeout(listenAddr string, cfg *tls.Config, clientTimeou
 	return &TSSLServerSocket{addr: addr, clientTimeout: clientTimeout, cfg: cfg}, nil
 }
 
+// Serves the certificate and client CA bundle of reloader in place of
+// those of the socket's tls.Config, so that they can be rotated without
+// restarting the server. Must be called before Listen.
+func (p *TSSLServerSocket) SetCertReloader(reloader *TCertReloader) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reloader = reloader
+	p.cfg = reloader.Config(p.cfg)
+}
+
+func (p *TSSLServerSocket) CertReloader() *TCertReloader {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.reloader
+}
+
+// Reads a PROXY protocol header ahead of the TLS handshake of each
+// connection accepted from one of cfg's trusted sources, exposing the addresses of the original client rather than
+// those of the proxy. Must be called before Listen.
+func (p *TSSLServerSocket) SetProxyProtocol(cfg *TProxyProtocolConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proxy = cfg
+}
+
+func (p *TSSLServerSocket) ProxyProtocol() *TProxyProtocolConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.proxy
+}
+
+// Creates a server socket accepting TLS connections from l, such as one
+// inherited from systemd or a parent process.
+func NewTSSLServerSocketFromListener(l net.Listener, cfg *tls.Config, clientTimeout time.Duration) *TSSLServerSocket {
+	return &TSSLServerSocket{raw: l, addr: l.Addr(), clientTimeout: clientTimeout, cfg: cfg}
+}
+
 func (p *TSSLServerSocket) Listen() error {
-	if p.IsListening() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listener != nil {
 		return nil
 	}
-	l, err := tls.Listen(p.addr.Network(), p.addr.String(), p.cfg)
-	if err != nil {
-		return err
+	return p.listenLocked()
+}
+
+// listenLocked starts listening, adopting p.raw if set. Must be called
+// with p.mu held.
+func (p *TSSLServerSocket) listenLocked() error {
+	if p.raw == nil {
+		l, err := net.Listen(p.addr.Network(), p.addr.String())
+		if err != nil {
+			return err
+		}
+		p.raw = l
+	}
+	raw := p.raw
+	if p.proxy != nil {
+		raw = &tProxyListener{Listener: raw, cfg: p.proxy}
 	}
-	p.listener = l
+	p.listener = tls.NewListener(raw, p.cfg)
 	return nil
 }
 
 func (p *TSSLServerSocket) Accept() (TTransport, error) {
-	if p.interrupted {
+	p.mu.RLock()
+	interrupted := p.interrupted
+	listener := p.listener
+	cfg := p.cfg
+	p.mu.RUnlock()
+	if interrupted {
 		return nil, errTransportInterrupted
 	}
-	if p.listener == nil {
+	if listener == nil {
 		return nil, NewTTransportException(NOT_OPEN, "No underlying server socket")
 	}
-	conn, err := p.listener.Accept()
+	conn, err := listener.Accept()
 	if err != nil {
+		if p.isInterrupted() {
+			return nil, errTransportInterrupted
+		}
 		return nil, NewTTransportExceptionFromError(err)
 	}
-	return NewTSSLSocketFromConnTimeout(conn, p.cfg, p.clientTimeout), nil
+	return NewTSSLSocketFromConnTimeout(conn, cfg, p.clientTimeout), nil
 }
 
 // Checks whether the socket is listening.
 func (p *TSSLServerSocket) IsListening() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return p.listener != nil
 }
 
+func (p *TSSLServerSocket) isInterrupted() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.interrupted
+}
+
 // Connects the socket, creating a new socket object if necessary.
 func (p *TSSLServerSocket) Open() error {
-	if p.IsListening() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listener != nil {
 		return NewTTransportException(ALREADY_OPEN, "Server socket already open")
 	}
-	if l, err := tls.Listen(p.addr.Network(), p.addr.String(), p.cfg); err != nil {
-		return err
-	} else {
-		p.listener = l
-	}
-	return nil
+	return p.listenLocked()
 }
 
 func (p *TSSLServerSocket) Addr() net.Addr {
@@ -94,16 +170,39 @@ func (p *TSSLServerSocket) Addr() net.Addr {
 }
 
 func (p *TSSLServerSocket) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	defer func() {
 		p.listener = nil
+		p.raw = nil
 	}()
-	if p.IsListening() {
+	if p.listener != nil {
 		return p.listener.Close()
 	}
+	if p.raw != nil {
+		return p.raw.Close()
+	}
 	return nil
 }
 
+// Returns a duplicate of the file descriptor of the listener, to be passed
+// on to another process.
+func (p *TSSLServerSocket) File() (*os.File, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return listenerFile(p.raw)
+}
+
+// Interrupt closes the listener, so a blocked Accept returns, and makes all
+// further calls to Accept fail.
 func (p *TSSLServerSocket) Interrupt() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.interrupted = true
+	p.raw = nil
+	if p.listener != nil {
+		p.listener.Close()
+		p.listener = nil
+	}
 	return nil
 }
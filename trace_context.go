@@ -0,0 +1,132 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// Headers of the W3C Trace Context specification.
+const (
+	TRACEPARENT_HEADER = "traceparent"
+	TRACESTATE_HEADER  = "tracestate"
+)
+
+// Holds the headers a TPropagator reads and writes. http.Header is one.
+// Carriers that also have a Del(key string) method, as http.Header does, get
+// headers left from earlier requests removed when there is nothing to
+// inject in their place.
+type TTextMapCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+}
+
+// Carries span contexts across process boundaries in request headers.
+type TPropagator interface {
+	// Writes the context of the span in ctx, if any, to carrier.
+	Inject(ctx context.Context, carrier TTextMapCarrier)
+	// Returns a copy of ctx carrying the remote span context read from
+	// carrier, or ctx itself if carrier holds none.
+	Extract(ctx context.Context, carrier TTextMapCarrier) context.Context
+}
+
+// Returns a propagator using the W3C Trace Context traceparent and
+// tracestate headers.
+func NewTTraceContextPropagator() TPropagator {
+	return tTraceContextPropagator{}
+}
+
+type tTraceContextPropagator struct{}
+
+func (tTraceContextPropagator) Inject(ctx context.Context, carrier TTextMapCarrier) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		deleteHeader(carrier, TRACEPARENT_HEADER)
+		deleteHeader(carrier, TRACESTATE_HEADER)
+		return
+	}
+	carrier.Set(TRACEPARENT_HEADER, FormatTraceparent(sc))
+	if sc.TraceState != "" {
+		carrier.Set(TRACESTATE_HEADER, sc.TraceState)
+	} else {
+		deleteHeader(carrier, TRACESTATE_HEADER)
+	}
+}
+
+// deleteHeader removes key from carrier if it can delete headers.
+func deleteHeader(carrier TTextMapCarrier, key string) {
+	if d, ok := carrier.(interface {
+		Del(key string)
+	}); ok {
+		d.Del(key)
+	}
+}
+
+func (tTraceContextPropagator) Extract(ctx context.Context, carrier TTextMapCarrier) context.Context {
+	sc, ok := ParseTraceparent(carrier.Get(TRACEPARENT_HEADER))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = carrier.Get(TRACESTATE_HEADER)
+	return NewContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Returns the traceparent header value for sc.
+func FormatTraceparent(sc TSpanContext) string {
+	return "00-" + sc.TraceIDString() + "-" + sc.SpanIDString() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// Parses a traceparent header value. Values of later versions are accepted
+// as long as they start with the fields of version 00.
+func ParseTraceparent(v string) (TSpanContext, bool) {
+	var sc TSpanContext
+	v = strings.TrimSpace(v)
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return sc, false
+	}
+	version, ok := decodeLowerHex(v[0:2], 1)
+	if !ok || version[0] == 0xff {
+		return sc, false
+	}
+	if version[0] == 0 && len(v) != 55 || len(v) > 55 && v[55] != '-' {
+		return sc, false
+	}
+	traceID, ok1 := decodeLowerHex(v[3:35], 16)
+	spanID, ok2 := decodeLowerHex(v[36:52], 8)
+	flags, ok3 := decodeLowerHex(v[53:55], 1)
+	if !ok1 || !ok2 || !ok3 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+// decodeLowerHex decodes s, which must be n bytes in lowercase hex.
+func decodeLowerHex(s string, n int) ([]byte, bool) {
+	if len(s) != 2*n || strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
@@ -0,0 +1,143 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A TTracer keeping the spans it starts in memory, for tests.
+type TRecordingTracer struct {
+	mu    sync.Mutex
+	spans []*TRecordedSpan
+}
+
+func NewTRecordingTracer() *TRecordingTracer {
+	return &TRecordingTracer{}
+}
+
+// A span started by a TRecordingTracer.
+type TRecordedSpan struct {
+	Name string
+	Kind TSpanKind
+	// The context of the span's parent, not valid for a root span.
+	Parent TSpanContext
+
+	mu         sync.Mutex
+	sc         TSpanContext
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+func (p *TRecordingTracer) Start(ctx context.Context, name string, kind TSpanKind) (context.Context, TSpan) {
+	parent := SpanContextFromContext(ctx)
+	span := &TRecordedSpan{
+		Name:       name,
+		Kind:       kind,
+		Parent:     parent,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	span.sc = TSpanContext{SpanID: newSpanID(), Flags: TRACE_FLAG_SAMPLED}
+	if parent.IsValid() {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Flags = parent.Flags
+		span.sc.TraceState = parent.TraceState
+	} else {
+		span.sc.TraceID = newTraceID()
+	}
+	p.mu.Lock()
+	p.spans = append(p.spans, span)
+	p.mu.Unlock()
+	return NewContextWithSpan(ctx, span), span
+}
+
+// Returns the spans started so far, in order.
+func (p *TRecordingTracer) Spans() []*TRecordedSpan {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*TRecordedSpan(nil), p.spans...)
+}
+
+// Forgets the spans started so far.
+func (p *TRecordingTracer) Reset() {
+	p.mu.Lock()
+	p.spans = nil
+	p.mu.Unlock()
+}
+
+func (p *TRecordedSpan) Context() TSpanContext {
+	return p.sc
+}
+
+func (p *TRecordedSpan) SetAttribute(key string, value interface{}) {
+	p.mu.Lock()
+	p.attributes[key] = value
+	p.mu.Unlock()
+}
+
+func (p *TRecordedSpan) SetError(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+}
+
+func (p *TRecordedSpan) End() {
+	p.mu.Lock()
+	if p.end.IsZero() {
+		p.end = time.Now()
+	}
+	p.mu.Unlock()
+}
+
+// Returns the value of an attribute set on the span.
+func (p *TRecordedSpan) Attribute(key string) (interface{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.attributes[key]
+	return v, ok
+}
+
+func (p *TRecordedSpan) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *TRecordedSpan) Ended() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.end.IsZero()
+}
+
+// Returns how long the span lasted, or has lasted so far if it has not
+// ended.
+func (p *TRecordedSpan) Duration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.end.IsZero() {
+		return time.Since(p.start)
+	}
+	return p.end.Sub(p.start)
+}
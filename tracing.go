@@ -0,0 +1,255 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// Identifies a span within a trace, as in the W3C Trace Context
+// specification.
+type TSpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Trace flags, such as TRACE_FLAG_SAMPLED.
+	Flags byte
+	// Vendor-specific trace state, passed on unchanged.
+	TraceState string
+}
+
+const TRACE_FLAG_SAMPLED = 0x01
+
+// Returns whether the trace and span IDs are set.
+func (p TSpanContext) IsValid() bool {
+	return p.TraceID != [16]byte{} && p.SpanID != [8]byte{}
+}
+
+func (p TSpanContext) IsSampled() bool {
+	return p.Flags&TRACE_FLAG_SAMPLED != 0
+}
+
+func (p TSpanContext) TraceIDString() string {
+	return hex.EncodeToString(p.TraceID[:])
+}
+
+func (p TSpanContext) SpanIDString() string {
+	return hex.EncodeToString(p.SpanID[:])
+}
+
+type TSpanKind int
+
+const (
+	SPAN_KIND_INTERNAL TSpanKind = 0
+	SPAN_KIND_CLIENT   TSpanKind = 1
+	SPAN_KIND_SERVER   TSpanKind = 2
+)
+
+// A unit of work in a trace, such as a call made or served. Spans must be
+// safe for concurrent use.
+type TSpan interface {
+	Context() TSpanContext
+	SetAttribute(key string, value interface{})
+	// Marks the span as failed with err.
+	SetError(err error)
+	End()
+}
+
+// Starts spans. Implementations adapt the tracing library in use.
+type TTracer interface {
+	// Starts a span named name whose parent is the span in ctx, or the
+	// remote span context in ctx if there is no span. Returns the span and
+	// a copy of ctx carrying it.
+	Start(ctx context.Context, name string, kind TSpanKind) (context.Context, TSpan)
+}
+
+// Returns a copy of ctx carrying span.
+func NewContextWithSpan(ctx context.Context, span TSpan) context.Context {
+	return context.WithValue(ctx, spanKey, span)
+}
+
+// Returns the span in ctx, if any.
+func SpanFromContext(ctx context.Context) (TSpan, bool) {
+	span, ok := ctx.Value(spanKey).(TSpan)
+	return span, ok
+}
+
+// Returns a copy of ctx carrying the context of a span in another process,
+// as extracted by a TPropagator.
+func NewContextWithRemoteSpanContext(ctx context.Context, sc TSpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanContextKey, sc)
+}
+
+// Returns the context of the span in ctx, or else of the remote span in
+// ctx. The result is not valid if there is neither.
+func SpanContextFromContext(ctx context.Context) TSpanContext {
+	if span, ok := SpanFromContext(ctx); ok {
+		return span.Context()
+	}
+	sc, _ := ctx.Value(remoteSpanContextKey).(TSpanContext)
+	return sc
+}
+
+// Returns a tracer recording nothing. Its spans carry the context of their
+// parent so that traces still propagate through untraced services.
+func NewTNopTracer() TTracer {
+	return tNopTracer{}
+}
+
+type tNopTracer struct{}
+
+func (tNopTracer) Start(ctx context.Context, name string, kind TSpanKind) (context.Context, TSpan) {
+	span := tNopSpan{SpanContextFromContext(ctx)}
+	return NewContextWithSpan(ctx, span), span
+}
+
+type tNopSpan struct {
+	sc TSpanContext
+}
+
+func (p tNopSpan) Context() TSpanContext                      { return p.sc }
+func (p tNopSpan) SetAttribute(key string, value interface{}) {}
+func (p tNopSpan) SetError(err error)                         {}
+func (p tNopSpan) End()                                       {}
+
+var (
+	defaultTracingMu  sync.RWMutex
+	defaultTracer     TTracer
+	defaultPropagator TPropagator
+)
+
+// Sets the tracer used where no other has been set. Passing nil restores
+// the no-op tracer.
+func SetDefaultTracer(tracer TTracer) {
+	defaultTracingMu.Lock()
+	defer defaultTracingMu.Unlock()
+	defaultTracer = tracer
+}
+
+func DefaultTracer() TTracer {
+	defaultTracingMu.RLock()
+	defer defaultTracingMu.RUnlock()
+	if defaultTracer == nil {
+		return tNopTracer{}
+	}
+	return defaultTracer
+}
+
+// Sets the propagator used to carry span contexts in request headers.
+// Passing nil restores the W3C Trace Context propagator.
+func SetDefaultPropagator(propagator TPropagator) {
+	defaultTracingMu.Lock()
+	defer defaultTracingMu.Unlock()
+	defaultPropagator = propagator
+}
+
+func DefaultPropagator() TPropagator {
+	defaultTracingMu.RLock()
+	defer defaultTracingMu.RUnlock()
+	if defaultPropagator == nil {
+		return NewTTraceContextPropagator()
+	}
+	return defaultPropagator
+}
+
+// StartClientSpan starts a client span for a call to method with the
+// default tracer and, if trans can send headers with a request as
+// THttpClient does, injects the span's context into them with the default
+// propagator. The caller must end the span once the call completes.
+func StartClientSpan(ctx context.Context, method string, trans TTransport) (context.Context, TSpan) {
+	ctx, span := DefaultTracer().Start(ctx, method, SPAN_KIND_CLIENT)
+	if h, ok := trans.(interface {
+		SetHeader(key, value string)
+	}); ok {
+		DefaultPropagator().Inject(ctx, tHeaderSetterCarrier{h})
+	}
+	return ctx, span
+}
+
+// Adapts a transport's SetHeader to a carrier that can only be injected
+// into.
+type tHeaderSetterCarrier struct {
+	h interface {
+		SetHeader(key, value string)
+	}
+}
+
+func (p tHeaderSetterCarrier) Get(key string) string { return "" }
+func (p tHeaderSetterCarrier) Set(key, value string) { p.h.SetHeader(key, value) }
+
+func (p tHeaderSetterCarrier) Del(key string) {
+	if d, ok := p.h.(interface {
+		DelHeader(key string)
+	}); ok {
+		d.DelHeader(key)
+	}
+}
+
+var errExceptionReply = errors.New("thrift: call answered with an exception")
+
+// NewTTracingMiddleware returns a middleware running each call in a server
+// span started with tracer, or the default tracer if nil. The span is a
+// child of the span context a server extracted from the request, if any,
+// and is failed if the call fails or is answered with an exception.
+func NewTTracingMiddleware(tracer TTracer) TMiddleware {
+	return func(next TCallHandler) TCallHandler {
+		return func(ctx context.Context, call *TCall, in, out TProtocol) (bool, TException) {
+			t := tracer
+			if t == nil {
+				t = DefaultTracer()
+			}
+			ctx, span := t.Start(ctx, call.Name, SPAN_KIND_SERVER)
+			defer span.End()
+			span.SetAttribute("rpc.system", "thrift")
+			span.SetAttribute("rpc.method", call.Name)
+			ok, err := next(ctx, call, in, out)
+			switch {
+			case err != nil:
+				span.SetError(err)
+			case call.Rejection != nil:
+				span.SetError(call.Rejection)
+			case call.ReplyType == EXCEPTION:
+				span.SetError(errExceptionReply)
+			}
+			return ok, err
+		}
+	}
+}
+
+// newSpanID returns a random span ID.
+func newSpanID() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// newTraceID returns a random trace ID.
+func newTraceID() [16]byte {
+	var id [16]byte
+	for id == [16]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
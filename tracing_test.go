@@ -0,0 +1,154 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	v := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(v)
+	if !ok || !sc.IsSampled() || sc.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanIDString() != "00f067aa0ba902b7" {
+		t.Fatalf("Unexpected span context %+v", sc)
+	}
+	if got := FormatTraceparent(sc); got != v {
+		t.Errorf("FormatTraceparent = %q, want %q", got, v)
+	}
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Error("Expected a later version with extra fields to parse")
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestNopTracerPropagatesParent(t *testing.T) {
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := NewContextWithRemoteSpanContext(context.Background(), sc)
+	ctx, span := NewTNopTracer().Start(ctx, "call", SPAN_KIND_CLIENT)
+	span.End()
+	header := http.Header{}
+	DefaultPropagator().Inject(ctx, header)
+	if got := header.Get(TRACEPARENT_HEADER); got != FormatTraceparent(sc) {
+		t.Errorf("Unexpected traceparent %q", got)
+	}
+}
+
+func TestTracePropagationOverHttp(t *testing.T) {
+	tracer := NewTRecordingTracer()
+	SetDefaultTracer(tracer)
+	defer SetDefaultTracer(nil)
+	processor := newContextProcessor()
+	pf := NewTBinaryProtocolFactoryDefault()
+	handler := NewThriftHandlerFunc(WrapProcessor(NewTProcessorFromContext(processor), NewTTracingMiddleware(nil)), pf, pf)
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	trans, err := NewTHttpPostClient(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	ctx, span := StartClientSpan(context.Background(), "echo", trans)
+	if err := callTestServer(pf.GetProtocol(trans), "echo", 1, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	span.End()
+
+	handlerCtx := <-processor.calls
+	spans := tracer.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a client and a server span, got %d", len(spans))
+	}
+	clientSpan, serverSpan := spans[0], spans[1]
+	if clientSpan.Kind != SPAN_KIND_CLIENT || clientSpan.Parent.IsValid() || !clientSpan.Ended() {
+		t.Errorf("Unexpected client span %+v", clientSpan)
+	}
+	if serverSpan.Kind != SPAN_KIND_SERVER || serverSpan.Name != "echo" || serverSpan.Parent.SpanID != clientSpan.Context().SpanID || !serverSpan.Ended() {
+		t.Errorf("Server span is not a child of the client span: %+v", serverSpan)
+	}
+	if got := SpanContextFromContext(handlerCtx); got.TraceID != SpanContextFromContext(ctx).TraceID || got.SpanID != serverSpan.Context().SpanID {
+		t.Errorf("Handler context carries %+v, want the server span", got)
+	}
+}
+
+func TestTracingMiddlewareRecordsErrors(t *testing.T) {
+	tracer := NewTRecordingTracer()
+	processor := NewTBaseProcessor()
+	wrapped := WrapProcessor(processor, NewTTracingMiddleware(tracer))
+	in := NewTMemoryBuffer()
+	out := NewTMemoryBuffer()
+	pf := NewTBinaryProtocolFactoryDefault()
+	sendTestCall(pf.GetProtocol(in), "missing", 1, 0)
+	wrapped.Process(pf.GetProtocol(in), pf.GetProtocol(out))
+	spans := tracer.Spans()
+	if len(spans) != 1 || spans[0].Err() == nil {
+		t.Fatalf("Expected a failed span, got %v", spans)
+	}
+	if v, _ := spans[0].Attribute("rpc.method"); v != "missing" {
+		t.Errorf("Unexpected rpc.method attribute %v", v)
+	}
+}
+
+func TestStartClientSpanClearsStaleHeaders(t *testing.T) {
+	tracer := NewTRecordingTracer()
+	SetDefaultTracer(tracer)
+	defer SetDefaultTracer(nil)
+	trans, err := NewTHttpPostClient("http://localhost")
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	client := trans.(*THttpClient)
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sc.TraceState = "vendor=value"
+	_, span := StartClientSpan(NewContextWithRemoteSpanContext(context.Background(), sc), "first", trans)
+	span.End()
+	if client.GetHeader(TRACEPARENT_HEADER) == "" || client.GetHeader(TRACESTATE_HEADER) != "vendor=value" {
+		t.Fatalf("Expected trace headers injected, got %v", client.header)
+	}
+
+	// A traced call without trace state drops the previous one.
+	_, span = StartClientSpan(context.Background(), "second", trans)
+	span.End()
+	if client.GetHeader(TRACEPARENT_HEADER) == "" || client.GetHeader(TRACESTATE_HEADER) != "" {
+		t.Errorf("Expected only a traceparent, got %v", client.header)
+	}
+
+	// An untraced call sends neither.
+	SetDefaultTracer(nil)
+	_, span = StartClientSpan(context.Background(), "third", trans)
+	span.End()
+	if client.GetHeader(TRACEPARENT_HEADER) != "" || client.GetHeader(TRACESTATE_HEADER) != "" {
+		t.Errorf("Expected no trace headers, got %v", client.header)
+	}
+}
@@ -0,0 +1,454 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many idle transports a TTransportPool keeps, unless configured
+// otherwise.
+const DEFAULT_POOL_MAX_IDLE = 2
+
+// Opens a transport for a TTransportPool, ready for use.
+type TTransportDialer func(ctx context.Context) (TTransport, error)
+
+// Returns a dialer connecting a TSocket to addr and wrapping it with
+// factory, such as a framed or buffered transport factory, if not nil.
+// timeout is passed on to the socket.
+func NewTSocketDialer(addr string, timeout time.Duration, factory TTransportFactory) TTransportDialer {
+	return func(ctx context.Context) (TTransport, error) {
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, NewTTransportException(NOT_OPEN, err.Error())
+		}
+		return wrapDialedTransport(NewTSocketFromConnTimeout(conn, timeout), factory), nil
+	}
+}
+
+// Returns a dialer connecting a TSSLSocket to addr, completing the TLS
+// handshake, and wrapping it with factory if not nil.
+func NewTSSLSocketDialer(addr string, cfg *tls.Config, timeout time.Duration, factory TTransportFactory) TTransportDialer {
+	return func(ctx context.Context) (TTransport, error) {
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout}, Config: cfg}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, NewTTransportException(NOT_OPEN, err.Error())
+		}
+		return wrapDialedTransport(NewTSSLSocketFromConnTimeout(conn, cfg, timeout), factory), nil
+	}
+}
+
+func wrapDialedTransport(trans TTransport, factory TTransportFactory) TTransport {
+	if factory == nil {
+		return trans
+	}
+	return factory.GetTransport(trans)
+}
+
+// Usage statistics of a TTransportPool.
+type TTransportPoolStats struct {
+	// The transports open, whether in use or idle.
+	Open  int
+	InUse int
+	Idle  int
+	// The transports opened so far.
+	Dialed int64
+	// The number of times Get had to wait for a transport to be returned,
+	// and for how long altogether.
+	Waits        int64
+	WaitDuration time.Duration
+	// The number of times Get gave up waiting.
+	WaitTimeouts int64
+	// The transports closed after an error or failing validation, and
+	// those closed for exceeding the maximum lifetime.
+	Discarded int64
+	Expired   int64
+}
+
+// A pool of open transports to a server, each used by one caller at a
+// time. Transports are borrowed with Get and returned by closing them.
+// Those that failed a read, write or flush are closed instead of being
+// returned, as are those older than the maximum lifetime.
+type TTransportPool struct {
+	dial TTransportDialer
+
+	mu          sync.Mutex
+	idle        []*TPooledTransport
+	open        int
+	waiters     []chan *TPooledTransport
+	closed      bool
+	maxIdle     int
+	maxOpen     int
+	maxLifetime time.Duration
+	waitTimeout time.Duration
+	validate    func(TTransport) error
+	stats       TTransportPoolStats
+}
+
+func NewTTransportPool(dial TTransportDialer) *TTransportPool {
+	return &TTransportPool{dial: dial, maxIdle: DEFAULT_POOL_MAX_IDLE}
+}
+
+// Sets how many transports are kept open while unused.
+func (p *TTransportPool) SetMaxIdle(maxIdle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxIdle = maxIdle
+}
+
+// Sets how many transports may be open at once, Get waiting for one to be
+// returned beyond that. Zero means no limit.
+func (p *TTransportPool) SetMaxOpen(maxOpen int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxOpen = maxOpen
+}
+
+// Sets how long a transport is used for after being opened. Zero means no
+// limit.
+func (p *TTransportPool) SetMaxLifetime(lifetime time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxLifetime = lifetime
+}
+
+// Sets how long Get waits for a transport when MaxOpen are in use. Zero
+// means waiting as long as the context allows.
+func (p *TTransportPool) SetWaitTimeout(timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waitTimeout = timeout
+}
+
+// Sets the check idle transports must pass to be borrowed. Those failing it
+// are closed. By default, transports must be open.
+func (p *TTransportPool) SetValidator(validate func(TTransport) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.validate = validate
+}
+
+func (p *TTransportPool) Stats() TTransportPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Open = p.open
+	stats.Idle = len(p.idle)
+	stats.InUse = p.open - len(p.idle)
+	return stats
+}
+
+var (
+	errPoolClosed      = NewTTransportException(NOT_OPEN, "Transport pool closed")
+	errPoolWaitTimeout = NewTTransportException(TIMED_OUT, "Timed out waiting for a pooled transport")
+)
+
+// Lends out transports to make calls on, as TTransportPool and TBalancer
+// do.
+type TTransportSource interface {
+	Get(ctx context.Context) (*TPooledTransport, error)
+}
+
+// Borrows a transport, reusing an idle one if possible. The transport must
+// be closed once done with, which returns it to the pool.
+func (p *TTransportPool) Get(ctx context.Context) (*TPooledTransport, error) {
+	trans, err := p.get(ctx)
+	if err != nil || trans.TTransport != nil {
+		return trans, err
+	}
+	// There is room for another transport.
+	if trans.TTransport, err = p.dial(ctx); err != nil {
+		p.release()
+		return nil, err
+	}
+	trans.created = time.Now()
+	p.mu.Lock()
+	p.stats.Dialed++
+	p.mu.Unlock()
+	return trans, nil
+}
+
+// get returns an idle transport that passed validation, or one without an
+// underlying transport if the caller may open one.
+func (p *TTransportPool) get(ctx context.Context) (*TPooledTransport, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			trans := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			expired := p.expiredLocked(trans)
+			validate := p.validate
+			p.mu.Unlock()
+			if expired {
+				p.discard(trans, true)
+				continue
+			}
+			if !p.valid(trans, validate) {
+				p.discard(trans, false)
+				continue
+			}
+			trans.returned = false
+			return trans, nil
+		}
+		if p.maxOpen <= 0 || p.open < p.maxOpen {
+			p.open++
+			p.mu.Unlock()
+			return &TPooledTransport{pool: p}, nil
+		}
+		return p.waitLocked(ctx)
+	}
+}
+
+func (p *TTransportPool) valid(trans *TPooledTransport, validate func(TTransport) error) bool {
+	if validate == nil {
+		return trans.IsOpen()
+	}
+	return validate(trans.TTransport) == nil
+}
+
+func (p *TTransportPool) expiredLocked(trans *TPooledTransport) bool {
+	return p.maxLifetime > 0 && time.Since(trans.created) >= p.maxLifetime
+}
+
+// waitLocked waits for a transport to be returned, or for a slot to be
+// freed. Must be called with p.mu held, which it releases.
+func (p *TTransportPool) waitLocked(ctx context.Context) (*TPooledTransport, error) {
+	ready := make(chan *TPooledTransport, 1)
+	p.waiters = append(p.waiters, ready)
+	p.stats.Waits++
+	var timeout <-chan time.Time
+	if p.waitTimeout > 0 {
+		timer := time.NewTimer(p.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	p.mu.Unlock()
+	start := time.Now()
+	defer func() {
+		p.mu.Lock()
+		p.stats.WaitDuration += time.Since(start)
+		p.mu.Unlock()
+	}()
+
+	var err error
+	select {
+	case trans, ok := <-ready:
+		if !ok {
+			return nil, errPoolClosed
+		}
+		return p.handedOver(trans)
+	case <-ctx.Done():
+		err = contextTransportException(ctx.Err())
+	case <-timeout:
+		err = errPoolWaitTimeout
+	}
+	p.mu.Lock()
+	p.stats.WaitTimeouts++
+	for i, w := range p.waiters {
+		if w == ready {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.mu.Unlock()
+			return nil, err
+		}
+	}
+	p.mu.Unlock()
+	// A transport was handed over as we gave up: pass it on.
+	if trans, ok := <-ready; !ok {
+		return nil, errPoolClosed
+	} else if trans == nil {
+		p.release()
+	} else {
+		p.put(trans)
+	}
+	return nil, err
+}
+
+// handedOver validates a transport handed to a waiting Get, which is nil if
+// a new transport may be opened instead.
+func (p *TTransportPool) handedOver(trans *TPooledTransport) (*TPooledTransport, error) {
+	if trans == nil {
+		return &TPooledTransport{pool: p}, nil
+	}
+	p.mu.Lock()
+	validate := p.validate
+	p.mu.Unlock()
+	if !p.valid(trans, validate) {
+		p.discard(trans, false)
+		return &TPooledTransport{pool: p}, nil
+	}
+	trans.returned = false
+	return trans, nil
+}
+
+// put returns a transport to the pool, handing it to a waiting Get if
+// there is one.
+func (p *TTransportPool) put(trans *TPooledTransport) {
+	p.mu.Lock()
+	if !p.closed && !p.expiredLocked(trans) {
+		if len(p.waiters) > 0 {
+			ready := p.waiters[0]
+			p.waiters = p.waiters[1:]
+			p.mu.Unlock()
+			ready <- trans
+			return
+		}
+		if len(p.idle) < p.maxIdle {
+			p.idle = append(p.idle, trans)
+			p.mu.Unlock()
+			return
+		}
+	}
+	expired := p.expiredLocked(trans)
+	p.mu.Unlock()
+	p.discard(trans, expired)
+}
+
+// discard closes a transport and frees its slot.
+func (p *TTransportPool) discard(trans *TPooledTransport, expired bool) {
+	trans.TTransport.Close()
+	p.mu.Lock()
+	if expired {
+		p.stats.Expired++
+	} else if !p.closed {
+		p.stats.Discarded++
+	}
+	p.mu.Unlock()
+	p.release()
+}
+
+// release frees the slot of a transport that was closed or never opened,
+// letting a waiting Get open another.
+func (p *TTransportPool) release() {
+	p.mu.Lock()
+	if len(p.waiters) > 0 {
+		ready := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		ready <- nil
+		return
+	}
+	p.open--
+	p.mu.Unlock()
+}
+
+// Closes the idle transports and makes Get fail. Transports in use are
+// closed when returned.
+func (p *TTransportPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	waiters := p.waiters
+	p.idle = nil
+	p.waiters = nil
+	p.closed = true
+	p.open -= len(idle)
+	p.mu.Unlock()
+	for _, trans := range idle {
+		trans.TTransport.Close()
+	}
+	for _, ready := range waiters {
+		close(ready)
+	}
+	return nil
+}
+
+// A transport borrowed from a TTransportPool. Closing it returns it to the
+// pool, unless it failed.
+type TPooledTransport struct {
+	TTransport
+	pool     *TTransportPool
+	created  time.Time
+	failed   int32
+	returned bool
+	// Called when the transport is closed, with whether it failed.
+	onClose func(failed bool)
+}
+
+func (p *TPooledTransport) Read(buf []byte) (int, error) {
+	n, err := p.TTransport.Read(buf)
+	if err != nil {
+		atomic.StoreInt32(&p.failed, 1)
+	}
+	return n, err
+}
+
+func (p *TPooledTransport) Write(buf []byte) (int, error) {
+	n, err := p.TTransport.Write(buf)
+	if err != nil {
+		atomic.StoreInt32(&p.failed, 1)
+	}
+	return n, err
+}
+
+func (p *TPooledTransport) Flush() error {
+	err := p.TTransport.Flush()
+	if err != nil {
+		atomic.StoreInt32(&p.failed, 1)
+	}
+	return err
+}
+
+// Interrupts the underlying transport if it supports that, as TSocket
+// does, so that it is closed rather than returned to the pool.
+func (p *TPooledTransport) Interrupt() error {
+	atomic.StoreInt32(&p.failed, 1)
+	if trans, ok := p.TTransport.(interface {
+		Interrupt() error
+	}); ok {
+		return trans.Interrupt()
+	}
+	return nil
+}
+
+// Closes the transport rather than returning it to the pool, as when it is
+// left in an unknown state.
+func (p *TPooledTransport) Discard() {
+	atomic.StoreInt32(&p.failed, 1)
+	p.Close()
+}
+
+// Returns the transport to the pool.
+func (p *TPooledTransport) Close() error {
+	if p.returned {
+		return nil
+	}
+	p.returned = true
+	failed := atomic.LoadInt32(&p.failed) != 0
+	if p.onClose != nil {
+		p.onClose(failed)
+		p.onClose = nil
+	}
+	if failed {
+		p.pool.discard(p, false)
+		return nil
+	}
+	p.pool.put(p)
+	return nil
+}
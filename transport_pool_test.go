@@ -0,0 +1,200 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements. See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership. The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License. You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied. See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package thrift
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A dialer of memory buffers, counting the transports opened and closed.
+type testPoolDialer struct {
+	dialed int32
+	closed int32
+}
+
+type testPoolTransport struct {
+	*TMemoryBuffer
+	dialer *testPoolDialer
+}
+
+func (p *testPoolTransport) Close() error {
+	atomic.AddInt32(&p.dialer.closed, 1)
+	return nil
+}
+
+func (p *testPoolDialer) dial(ctx context.Context) (TTransport, error) {
+	atomic.AddInt32(&p.dialed, 1)
+	return &testPoolTransport{TMemoryBuffer: NewTMemoryBuffer(), dialer: p}, nil
+}
+
+func getPooled(t *testing.T, pool *TTransportPool) *TPooledTransport {
+	trans, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to get a transport: %v", err)
+	}
+	return trans
+}
+
+func TestTransportPoolReuse(t *testing.T) {
+	dialer := &testPoolDialer{}
+	pool := NewTTransportPool(dialer.dial)
+	pool.SetMaxIdle(1)
+	a := getPooled(t, pool)
+	a.Close()
+	if b := getPooled(t, pool); b != a {
+		t.Error("Expected the idle transport to be reused")
+	}
+	c := getPooled(t, pool)
+	if stats := pool.Stats(); stats.Open != 2 || stats.InUse != 2 || stats.Dialed != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	a.Close()
+	c.Close()
+	if stats := pool.Stats(); stats.Open != 1 || stats.Idle != 1 || dialer.closed != 1 {
+		t.Errorf("Expected one transport beyond MaxIdle to be closed: %+v", stats)
+	}
+	a.Close()
+	if stats := pool.Stats(); stats.Idle != 1 {
+		t.Errorf("Expected closing twice to have no effect: %+v", stats)
+	}
+}
+
+func TestTransportPoolDiscard(t *testing.T) {
+	dialer := &testPoolDialer{}
+	pool := NewTTransportPool(dialer.dial)
+	trans := getPooled(t, pool)
+	if _, err := trans.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected reading an empty buffer to fail")
+	}
+	trans.Close()
+	if stats := pool.Stats(); stats.Open != 0 || stats.Discarded != 1 || dialer.closed != 1 {
+		t.Errorf("Expected a failed transport to be discarded: %+v", stats)
+	}
+
+	getPooled(t, pool).Close()
+	pool.SetValidator(func(TTransport) error { return errors.New("stale") })
+	getPooled(t, pool)
+	if stats := pool.Stats(); stats.Open != 1 || stats.Discarded != 2 || stats.Dialed != 3 {
+		t.Errorf("Expected a transport failing validation to be replaced: %+v", stats)
+	}
+
+	pool.SetValidator(nil)
+	pool.SetMaxLifetime(20 * time.Millisecond)
+	trans = getPooled(t, pool)
+	trans.Close()
+	time.Sleep(30 * time.Millisecond)
+	if getPooled(t, pool) == trans {
+		t.Error("Expected an expired transport to be replaced")
+	}
+	if stats := pool.Stats(); stats.Expired != 1 {
+		t.Errorf("Expected an expired transport: %+v", stats)
+	}
+}
+
+func TestTransportPoolMaxOpen(t *testing.T) {
+	dialer := &testPoolDialer{}
+	pool := NewTTransportPool(dialer.dial)
+	pool.SetMaxOpen(1)
+	pool.SetWaitTimeout(50 * time.Millisecond)
+	a := getPooled(t, pool)
+	_, err := pool.Get(context.Background())
+	if exc, ok := err.(TTransportException); !ok || exc.TypeId() != TIMED_OUT {
+		t.Errorf("Expected waiting to time out, got %v", err)
+	}
+
+	got := make(chan *TPooledTransport)
+	go func() {
+		trans, _ := pool.Get(context.Background())
+		got <- trans
+	}()
+	time.Sleep(20 * time.Millisecond)
+	a.Close()
+	if b := <-got; b != a {
+		t.Error("Expected the returned transport to be handed to the waiting Get")
+	}
+
+	go func() {
+		trans, _ := pool.Get(context.Background())
+		got <- trans
+	}()
+	time.Sleep(20 * time.Millisecond)
+	a.Discard()
+	if b := <-got; b == nil || b == a {
+		t.Error("Expected the waiting Get to open a transport in place of the discarded one")
+	}
+	if stats := pool.Stats(); stats.Open != 1 || stats.Waits != 3 || stats.WaitTimeouts != 1 || stats.WaitDuration < 50*time.Millisecond {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := pool.Get(ctx); err == nil {
+		t.Error("Expected waiting to end with the context")
+	}
+	pool.SetWaitTimeout(0)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pool.Close()
+	}()
+	if _, err := pool.Get(context.Background()); err != errPoolClosed {
+		t.Errorf("Expected waiting to end when the pool is closed, got %v", err)
+	}
+}
+
+func TestTransportPoolSockets(t *testing.T) {
+	server, addr, done := startTestServer(t, &sleepProcessor{})
+	defer func() {
+		server.Stop()
+		waitServe(t, done)
+	}()
+	pool := NewTTransportPool(NewTSocketDialer(addr, 2*time.Second, NewTBufferedTransportFactory(1024)))
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		trans := getPooled(t, pool)
+		client := NewTStandardClientFactory2(trans, NewTBinaryProtocolFactoryDefault())
+		if err := client.Call(context.Background(), "test", &testSleepArgs{}, &testEmptyResult{}); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		trans.Close()
+	}
+	if stats := pool.Stats(); stats.Dialed != 1 {
+		t.Errorf("Expected the connection to be reused: %+v", stats)
+	}
+
+	trans := getPooled(t, pool)
+	client := NewTStandardClientFactory2(trans, NewTBinaryProtocolFactoryDefault())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.Call(ctx, "slow", &testSleepArgs{sleep: 200}, &testEmptyResult{}); err == nil {
+		t.Fatal("Expected the call to time out")
+	}
+	trans.Close()
+	if stats := pool.Stats(); stats.Open != 0 || stats.Discarded != 1 {
+		t.Errorf("Expected the interrupted connection to be discarded: %+v", stats)
+	}
+}